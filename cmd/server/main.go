@@ -19,43 +19,102 @@ func main() {
 		log.Fatalf("[ERROR] Failed to load config: %v", err)
 	}
 
-	wal, err := storage.NewWAL()
+	walOpts := storage.DefaultWALOptions()
+	walOpts.Durability = cfg.WALDurability
+	walOpts.GroupCommitWait = time.Duration(cfg.WALGroupCommitWait) * time.Microsecond
+	walOpts.SyncInterval = time.Duration(cfg.WALSyncInterval) * time.Millisecond
+	wal, err := storage.OpenWAL(walOpts)
 	if err != nil {
 		log.Fatalf("[ERROR] Failed to initialize WAL: %v", err)
 	}
 	defer wal.Close()
 
-	sstable, err := storage.NewSSTable(cfg.SSTablePath)
+	// Process-wide memory budget shared by memtables, the block cache and SSTable indexes
+	var budget *storage.MemoryBudget
+	if cfg.MemoryBudget > 0 {
+		budget = storage.NewMemoryBudget(cfg.MemoryBudget)
+	}
+
+	// Block cache shared by every SSTable, sized by what the budget leaves
+	lsmOpts := storage.DefaultLSMOptions()
+	if cfg.BlockCacheSize >= 0 {
+		cacheOpts := storage.DefaultBlockCacheOptions()
+		cacheOpts.Capacity = cfg.BlockCacheSize
+		cacheOpts.PinIndexAndFilter = !cfg.BlockCacheIndexes
+		cacheOpts.Budget = budget
+		lsmOpts.BlockCache = storage.NewBlockCache(cacheOpts)
+	}
+	lsmOpts.SSTable.BloomBitsPerKey = cfg.BloomBitsPerKey
+	lsmOpts.SSTable.Compression = cfg.SSTableCompression
+	lsmOpts.Budget = budget
+
+	tree, err := storage.OpenLSMTree(cfg.SSTableDir, lsmOpts)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to open SSTables: %v", err)
+	}
+	defer tree.Close()
+
+	// Background compaction (merges SSTables off the request path)
+	compactionOpts := storage.DefaultCompactionOptions()
+	compactionOpts.Strategy = cfg.CompactionStrategy
+	compactionOpts.TimeWindow = time.Duration(cfg.CompactionWindow) * time.Second
+	compactionOpts.WindowRetention = time.Duration(cfg.CompactionRetention) * time.Second
+	compactionOpts.RateLimitBytesPerSec = cfg.CompactionRateLimit
+	compactor, err := storage.NewCompactor(tree, compactionOpts)
 	if err != nil {
-		log.Fatalf("[ERROR] Failed to initialize SSTable: %v", err)
+		log.Fatalf("[ERROR] Failed to configure compaction: %v", err)
 	}
+	compactor.Start()
+	defer compactor.Stop()
 
-	// Initialize Memtable (Flushes to SSTable when full)
-	memtable := storage.NewMemtable(cfg.MemtableMaxEntries, func(data map[string]string) {
-		for key, value := range data {
-			if err := sstable.Write(key, value); err != nil {
-				log.Printf("[ERROR] Failed to flush Memtable to SSTable: %v", err)
-			}
+	// Initialize Memtable (Frozen when full and flushed to a new L0 SSTable in the background)
+	memtableOpts := storage.DefaultMemtableOptions()
+	memtableOpts.MaxBytes = cfg.MemtableMaxBytes
+	memtableOpts.Budget = budget
+	memtable := storage.NewMemtable(memtableOpts, func(it *storage.MemtableIterator, seq uint64) error {
+		// A failed flush is retried by the Memtable; the WAL keeps its records meanwhile.
+		if err := tree.FlushMemtable(it); err != nil {
+			return fmt.Errorf("flush Memtable to SSTable: %w", err)
+		}
+		// Records up to seq are now in an SSTable; WAL segments holding only those can go.
+		// A failed checkpoint only keeps them longer: the next one covers them.
+		if err := wal.Checkpoint(seq); err != nil {
+			log.Printf("[ERROR] Failed to checkpoint WAL: %v", err)
 		}
-		wal.Flush()
+		compactor.Notify()
+		return nil
 	})
 
-	// WAL Recovery: Restore Data to Memtable After a Crash
-	restoredData, err := wal.Replay()
+	defer memtable.Close()
+
+	// WAL Recovery: Restore records written since the last checkpoint to Memtable After a Crash
+	restored := 0
+	err = wal.ReplayRecords(func(rec storage.WALRecord) {
+		// Reinserting WAL entries into Memtable in sequence order, deletes as tombstones
+		// and range deletes as range tombstones
+		memtable.ApplyBatch(rec)
+		restored++
+	})
 	if err != nil {
 		log.Fatalf("[ERROR] WAL replay failed: %v", err)
 	}
-	for key, value := range restoredData {
-		memtable.Set(key, value) // Reinserting WAL entries into Memtable
-	}
-	log.Printf("[INFO] WAL replay restored %d entries to Memtable", len(restoredData))
+	log.Printf("[INFO] WAL replay restored %d records to Memtable", restored)
 
 	// Initialize Handlers
-	writeHandler := handler.NewWriteHandler(wal, memtable, sstable)
-	readHandler := handler.NewReadHandler(memtable, sstable)
-	deleteHandler := handler.NewDeleteHandler(memtable, sstable)
+	// Size limits on writes; negative configured values mean no limit
+	limits := storage.Limits{
+		MaxKeyBytes:     max(cfg.MaxKeyBytes, 0),
+		MaxValueBytes:   max(cfg.MaxValueBytes, 0),
+		MaxBatchEntries: max(cfg.MaxBatchEntries, 0),
+		MaxBatchBytes:   max(cfg.MaxBatchBytes, 0),
+	}
+	writer := storage.NewWriter(wal, memtable, limits)
+	writeHandler := handler.NewWriteHandler(writer, max(cfg.MaxRequestBytes, 0))
+	readHandler := handler.NewReadHandler(memtable, tree)
+	deleteHandler := handler.NewDeleteHandler(writer, max(cfg.MaxRequestBytes, 0))
+	statsHandler := handler.NewStatsHandler(wal, memtable, tree, compactor, budget)
 
-	requestHandler := handler.NewRequestHandler(readHandler, writeHandler, deleteHandler)
+	requestHandler := handler.NewRequestHandler(readHandler, writeHandler, deleteHandler, statsHandler)
 
 	router := api.NewRouter(requestHandler)
 
@@ -2,35 +2,72 @@ package api
 
 import (
 	"moniepoint/internal/handler"
+	"moniepoint/internal/utils"
 	"net/http"
+	"strings"
 )
 
 func NewRouter(requestHandler *handler.RequestHandler) http.Handler {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/kv/", func(w http.ResponseWriter, r *http.Request) {
+	kv := func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
 			requestHandler.HandleWrite(w, r)
 		case http.MethodGet:
-			if r.URL.Query().Has("start") && r.URL.Query().Has("end") {
+			// Without a key, the request is a range scan. Bounds or a
+			// prefix would be ignored by a read of a single key
+			key := utils.GetKeyFromPath(r.URL.EscapedPath())
+			switch {
+			case key == "":
 				requestHandler.HandleReadRange(w, r)
-			} else {
+			case hasRangeParams(r):
+				http.Error(w, "A key cannot be combined with start, end or prefix", http.StatusBadRequest)
+			default:
 				requestHandler.HandleRead(w, r)
 			}
 		case http.MethodDelete:
-			requestHandler.HandleDelete(w, r)
+			// With bounds or a prefix, and no key, the request deletes a
+			// range. With a key as well, it is rejected rather than guess
+			// which of the two was meant
+			key := utils.GetKeyFromPath(r.URL.EscapedPath())
+			switch {
+			case !hasRangeParams(r):
+				requestHandler.HandleDelete(w, r)
+			case key != "":
+				http.Error(w, "A key cannot be combined with start, end or prefix", http.StatusBadRequest)
+			default:
+				requestHandler.HandleDeleteRange(w, r)
+			}
 		default:
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		}
-	})
+	}
+	mux.HandleFunc("/kv/", kv)
 
-	mux.HandleFunc("/kv/batch", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPost {
+	batch := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
 			requestHandler.HandleBatchWrite(w, r)
-		} else {
+		case http.MethodDelete:
+			requestHandler.HandleBatchDelete(w, r)
+		default:
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		}
+	}
+	// Outside /kv/, so that every key, "batch" included, can be written
+	mux.HandleFunc("/batch/kv", batch)
+
+	mux.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
+		requestHandler.HandleList(w, r)
+	})
+
+	mux.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		requestHandler.HandleLimits(w, r)
+	})
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		requestHandler.HandleStats(w, r)
 	})
 
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -38,5 +75,27 @@ func NewRouter(requestHandler *handler.RequestHandler) http.Handler {
 		w.Write([]byte(`{"status": "ok"}`))
 	})
 
-	return mux
+	// Keys are the whole rest of the path, so they are routed before the
+	// mux, which would redirect paths with empty, "." or ".." segments to
+	// a cleaned path naming another key
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The old batch path is kept for existing clients. Only the literal
+		// path is an alias: the key "batch" is still written and deleted as
+		// /kv/%62atch
+		if r.URL.EscapedPath() == "/kv/batch" && (r.Method == http.MethodPost || r.Method == http.MethodDelete) {
+			batch(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/kv/") {
+			kv(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// hasRangeParams reports whether r bounds a range with start, end or prefix.
+func hasRangeParams(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Has("start") || q.Has("end") || q.Has("prefix")
 }
@@ -1,6 +1,8 @@
 package handler
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 
@@ -10,13 +12,24 @@ import (
 
 // DeleteHandler handles key deletion.
 type DeleteHandler struct {
-	memtable *storage.Memtable
-	sstable  *storage.SSTable
+	writer          *storage.Writer
+	maxRequestBytes int64 // 0 for no limit
 }
 
-// NewDeleteHandler initializes DeleteHandler.
-func NewDeleteHandler(memtable *storage.Memtable, sstable *storage.SSTable) *DeleteHandler {
-	return &DeleteHandler{memtable, sstable}
+// BatchDeleteRequest is one entry of a batch delete. Encoding, if set, is
+// "base64" and applies to Key (see encoding.go).
+type BatchDeleteRequest struct {
+	Key      string `json:"key"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// NewDeleteHandler initializes DeleteHandler, which rejects batch delete
+// bodies over maxRequestBytes.
+func NewDeleteHandler(writer *storage.Writer, maxRequestBytes int64) *DeleteHandler {
+	return &DeleteHandler{
+		writer:          writer,
+		maxRequestBytes: maxRequestBytes,
+	}
 }
 
 // HandleDelete processes an HTTP DELETE request.
@@ -26,26 +39,133 @@ func (dh *DeleteHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	key := utils.GetKeyFromPath(r.URL.Path)
+	key := utils.GetKeyFromPath(r.URL.EscapedPath())
 	if key == "" {
 		http.Error(w, "Missing key in URL", http.StatusBadRequest)
 		return
 	}
 
-	if err := dh.Delete(key); err != nil {
-		http.Error(w, "Failed to delete key", http.StatusInternalServerError)
+	durability, err := requestedDurability(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	achieved, err := dh.Delete(key, durability)
+	if err != nil {
+		if !limitError(w, err) {
+			http.Error(w, "Failed to delete key", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set(DurabilityHeader, achieved)
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// Delete removes a key from both Memtable and SSTable.
-func (dh *DeleteHandler) Delete(key string) error {
-	dh.memtable.Delete(key)
-	if err := dh.sstable.Delete(key); err != nil {
-		log.Printf("Failed to delete key=%s from SSTable: %v", key, err)
-		return err
+// Delete writes a tombstone for key to the WAL and the Memtable. The
+// tombstone shadows the key in older SSTables until compaction drops both.
+// It returns the durability reached, at least the requested one.
+func (dh *DeleteHandler) Delete(key, durability string) (string, error) {
+	// Append the tombstone to WAL and record it in Memtable (persisted to an
+	// SSTable when it flushes), as durable as requested.
+	achieved, err := dh.writer.Delete(key, durability)
+	if err != nil {
+		log.Printf("[ERROR] WAL delete failed for key=%s: %v", key, err)
+		return "", err
+	}
+	return achieved, nil
+}
+
+// HandleBatchDelete processes an HTTP DELETE request for deleting a list of
+// keys atomically.
+func (dh *DeleteHandler) HandleBatchDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	durability, err := requestedDurability(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limitBody(w, r, dh.maxRequestBytes)
+	var batchReq []BatchDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&batchReq); err != nil {
+		err = bodyError(err, "Invalid JSON request")
+		if !limitError(w, err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	if len(batchReq) == 0 {
+		http.Error(w, "Empty batch", http.StatusBadRequest)
+		return
+	}
+
+	keys := make([]string, len(batchReq))
+	for i, entry := range batchReq {
+		key, err := decodeText(entry.Key, entry.Encoding)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Entry %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		keys[i] = key
+	}
+	// One tombstone per key, all logged as one WAL record
+	achieved, err := dh.writer.DeleteBatch(keys, durability)
+	if limitError(w, err) {
+		return
 	}
-	return nil
+	if err != nil {
+		log.Printf("[ERROR] WAL batch delete failed: %v", err)
+		http.Error(w, "Batch WAL Delete Failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(DurabilityHeader, achieved)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleDeleteRange processes an HTTP DELETE request for every key in a
+// range, given like the range of a scan (see parseScan) but with an end or
+// a prefix: an open-ended delete has to name its last key.
+func (dh *DeleteHandler) HandleDeleteRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	durability, err := requestedDurability(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scan, err := parseScan(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end := scan.halfOpen()
+	if end == "" {
+		http.Error(w, "Missing end or prefix", http.StatusBadRequest)
+		return
+	}
+
+	// A single range tombstone, however many keys it covers
+	achieved, err := dh.writer.DeleteRange(start, end, durability)
+	if limitError(w, err) {
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] WAL range delete failed for [%q, %q): %v", start, end, err)
+		http.Error(w, "Failed to delete range", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(DurabilityHeader, achieved)
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Keys and values are arbitrary bytes. JSON strings can only carry UTF-8,
+// so in JSON bodies a key or value may be base64-encoded, which the object
+// holding it says with "encoding": "base64". Writes accept either form;
+// responses use base64 when the request asks for it with encoding=base64,
+// or when a key or value is not valid UTF-8 and would otherwise be mangled.
+// Single values may also be written and read as raw bytes.
+const (
+	OctetStreamContentType = "application/octet-stream"
+	EncodingBase64         = "base64"
+)
+
+// encodeText returns s as it goes in a JSON body with the given encoding.
+func encodeText(s, encoding string) string {
+	if encoding == EncodingBase64 {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	return s
+}
+
+// decodeText reverses encodeText for a key or value from a request body.
+func decodeText(s, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return s, nil
+	case EncodingBase64:
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", fmt.Errorf("Invalid base64: %v", err)
+		}
+		return string(b), nil
+	default:
+		return "", fmt.Errorf("Invalid encoding: %q", encoding)
+	}
+}
+
+// textEncoding returns the encoding for a response holding texts: base64 if
+// forced or if any of them is not valid UTF-8, otherwise none.
+func textEncoding(force bool, texts ...string) string {
+	if force {
+		return EncodingBase64
+	}
+	for _, s := range texts {
+		if !utf8.ValidString(s) {
+			return EncodingBase64
+		}
+	}
+	return ""
+}
+
+// forceBase64 reports whether the request asks for base64 with the
+// encoding query parameter.
+func forceBase64(r *http.Request) (bool, error) {
+	switch encoding := r.URL.Query().Get("encoding"); encoding {
+	case "":
+		return false, nil
+	case EncodingBase64:
+		return true, nil
+	default:
+		return false, fmt.Errorf("Invalid encoding: %q", encoding)
+	}
+}
+
+// isOctetStream reports whether a request body is a raw value.
+func isOctetStream(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == OctetStreamContentType
+}
+
+// wantsOctetStream reports whether a read asks for the raw value, with
+// format=raw or by accepting application/octet-stream.
+func wantsOctetStream(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "raw" || strings.Contains(r.Header.Get("Accept"), OctetStreamContentType)
+}
@@ -0,0 +1,116 @@
+package handler_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"moniepoint/internal/handler"
+)
+
+// Keys and values with bytes that JSON, paths or line-based formats tend to
+// mangle. The first pair is not valid UTF-8, so JSON responses carry it in
+// base64; the second is, so they carry it as is.
+var (
+	binaryKey   = "k\x00\xff:\n"
+	binaryValue = "v\x00\xff:\nend"
+	textKey     = "t\x00:\n"
+	textValue   = "x\x00:\ny"
+)
+
+// readJSON returns the key, value and encoding of the JSON response to a
+// read of path, query included, with the key and value decoded.
+func (s *testServer) readJSON(t *testing.T, path string) (key, value, encoding string) {
+	t.Helper()
+	rec := s.do(t, http.MethodGet, path)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: expected 200, got %d: %s", path, rec.Code, rec.Body)
+	}
+	var resp struct {
+		Key      string `json:"key"`
+		Value    string `json:"value"`
+		Encoding string `json:"encoding"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("GET %s: invalid response %q: %v", path, rec.Body, err)
+	}
+	if resp.Encoding == handler.EncodingBase64 {
+		return decodeBase64(t, resp.Key), decodeBase64(t, resp.Value), resp.Encoding
+	}
+	return resp.Key, resp.Value, resp.Encoding
+}
+
+// checkReads verifies that key reads back as value in every format: raw
+// with format=raw, raw with Accept, and JSON with the given encoding.
+func (s *testServer) checkReads(t *testing.T, key, value, encoding string) {
+	t.Helper()
+	path := "/kv/" + url.PathEscape(key)
+
+	if got := s.read(t, path); got != value {
+		t.Errorf("format=raw: expected %q, got %q", value, got)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Accept", handler.OctetStreamContentType)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if ct := rec.Header().Get("Content-Type"); rec.Code != http.StatusOK || ct != handler.OctetStreamContentType {
+		t.Errorf("Accept: expected 200 %s, got %d %s", handler.OctetStreamContentType, rec.Code, ct)
+	}
+	if got := rec.Body.String(); got != value {
+		t.Errorf("Accept: expected %q, got %q", value, got)
+	}
+
+	gotKey, gotValue, gotEncoding := s.readJSON(t, path)
+	if gotKey != key || gotValue != value || gotEncoding != encoding {
+		t.Errorf("JSON: expected (%q, %q, %q), got (%q, %q, %q)", key, value, encoding, gotKey, gotValue, gotEncoding)
+	}
+	if _, gotValue, gotEncoding := s.readJSON(t, path+"?encoding=base64"); gotValue != value || gotEncoding != handler.EncodingBase64 {
+		t.Errorf("encoding=base64: expected (%q, base64), got (%q, %q)", value, gotValue, gotEncoding)
+	}
+}
+
+// TestOctetStreamRoundTrip verifies that a value written as the raw request
+// body reads back byte for byte.
+func TestOctetStreamRoundTrip(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, kv := range [][2]string{{binaryKey, binaryValue}, {textKey, textValue}} {
+		req := httptest.NewRequest(http.MethodPost, "/kv/"+url.PathEscape(kv[0]), strings.NewReader(kv[1]))
+		req.Header.Set("Content-Type", handler.OctetStreamContentType)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("POST %q: expected 201, got %d: %s", kv[0], rec.Code, rec.Body)
+		}
+	}
+
+	srv.checkReads(t, binaryKey, binaryValue, handler.EncodingBase64)
+	srv.checkReads(t, textKey, textValue, "")
+}
+
+// TestBase64JSONRoundTrip verifies that keys and values written base64-
+// encoded in JSON, by single and batch writes, read back byte for byte.
+func TestBase64JSONRoundTrip(t *testing.T) {
+	srv := newTestServer(t)
+	b64 := base64.StdEncoding.EncodeToString
+
+	body, _ := json.Marshal(map[string]string{"value": b64([]byte(binaryValue)), "encoding": handler.EncodingBase64})
+	if rec := srv.send(t, http.MethodPost, "/kv/"+url.PathEscape(binaryKey), string(body)); rec.Code != http.StatusCreated {
+		t.Fatalf("Single write: expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+
+	body, _ = json.Marshal([]handler.BatchWriteRequest{
+		{Key: b64([]byte(textKey)), Value: b64([]byte(textValue)), Encoding: handler.EncodingBase64},
+	})
+	if rec := srv.send(t, http.MethodPost, "/batch/kv", string(body)); rec.Code != http.StatusCreated {
+		t.Fatalf("Batch write: expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+
+	srv.checkReads(t, binaryKey, binaryValue, handler.EncodingBase64)
+	srv.checkReads(t, textKey, textValue, "")
+}
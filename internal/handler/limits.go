@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"moniepoint/internal/storage"
+)
+
+// DefaultMaxRequestBytes caps a write request body: room for a batch at the
+// default storage limits, base64-encoded in JSON.
+const DefaultMaxRequestBytes = 8 << 20
+
+// Codes of writes rejected for their size or shape, returned in the "code"
+// field of a JSON error body alongside a human-readable "error".
+const (
+	CodeRequestTooLarge = "request_too_large" // 413: the body is over max_request_bytes
+	CodeKeyTooLarge     = "key_too_large"     // 400: a key is over max_key_bytes
+	CodeValueTooLarge   = "value_too_large"   // 413: a value is over max_value_bytes
+	CodeBatchTooLarge   = "batch_too_large"   // 413: a batch is over max_batch_entries or max_batch_bytes
+	CodeEmptyKey        = "empty_key"         // 400: a batch entry has no key
+	CodeInvalidRange    = "invalid_range"     // 400: a range delete does not end after its start
+)
+
+// errRequestTooLarge reports a body cut off by http.MaxBytesReader.
+var errRequestTooLarge = errors.New("request body too large")
+
+// limitErrors maps each limit error to its code and status.
+var limitErrors = []struct {
+	err    error
+	code   string
+	status int
+}{
+	{errRequestTooLarge, CodeRequestTooLarge, http.StatusRequestEntityTooLarge},
+	{storage.ErrKeyTooLarge, CodeKeyTooLarge, http.StatusBadRequest},
+	{storage.ErrValueTooLarge, CodeValueTooLarge, http.StatusRequestEntityTooLarge},
+	{storage.ErrBatchTooLarge, CodeBatchTooLarge, http.StatusRequestEntityTooLarge},
+	{storage.ErrEmptyKey, CodeEmptyKey, http.StatusBadRequest},
+	{storage.ErrInvalidRange, CodeInvalidRange, http.StatusBadRequest},
+}
+
+// limitError writes the response for err if it is a limit error, and
+// reports whether it was.
+func limitError(w http.ResponseWriter, err error) bool {
+	for _, le := range limitErrors {
+		if errors.Is(err, le.err) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(le.status)
+			json.NewEncoder(w).Encode(map[string]string{"code": le.code, "error": err.Error()})
+			return true
+		}
+	}
+	return false
+}
+
+// limitBody stops reading the request body past maxBytes, if positive.
+func limitBody(w http.ResponseWriter, r *http.Request, maxBytes int64) {
+	if maxBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	}
+}
+
+// bodyError turns an error reading a request body into errRequestTooLarge
+// if the body was over the limit, or into msg otherwise.
+func bodyError(err error, msg string) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errRequestTooLarge
+	}
+	return errors.New(msg)
+}
+
+// limitsResponse is the body of GET /limits.
+type limitsResponse struct {
+	storage.Limits
+	MaxRequestBytes int64 `json:"max_request_bytes"`
+}
+
+// HandleLimits processes an HTTP GET request for the limits writes must
+// keep to, so clients can size keys, values and batches up front. A zero
+// limit means none.
+func (wh *WriteHandler) HandleLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limitsResponse{wh.writer.Limits(), wh.maxRequestBytes})
+}
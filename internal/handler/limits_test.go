@@ -0,0 +1,120 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"moniepoint/internal/handler"
+	"moniepoint/internal/storage"
+)
+
+// testLimits are small enough to break with short requests.
+var testLimits = storage.Limits{
+	MaxKeyBytes:     8,
+	MaxValueBytes:   16,
+	MaxBatchEntries: 2,
+	MaxBatchBytes:   32,
+}
+
+const testMaxRequestBytes = 256
+
+// TestWriteLimitErrors verifies the status and machine-readable code of
+// each write rejected for its size or shape, and that nothing is written.
+func TestWriteLimitErrors(t *testing.T) {
+	srv := newLimitedServer(t, testLimits, testMaxRequestBytes)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		code   string
+	}{
+		{"request too large", http.MethodPost, "/kv/a", `{"value": "` + strings.Repeat("x", testMaxRequestBytes) + `"}`,
+			http.StatusRequestEntityTooLarge, handler.CodeRequestTooLarge},
+		{"batch request too large", http.MethodPost, "/batch/kv", `[{"key": "a", "value": "` + strings.Repeat("x", testMaxRequestBytes) + `"}]`,
+			http.StatusRequestEntityTooLarge, handler.CodeRequestTooLarge},
+		{"batch delete request too large", http.MethodDelete, "/batch/kv", `[{"key": "` + strings.Repeat("x", testMaxRequestBytes) + `"}]`,
+			http.StatusRequestEntityTooLarge, handler.CodeRequestTooLarge},
+		{"key too large", http.MethodPost, "/kv/" + strings.Repeat("k", 9), `{"value": "v"}`,
+			http.StatusBadRequest, handler.CodeKeyTooLarge},
+		{"value too large", http.MethodPost, "/kv/a", `{"value": "` + strings.Repeat("v", 17) + `"}`,
+			http.StatusRequestEntityTooLarge, handler.CodeValueTooLarge},
+		{"batch key too large", http.MethodPost, "/batch/kv", `[{"key": "` + strings.Repeat("k", 9) + `", "value": "v"}]`,
+			http.StatusBadRequest, handler.CodeKeyTooLarge},
+		{"batch value too large", http.MethodPost, "/batch/kv", `[{"key": "a", "value": "` + strings.Repeat("v", 17) + `"}]`,
+			http.StatusRequestEntityTooLarge, handler.CodeValueTooLarge},
+		{"batch too many entries", http.MethodPost, "/batch/kv", `[{"key": "a", "value": "1"}, {"key": "b", "value": "2"}, {"key": "c", "value": "3"}]`,
+			http.StatusRequestEntityTooLarge, handler.CodeBatchTooLarge},
+		{"batch too many bytes", http.MethodPost, "/batch/kv", `[{"key": "a", "value": "` + strings.Repeat("v", 16) + `"}, {"key": "b", "value": "` + strings.Repeat("v", 16) + `"}]`,
+			http.StatusRequestEntityTooLarge, handler.CodeBatchTooLarge},
+		{"batch delete too many entries", http.MethodDelete, "/batch/kv", `[{"key": "a"}, {"key": "b"}, {"key": "c"}]`,
+			http.StatusRequestEntityTooLarge, handler.CodeBatchTooLarge},
+		{"batch empty key", http.MethodPost, "/batch/kv", `[{"key": "", "value": "v"}]`,
+			http.StatusBadRequest, handler.CodeEmptyKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := srv.send(t, tt.method, tt.target, tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("Expected %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			var resp struct {
+				Code  string `json:"code"`
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Invalid error body %q: %v", rec.Body, err)
+			}
+			if resp.Code != tt.code || resp.Error == "" {
+				t.Errorf("Expected code %q with a message, got %+v", tt.code, resp)
+			}
+		})
+	}
+
+	if rec := srv.do(t, http.MethodGet, "/kv/a"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected rejected writes to leave a unset, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// TestLimitsEndpoint verifies that GET /limits reports the limits the
+// server enforces.
+func TestLimitsEndpoint(t *testing.T) {
+	srv := newLimitedServer(t, testLimits, testMaxRequestBytes)
+
+	rec := srv.do(t, http.MethodGet, "/limits")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected Content-Type application/json, got %q", ct)
+	}
+
+	var got map[string]int64
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Invalid response %q: %v", rec.Body, err)
+	}
+	want := map[string]int64{
+		"max_key_bytes":     8,
+		"max_value_bytes":   16,
+		"max_batch_entries": 2,
+		"max_batch_bytes":   32,
+		"max_request_bytes": testMaxRequestBytes,
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("Expected %s = %d, got %d", name, value, got[name])
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("Expected %d limits, got %v", len(want), got)
+	}
+
+	if rec := srv.do(t, http.MethodPost, "/limits"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /limits: expected 405, got %d", rec.Code)
+	}
+}
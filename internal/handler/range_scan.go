@@ -0,0 +1,357 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"moniepoint/internal/storage"
+)
+
+// NDJSONContentType selects, in the Accept header or as format=ndjson, a
+// range response of one JSON object per line.
+const NDJSONContentType = "application/x-ndjson"
+
+// rangeScan describes a range read. Empty bounds are open. Resuming from a
+// continuation token is the same scan with the bound it walks towards
+// unchanged and the other moved past the last key returned, so the token is
+// just the encoded scan.
+type rangeScan struct {
+	Start          string
+	End            string
+	StartExclusive bool
+	EndExclusive   bool
+	Reverse        bool
+	Prefix         string // Already applied to the bounds
+	Delimiter      string // Listings only
+}
+
+// rangeCursor is the encoding of a rangeScan in a continuation token. Keys
+// are bytes, so they go in the JSON as base64.
+type rangeCursor struct {
+	Start          []byte `json:"s,omitempty"`
+	End            []byte `json:"e,omitempty"`
+	StartExclusive bool   `json:"sx,omitempty"`
+	EndExclusive   bool   `json:"ex,omitempty"`
+	Reverse        bool   `json:"r,omitempty"`
+	Prefix         []byte `json:"p,omitempty"`
+	Delimiter      []byte `json:"d,omitempty"`
+}
+
+// rangeRequest is a parsed range query.
+type rangeRequest struct {
+	scan   rangeScan
+	limit  int // 0 for no limit
+	ndjson bool
+	base64 bool // Every key and value in base64
+}
+
+// parseRangeRequest reads the range query parameters: start, end,
+// start_exclusive, end_exclusive, reverse, prefix, limit, cursor, format
+// and encoding. A cursor replaces the bounds, prefix and direction; only
+// limit, format and encoding may change between pages.
+func parseRangeRequest(r *http.Request) (rangeRequest, error) {
+	q := r.URL.Query()
+	var req rangeRequest
+
+	if cursor := q.Get("cursor"); cursor != "" {
+		scan, err := decodeCursor(cursor)
+		if err != nil {
+			return req, err
+		}
+		req.scan = scan
+	} else {
+		scan, err := parseScan(q)
+		if err != nil {
+			return req, err
+		}
+		req.scan = scan
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return req, fmt.Errorf("Invalid limit: %q", v)
+		}
+		req.limit = limit
+	}
+
+	force, err := forceBase64(r)
+	if err != nil {
+		return req, err
+	}
+	req.base64 = force
+
+	switch format := q.Get("format"); format {
+	case "ndjson":
+		req.ndjson = true
+	case "json":
+	case "":
+		req.ndjson = strings.Contains(r.Header.Get("Accept"), NDJSONContentType)
+	default:
+		return req, fmt.Errorf("Invalid format: %q", format)
+	}
+	return req, nil
+}
+
+// parseScan reads the bounds of a scan from the query parameters start,
+// end, start_exclusive, end_exclusive, reverse and prefix.
+func parseScan(q url.Values) (rangeScan, error) {
+	scan := rangeScan{Start: q.Get("start"), End: q.Get("end")}
+	for name, flag := range map[string]*bool{
+		"start_exclusive": &scan.StartExclusive,
+		"end_exclusive":   &scan.EndExclusive,
+		"reverse":         &scan.Reverse,
+	} {
+		if v := q.Get(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return scan, fmt.Errorf("Invalid %s: %q", name, v)
+			}
+			*flag = b
+		}
+	}
+	if prefix := q.Get("prefix"); prefix != "" {
+		scan = scan.within(prefix)
+	}
+	return scan, nil
+}
+
+// halfOpen returns the keys of the scan as [start, end), the form of a
+// range delete. An inclusive bound moves past its key to the next possible
+// one, the key with a zero byte appended. An open end stays empty.
+func (s rangeScan) halfOpen() (start, end string) {
+	start, end = s.Start, s.End
+	if s.StartExclusive {
+		start += "\x00"
+	}
+	if end != "" && !s.EndExclusive {
+		end += "\x00"
+	}
+	return start, end
+}
+
+// within narrows the scan to the keys starting with prefix, which are
+// exactly those in [prefix, prefixSuccessor(prefix)).
+func (s rangeScan) within(prefix string) rangeScan {
+	s.Prefix = prefix
+	if s.Start < prefix {
+		s.Start, s.StartExclusive = prefix, false
+	}
+	if end := prefixSuccessor(prefix); end != "" && (s.End == "" || s.End >= end) {
+		s.End, s.EndExclusive = end, true
+	}
+	return s
+}
+
+// prefixSuccessor returns the smallest key greater than every key starting
+// with prefix, or an empty string if there is none.
+func prefixSuccessor(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// commonPrefix returns the part of key up to and including the first
+// delimiter after the scan's prefix, if there is one.
+func (s rangeScan) commonPrefix(key string) (string, bool) {
+	if s.Delimiter == "" || !strings.HasPrefix(key, s.Prefix) {
+		return "", false
+	}
+	i := strings.Index(key[len(s.Prefix):], s.Delimiter)
+	if i < 0 {
+		return "", false
+	}
+	return key[:len(s.Prefix)+i+len(s.Delimiter)], true
+}
+
+// seek positions it at the first key of the scan.
+func (s rangeScan) seek(it storage.Iterator) {
+	if !s.Reverse {
+		if s.Start == "" {
+			it.SeekToFirst()
+			return
+		}
+		if it.Seek(s.Start); s.StartExclusive && it.Valid() && it.Key() == s.Start {
+			it.Next()
+		}
+		return
+	}
+
+	if s.End == "" {
+		it.SeekToLast()
+		return
+	}
+	if it.Seek(s.End); !it.Valid() {
+		if it.Err() == nil {
+			it.SeekToLast() // Every key is before End
+		}
+		return
+	}
+	if it.Key() > s.End || s.EndExclusive {
+		it.Prev()
+	}
+}
+
+// next moves it to the following key of the scan.
+func (s rangeScan) next(it storage.Iterator) {
+	if s.Reverse {
+		it.Prev()
+	} else {
+		it.Next()
+	}
+}
+
+// contains reports whether it is positioned at a key of the scan.
+func (s rangeScan) contains(it storage.Iterator) bool {
+	if !it.Valid() {
+		return false
+	}
+	key := it.Key()
+	if s.Reverse {
+		return s.Start == "" || key > s.Start || (key == s.Start && !s.StartExclusive)
+	}
+	return s.End == "" || key < s.End || (key == s.End && !s.EndExclusive)
+}
+
+// after returns the rest of the scan once key has been returned.
+func (s rangeScan) after(key string) rangeScan {
+	if s.Reverse {
+		s.End, s.EndExclusive = key, true
+	} else {
+		s.Start, s.StartExclusive = key, true
+	}
+	return s
+}
+
+// cursor encodes the scan as an opaque continuation token.
+func (s rangeScan) cursor() string {
+	data, _ := json.Marshal(rangeCursor{
+		Start:          []byte(s.Start),
+		End:            []byte(s.End),
+		StartExclusive: s.StartExclusive,
+		EndExclusive:   s.EndExclusive,
+		Reverse:        s.Reverse,
+		Prefix:         []byte(s.Prefix),
+		Delimiter:      []byte(s.Delimiter),
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a token made by cursor.
+func decodeCursor(token string) (rangeScan, error) {
+	var c rangeCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return rangeScan{}, errors.New("Invalid cursor")
+	}
+	return rangeScan{
+		Start:          string(c.Start),
+		End:            string(c.End),
+		StartExclusive: c.StartExclusive,
+		EndExclusive:   c.EndExclusive,
+		Reverse:        c.Reverse,
+		Prefix:         string(c.Prefix),
+		Delimiter:      string(c.Delimiter),
+	}, nil
+}
+
+// rangeItem is one record of a range response.
+type rangeItem struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// rangeWriter streams a range response. As JSON it is one object,
+//
+//	{"items":[{"key":...,"value":...},...],"next_cursor":"..."}
+//
+// where an item encoded in base64 also has "encoding":"base64",
+// and as NDJSON one item per line, followed by a {"next_cursor":"..."} line
+// when there are more pages. A failure after the first item replaces the
+// cursor with an "error" field or line, as the status is already sent.
+type rangeWriter struct {
+	w       http.ResponseWriter
+	ndjson  bool
+	base64  bool
+	written int
+}
+
+// flushEvery is how many items are written between flushes to the client.
+const flushEvery = 256
+
+func newRangeWriter(w http.ResponseWriter, ndjson, forceBase64 bool) *rangeWriter {
+	if ndjson {
+		w.Header().Set("Content-Type", NDJSONContentType)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"items":[`))
+	}
+	return &rangeWriter{w: w, ndjson: ndjson, base64: forceBase64}
+}
+
+// item writes one record.
+func (rw *rangeWriter) item(key, value string) error {
+	encoding := textEncoding(rw.base64, key, value)
+	data, err := json.Marshal(rangeItem{encodeText(key, encoding), encodeText(value, encoding), encoding})
+	if err != nil {
+		return err
+	}
+	switch {
+	case rw.ndjson:
+		data = append(data, '\n')
+	case rw.written > 0:
+		data = append([]byte{','}, data...)
+	}
+	if _, err := rw.w.Write(data); err != nil {
+		return err
+	}
+	if rw.written++; rw.written%flushEvery == 0 {
+		if f, ok := rw.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	return nil
+}
+
+// end completes the response with the continuation token, if any, or the
+// error that cut it short.
+func (rw *rangeWriter) end(cursor string, failure error) {
+	var tail struct {
+		NextCursor string `json:"next_cursor,omitempty"`
+		Error      string `json:"error,omitempty"`
+	}
+	tail.NextCursor = cursor
+	if failure != nil {
+		tail.Error = failure.Error()
+	}
+	data, _ := json.Marshal(tail)
+
+	if rw.ndjson {
+		if cursor != "" || failure != nil {
+			rw.w.Write(append(data, '\n'))
+		}
+		return
+	}
+	rw.w.Write([]byte("]"))
+	if len(data) > 2 { // Not "{}"
+		rw.w.Write([]byte(","))
+		rw.w.Write(data[1:])
+		return
+	}
+	rw.w.Write([]byte("}"))
+}
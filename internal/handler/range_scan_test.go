@@ -0,0 +1,363 @@
+package handler_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+
+	"moniepoint/internal/api"
+	"moniepoint/internal/handler"
+	"moniepoint/internal/storage"
+)
+
+// TestMain is the entry point for testing; it cleans up the WAL directory when done.
+func TestMain(m *testing.M) {
+	code := m.Run()
+
+	os.RemoveAll("data")
+
+	os.Exit(code)
+}
+
+// testServer is the API over a WAL, a Memtable and an LSM tree of its own.
+type testServer struct {
+	http.Handler
+	writer   *storage.Writer
+	memtable *storage.Memtable
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	return newLimitedServer(t, storage.DefaultLimits(), 0)
+}
+
+// newLimitedServer is newTestServer with the given write limits and cap on
+// request bodies.
+func newLimitedServer(t *testing.T, limits storage.Limits, maxRequestBytes int64) *testServer {
+	t.Helper()
+	os.RemoveAll(storage.WALDirectory)
+	t.Cleanup(func() { os.RemoveAll(storage.WALDirectory) })
+
+	wal, err := storage.OpenWAL(storage.WALOptions{Durability: storage.WALDurabilityInterval})
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	tree, err := storage.OpenLSMTree(t.TempDir(), storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	memtable := storage.NewMemtable(storage.DefaultMemtableOptions(), func(it *storage.MemtableIterator, seq uint64) error {
+		return tree.FlushMemtable(it)
+	})
+	t.Cleanup(func() {
+		memtable.Close()
+		tree.Close()
+		wal.Close()
+	})
+
+	writer := storage.NewWriter(wal, memtable, limits)
+	requestHandler := handler.NewRequestHandler(
+		handler.NewReadHandler(memtable, tree),
+		handler.NewWriteHandler(writer, maxRequestBytes),
+		handler.NewDeleteHandler(writer, maxRequestBytes),
+		nil,
+	)
+	return &testServer{Handler: api.NewRouter(requestHandler), writer: writer, memtable: memtable}
+}
+
+// put writes value under each key, and flushes them to an SSTable if asked,
+// so that scans merge the Memtable with the files.
+func (s *testServer) put(t *testing.T, flush bool, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		if _, err := s.writer.Put(key, "v:"+key, ""); err != nil {
+			t.Fatalf("Put(%q) failed: %v", key, err)
+		}
+	}
+	if flush {
+		s.memtable.Flush()
+	}
+}
+
+// do sends a request and returns the response.
+func (s *testServer) do(t *testing.T, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
+
+// rangePage is a page of a range response, keys decoded.
+type rangePage struct {
+	Items []struct {
+		Key      string `json:"key"`
+		Value    string `json:"value"`
+		Encoding string `json:"encoding"`
+	} `json:"items"`
+	NextCursor string `json:"next_cursor"`
+	Error      string `json:"error"`
+}
+
+// scan follows the cursors of a range query from the first page to the
+// last and returns the keys in the order received and the number of pages.
+func (s *testServer) scan(t *testing.T, query url.Values) ([]string, int) {
+	t.Helper()
+	keys := []string{}
+	for pages := 1; pages <= 100; pages++ {
+		rec := s.do(t, http.MethodGet, "/kv/?"+query.Encode())
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Range %v: expected 200, got %d: %s", query, rec.Code, rec.Body)
+		}
+		var page rangePage
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Range %v: invalid response %q: %v", query, rec.Body, err)
+		}
+		if page.Error != "" {
+			t.Fatalf("Range %v: %s", query, page.Error)
+		}
+		for _, item := range page.Items {
+			key, value := item.Key, item.Value
+			if item.Encoding == handler.EncodingBase64 {
+				key, value = decodeBase64(t, key), decodeBase64(t, value)
+			}
+			if value != "v:"+key {
+				t.Errorf("Expected the value of %q, got %q", key, value)
+			}
+			keys = append(keys, key)
+		}
+		if page.NextCursor == "" {
+			return keys, pages
+		}
+		query = url.Values{"cursor": {page.NextCursor}, "limit": {query.Get("limit")}}
+	}
+	t.Fatalf("Range %v: cursors never ran out", query)
+	return nil, 0
+}
+
+func decodeBase64(t *testing.T, s string) string {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("Invalid base64 %q: %v", s, err)
+	}
+	return string(b)
+}
+
+// TestRangeCursorPagination verifies that following the cursors returns
+// every key of a range exactly once, in key order or in reverse, with the
+// bounds kept across pages.
+func TestRangeCursorPagination(t *testing.T) {
+	srv := newTestServer(t)
+	srv.put(t, true, "k00", "k02", "k04", "k06", "k08")
+	srv.put(t, false, "k01", "k03", "k05", "k07", "k09")
+	if _, err := srv.writer.Delete("k05", ""); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		query url.Values
+		keys  []string
+		pages int
+	}{
+		{"Forward", url.Values{"limit": {"3"}},
+			[]string{"k00", "k01", "k02", "k03", "k04", "k06", "k07", "k08", "k09"}, 3},
+		{"Reverse", url.Values{"reverse": {"true"}, "limit": {"4"}},
+			[]string{"k09", "k08", "k07", "k06", "k04", "k03", "k02", "k01", "k00"}, 3},
+		{"Bounds", url.Values{"start": {"k01"}, "end": {"k07"}, "limit": {"2"}},
+			[]string{"k01", "k02", "k03", "k04", "k06", "k07"}, 3},
+		{"Exclusive bounds", url.Values{"start": {"k01"}, "end": {"k07"}, "start_exclusive": {"true"}, "end_exclusive": {"true"}, "limit": {"2"}},
+			[]string{"k02", "k03", "k04", "k06"}, 2},
+		{"Reverse seek between keys", url.Values{"start": {"k015"}, "end": {"k065"}, "reverse": {"true"}, "limit": {"2"}},
+			[]string{"k06", "k04", "k03", "k02"}, 2},
+		{"Reverse exclusive end", url.Values{"end": {"k03"}, "end_exclusive": {"true"}, "reverse": {"true"}},
+			[]string{"k02", "k01", "k00"}, 1},
+		{"Reverse end past the last key", url.Values{"start": {"k08"}, "end": {"z"}, "reverse": {"true"}, "limit": {"1"}},
+			[]string{"k09", "k08"}, 2},
+		{"Limit of the whole range", url.Values{"start": {"k06"}, "limit": {"4"}},
+			[]string{"k06", "k07", "k08", "k09"}, 1},
+		{"Empty range", url.Values{"start": {"k10"}},
+			[]string{}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, pages := srv.scan(t, tt.query)
+			if !reflect.DeepEqual(keys, tt.keys) || pages != tt.pages {
+				t.Errorf("Expected %v in %d pages, got %v in %d", tt.keys, tt.pages, keys, pages)
+			}
+		})
+	}
+}
+
+// TestRangeCursorIgnoresNewBounds verifies that a cursor carries the scan:
+// bounds given with it do not change the pages that follow.
+func TestRangeCursorIgnoresNewBounds(t *testing.T) {
+	srv := newTestServer(t)
+	srv.put(t, false, "a", "b", "c", "d")
+
+	rec := srv.do(t, http.MethodGet, "/kv/?end=c&limit=1")
+	var page rangePage
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || page.NextCursor == "" {
+		t.Fatalf("Expected a first page with a cursor, got %q (err=%v)", rec.Body, err)
+	}
+	rec = srv.do(t, http.MethodGet, "/kv/?start=a&end=z&reverse=true&cursor="+page.NextCursor)
+	page = rangePage{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Invalid response %q: %v", rec.Body, err)
+	}
+	var keys []string
+	for _, item := range page.Items {
+		keys = append(keys, item.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"b", "c"}) || page.NextCursor != "" {
+		t.Errorf("Expected the cursor to resume at b and end at c, got %v (cursor %q)", keys, page.NextCursor)
+	}
+}
+
+// TestRangeRejectsInvalidParameters verifies the 400 responses to malformed
+// range and listing queries.
+func TestRangeRejectsInvalidParameters(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, target := range []string{
+		"/kv/?limit=0",
+		"/kv/?limit=-1",
+		"/kv/?limit=ten",
+		"/kv/?reverse=maybe",
+		"/kv/?cursor=not-a-cursor",
+		"/kv/?format=xml",
+		"/list?limit=0",
+		"/list?reverse=true",
+	} {
+		if rec := srv.do(t, http.MethodGet, target); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: expected 400, got %d", target, rec.Code)
+		}
+	}
+}
+
+// TestRangePrefixEndingInFF verifies prefixes whose last bytes are 0xff,
+// which have no successor of the same length: the range has to end at the
+// next shorter successor, or stay open when the prefix is all 0xff.
+func TestRangePrefixEndingInFF(t *testing.T) {
+	srv := newTestServer(t)
+	srv.put(t, true, "a\xfe", "a\xff", "a\xff\x00", "a\xff\xff")
+	srv.put(t, false, "a\xff\xff\x01", "b", "\xff", "\xff\xff\x01")
+
+	tests := []struct {
+		name  string
+		query url.Values
+		keys  []string
+	}{
+		{"Forward", url.Values{"prefix": {"a\xff"}, "limit": {"2"}},
+			[]string{"a\xff", "a\xff\x00", "a\xff\xff", "a\xff\xff\x01"}},
+		{"Reverse", url.Values{"prefix": {"a\xff"}, "reverse": {"true"}, "limit": {"3"}},
+			[]string{"a\xff\xff\x01", "a\xff\xff", "a\xff\x00", "a\xff"}},
+		{"All 0xff", url.Values{"prefix": {"\xff\xff"}},
+			[]string{"\xff\xff\x01"}},
+		{"All 0xff reverse", url.Values{"prefix": {"\xff"}, "reverse": {"true"}, "limit": {"1"}},
+			[]string{"\xff\xff\x01", "\xff"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if keys, _ := srv.scan(t, tt.query); !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("Expected %q, got %q", tt.keys, keys)
+			}
+		})
+	}
+}
+
+// TestRangeDeleteBounds verifies that the inclusive and exclusive bounds
+// of a range delete, and a prefix ending in 0xff, cover the same keys as a
+// range query with the same parameters.
+func TestRangeDeleteBounds(t *testing.T) {
+	tests := []struct {
+		name  string
+		query url.Values
+		keys  []string // Left after the delete
+	}{
+		{"Inclusive", url.Values{"start": {"k1"}, "end": {"k3"}},
+			[]string{"k0", "k4", "k\xff", "k\xff\xff"}},
+		{"Exclusive", url.Values{"start": {"k1"}, "end": {"k3"}, "start_exclusive": {"true"}, "end_exclusive": {"true"}},
+			[]string{"k0", "k1", "k3", "k4", "k\xff", "k\xff\xff"}},
+		{"Prefix ending in 0xff", url.Values{"prefix": {"k\xff"}},
+			[]string{"k0", "k1", "k2", "k3", "k4"}},
+		{"Prefix with end", url.Values{"prefix": {"k"}, "end": {"k2"}},
+			[]string{"k3", "k4", "k\xff", "k\xff\xff"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			srv.put(t, true, "k0", "k1", "k2")
+			srv.put(t, false, "k3", "k4", "k\xff", "k\xff\xff")
+
+			if rec := srv.do(t, http.MethodDelete, "/kv/?"+tt.query.Encode()); rec.Code != http.StatusNoContent {
+				t.Fatalf("Expected 204, got %d: %s", rec.Code, rec.Body)
+			}
+			if keys, _ := srv.scan(t, url.Values{}); !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("Expected %q to remain, got %q", tt.keys, keys)
+			}
+		})
+	}
+
+	srv := newTestServer(t)
+	if rec := srv.do(t, http.MethodDelete, "/kv/?start=k1"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a range delete without an end, got %d", rec.Code)
+	}
+}
+
+// listPage is a page of a listing, as sent.
+type listPage struct {
+	Keys           []string `json:"keys"`
+	CommonPrefixes []string `json:"common_prefixes"`
+	NextCursor     string   `json:"next_cursor"`
+}
+
+// TestListDelimiterAcrossPages verifies that a delimiter listing rolls keys
+// up into common prefixes, and that a page ending on a common prefix
+// resumes after every key under it rather than listing them again.
+func TestListDelimiterAcrossPages(t *testing.T) {
+	srv := newTestServer(t)
+	srv.put(t, true, "photos/2024/a.jpg", "photos/2024/b.jpg", "photos/2025/c.jpg")
+	srv.put(t, false, "photos/2024/z/d.jpg", "photos/index.html", "photos/x/e.jpg", "photos/\xff/f.jpg", "videos/1.mp4")
+
+	var pages []listPage
+	query := url.Values{"prefix": {"photos/"}, "delimiter": {"/"}, "limit": {"2"}}
+	for len(pages) < 10 {
+		rec := srv.do(t, http.MethodGet, "/list?"+query.Encode())
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		var page listPage
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Invalid response %q: %v", rec.Body, err)
+		}
+		pages = append(pages, page)
+		if page.NextCursor == "" {
+			break
+		}
+		query = url.Values{"cursor": {page.NextCursor}, "limit": {"2"}}
+	}
+
+	expected := []listPage{
+		{Keys: []string{}, CommonPrefixes: []string{"photos/2024/", "photos/2025/"}},
+		{Keys: []string{"photos/index.html"}, CommonPrefixes: []string{"photos/x/"}},
+		{Keys: []string{}, CommonPrefixes: []string{base64.StdEncoding.EncodeToString([]byte("photos/\xff/"))}},
+	}
+	if len(pages) != len(expected) {
+		t.Fatalf("Expected %d pages, got %+v", len(expected), pages)
+	}
+	for i, page := range pages {
+		if page.NextCursor == "" != (i == len(pages)-1) {
+			t.Errorf("Page %d: expected a cursor on every page but the last, got %q", i, page.NextCursor)
+		}
+		page.NextCursor = ""
+		if !reflect.DeepEqual(page, expected[i]) {
+			t.Errorf("Page %d: expected %+v, got %+v", i, expected[i], page)
+		}
+	}
+}
@@ -12,26 +12,39 @@ import (
 // ReadHandler manages key-value retrieval.
 type ReadHandler struct {
 	memtable *storage.Memtable
-	sstable  *storage.SSTable
+	tree     *storage.LSMTree
 }
 
 // NewReadHandler initializes ReadHandler.
-func NewReadHandler(memtable *storage.Memtable, sstable *storage.SSTable) *ReadHandler {
-	return &ReadHandler{memtable, sstable}
+func NewReadHandler(memtable *storage.Memtable, tree *storage.LSMTree) *ReadHandler {
+	return &ReadHandler{memtable, tree}
 }
 
-// HandleRead processes an HTTP GET request for a single key.
+// readResponse is the JSON form of a single value.
+type readResponse struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"` // See encoding.go
+}
+
+// HandleRead processes an HTTP GET request for a single key. The value is
+// returned as JSON or, if asked for, as raw bytes.
 func (rh *ReadHandler) HandleRead(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	key := utils.GetKeyFromPath(r.URL.Path)
+	key := utils.GetKeyFromPath(r.URL.EscapedPath())
 	if key == "" {
 		http.Error(w, "Missing key in URL", http.StatusBadRequest)
 		return
 	}
+	force, err := forceBase64(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	value, err := rh.Read(key)
 	if err != nil {
@@ -39,75 +52,190 @@ func (rh *ReadHandler) HandleRead(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Key not found", http.StatusNotFound)
 			return
 		}
+		if errors.Is(err, storage.ErrCorruption) {
+			log.Printf("[ERROR] Corruption detected reading key '%s': %v", key, err)
+			http.Error(w, "Internal server error: data corruption detected", http.StatusInternalServerError)
+			return
+		}
 		log.Printf("Error retrieving key '%s': %v", key, err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	if wantsOctetStream(r) {
+		w.Header().Set("Content-Type", OctetStreamContentType)
+		w.Write([]byte(value))
+		return
+	}
+	encoding := textEncoding(force, key, value)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"key": key, "value": value})
+	json.NewEncoder(w).Encode(readResponse{encodeText(key, encoding), encodeText(value, encoding), encoding})
 }
 
-// HandleReadRange processes an HTTP GET request for a range of keys.
+// HandleReadRange processes an HTTP GET request for a range of keys,
+// streaming them in key order, or reverse order, a page of up to limit keys
+// at a time. See parseRangeRequest for the parameters and rangeWriter for
+// the response.
 func (rh *ReadHandler) HandleReadRange(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	startKey := r.URL.Query().Get("start")
-	endKey := r.URL.Query().Get("end")
-	if startKey == "" || endKey == "" {
-		http.Error(w, "Missing start or end key in query", http.StatusBadRequest)
+	req, err := parseRangeRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	scan := req.scan
 
-	results, err := rh.ReadKeyRange(startKey, endKey)
-	if err != nil {
-		log.Printf("Error retrieving range '%s' - '%s': %v", startKey, endKey, err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	it := rh.NewIterator()
+	defer it.Close()
+
+	// Errors before the first record can still change the status
+	scan.seek(it)
+	if err := it.Err(); err != nil {
+		http.Error(w, rangeFailure(scan, err).Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(results)
+	out := newRangeWriter(w, req.ndjson, req.base64)
+	var cursor, last string
+	for n := 0; scan.contains(it); scan.next(it) {
+		if req.limit > 0 && n == req.limit {
+			cursor = scan.after(last).cursor() // Only once a key is known to remain
+			break
+		}
+		if err := out.item(it.Key(), it.Value()); err != nil {
+			log.Printf("Range response to %s aborted: %v", r.RemoteAddr, err)
+			return
+		}
+		last = it.Key()
+		n++
+	}
+	if err := it.Err(); err != nil {
+		out.end("", rangeFailure(scan, err))
+		return
+	}
+	out.end(cursor, nil)
 }
 
-// Read retrieves a key from Memtable, falling back to SSTable if needed.
-func (rh *ReadHandler) Read(key string) (string, error) {
-	if value, found := rh.memtable.Get(key); found {
-		return value, nil
+// MaxListKeys caps the keys and common prefixes in one listing page.
+const MaxListKeys = 1000
+
+// listResponse is a page of a listing. Its keys and common prefixes are
+// all in base64 when Encoding says so.
+type listResponse struct {
+	Keys           []string `json:"keys"`
+	CommonPrefixes []string `json:"common_prefixes"`
+	Encoding       string   `json:"encoding,omitempty"`
+	NextCursor     string   `json:"next_cursor,omitempty"`
+}
+
+// HandleList processes an HTTP GET request listing keys, like S3's
+// ListObjects: with a delimiter, keys that contain it after the prefix are
+// rolled up into one common prefix each, up to and including the delimiter.
+// It takes the range parameters except reverse and format, and delimiter;
+// pages hold up to limit keys and common prefixes, at most MaxListKeys.
+func (rh *ReadHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	// If not found, check SSTable (persistent storage)
-	value, err := rh.sstable.Read(key)
+	req, err := parseRangeRequest(r)
 	if err != nil {
-		log.Printf("SSTable Read failed for key '%s': %v", key, err)
-		return "", err
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scan := req.scan
+	if scan.Reverse {
+		http.Error(w, "Listings cannot be reversed", http.StatusBadRequest)
+		return
+	}
+	if !r.URL.Query().Has("cursor") {
+		scan.Delimiter = r.URL.Query().Get("delimiter")
+	}
+	limit := req.limit
+	if limit == 0 || limit > MaxListKeys {
+		limit = MaxListKeys
 	}
-	return value, nil
-}
 
-// ReadKeyRange fetches keys within a range from Memtable and SSTable.
-func (rh *ReadHandler) ReadKeyRange(startKey, endKey string) (map[string]string, error) {
-	results := make(map[string]string)
+	it := rh.NewIterator()
+	defer it.Close()
 
-	memResults := rh.memtable.GetRange(startKey, endKey)
-	for k, v := range memResults {
-		results[k] = v
+	resp := listResponse{Keys: []string{}, CommonPrefixes: []string{}}
+	next := scan
+	for scan.seek(it); scan.contains(it); {
+		if len(resp.Keys)+len(resp.CommonPrefixes) == limit {
+			resp.NextCursor = next.cursor()
+			break
+		}
+		key := it.Key()
+		prefix, ok := scan.commonPrefix(key)
+		if !ok {
+			resp.Keys = append(resp.Keys, key)
+			next = scan.after(key)
+			it.Next()
+			continue
+		}
+
+		// Skip the rest of the keys under the common prefix
+		resp.CommonPrefixes = append(resp.CommonPrefixes, prefix)
+		next.Start, next.StartExclusive = prefixSuccessor(prefix), false
+		if next.Start == "" {
+			break // No key can follow prefix
+		}
+		it.Seek(next.Start)
+	}
+	if err := it.Err(); err != nil {
+		http.Error(w, rangeFailure(scan, err).Error(), http.StatusInternalServerError)
+		return
 	}
 
-	// Fetch from SSTable
-	sstableResults, err := rh.sstable.ReadRange(startKey, endKey)
-	if err != nil {
-		log.Printf("SSTable ReadRange failed for range '%s' - '%s': %v", startKey, endKey, err)
-		return nil, err
+	resp.Encoding = textEncoding(req.base64, append(resp.Keys, resp.CommonPrefixes...)...)
+	for _, list := range [][]string{resp.Keys, resp.CommonPrefixes} {
+		for i, s := range list {
+			list[i] = encodeText(s, resp.Encoding)
+		}
 	}
 
-	// Merge results from both sources
-	for k, v := range sstableResults {
-		results[k] = v
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// rangeFailure logs a range read error and returns what the client is told.
+func rangeFailure(scan rangeScan, err error) error {
+	if errors.Is(err, storage.ErrCorruption) {
+		log.Printf("[ERROR] Corruption detected reading range '%s' - '%s': %v", scan.Start, scan.End, err)
+		return errors.New("Internal server error: data corruption detected")
+	}
+	log.Printf("Error retrieving range '%s' - '%s': %v", scan.Start, scan.End, err)
+	return errors.New("Internal server error")
+}
+
+// Read retrieves a key from Memtable, falling back to the SSTables if needed.
+func (rh *ReadHandler) Read(key string) (string, error) {
+	if entry, found := rh.memtable.GetEntry(key); found {
+		if entry.Tombstone {
+			return "", storage.ErrKeyNotFound
+		}
+		return entry.Value, nil
 	}
 
-	return results, nil
+	// If not found, search the SSTables (L0 newest-first, then L1..Ln)
+	value, err := rh.tree.Get(key)
+	if err != nil {
+		log.Printf("SSTable Read failed for key '%s': %v", key, err)
+		return "", err
+	}
+	return value, nil
+}
+
+// NewIterator returns an iterator over the newest visible version of every
+// key in the Memtable and SSTables. It must be closed.
+func (rh *ReadHandler) NewIterator() *storage.MergingIterator {
+	// Memtable iterators come first: they are newer, and taking them before
+	// the SSTables means a concurrent flush cannot hide records from both
+	return storage.NewMergingIterator(append(rh.memtable.Iterators(), rh.tree.Iterators()...)...)
 }
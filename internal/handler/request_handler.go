@@ -7,10 +7,11 @@ type RequestHandler struct {
 	readHandler   *ReadHandler
 	writeHandler  *WriteHandler
 	deleteHandler *DeleteHandler
+	statsHandler  *StatsHandler
 }
 
-func NewRequestHandler(readHandler *ReadHandler, writeHandler *WriteHandler, deleteHandler *DeleteHandler) *RequestHandler {
-	return &RequestHandler{readHandler, writeHandler, deleteHandler}
+func NewRequestHandler(readHandler *ReadHandler, writeHandler *WriteHandler, deleteHandler *DeleteHandler, statsHandler *StatsHandler) *RequestHandler {
+	return &RequestHandler{readHandler, writeHandler, deleteHandler, statsHandler}
 }
 
 // HandleWrite delegates the write request.
@@ -33,7 +34,32 @@ func (h *RequestHandler) HandleReadRange(w http.ResponseWriter, r *http.Request)
 	h.readHandler.HandleReadRange(w, r)
 }
 
+// HandleList delegates key listings.
+func (h *RequestHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	h.readHandler.HandleList(w, r)
+}
+
 // HandleDelete delegates the delete request.
 func (h *RequestHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
 	h.deleteHandler.HandleDelete(w, r)
 }
+
+// HandleBatchDelete delegates batch delete requests.
+func (h *RequestHandler) HandleBatchDelete(w http.ResponseWriter, r *http.Request) {
+	h.deleteHandler.HandleBatchDelete(w, r)
+}
+
+// HandleDeleteRange delegates range deletes.
+func (h *RequestHandler) HandleDeleteRange(w http.ResponseWriter, r *http.Request) {
+	h.deleteHandler.HandleDeleteRange(w, r)
+}
+
+// HandleLimits delegates the write limits request.
+func (h *RequestHandler) HandleLimits(w http.ResponseWriter, r *http.Request) {
+	h.writeHandler.HandleLimits(w, r)
+}
+
+// HandleStats delegates the engine statistics request.
+func (h *RequestHandler) HandleStats(w http.ResponseWriter, r *http.Request) {
+	h.statsHandler.HandleStats(w, r)
+}
@@ -0,0 +1,94 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// send sends a request with a JSON body and returns the response.
+func (s *testServer) send(t *testing.T, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+// read returns the raw value of the key at path, or fails the test if it
+// is not found.
+func (s *testServer) read(t *testing.T, path string) string {
+	t.Helper()
+	rec := s.do(t, http.MethodGet, path+"?format=raw")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: expected 200, got %d: %s", path, rec.Code, rec.Body)
+	}
+	return rec.Body.String()
+}
+
+// TestBatchLegacyPath verifies that batches sent to /kv/batch, where they
+// used to go, still reach the batch endpoints, and that the key "batch" can
+// be written by escaping it.
+func TestBatchLegacyPath(t *testing.T) {
+	srv := newTestServer(t)
+
+	rec := srv.send(t, http.MethodPost, "/kv/batch", `[{"key": "a", "value": "1"}, {"key": "b", "value": "2"}]`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /kv/batch: expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	if value := srv.read(t, "/kv/b"); value != "2" {
+		t.Errorf("Expected b = %q, got %q", "2", value)
+	}
+
+	rec = srv.send(t, http.MethodDelete, "/kv/batch", `[{"key": "a"}]`)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /kv/batch: expected 204, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := srv.do(t, http.MethodGet, "/kv/a"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected a to be deleted, got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = srv.send(t, http.MethodPost, "/kv/%62atch", `{"value": "key"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /kv/%%62atch: expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	if value := srv.read(t, "/kv/batch"); value != "key" {
+		t.Errorf("Expected batch = %q, got %q", "key", value)
+	}
+}
+
+// TestReadRejectsKeyWithRange verifies that a read naming a key is not
+// silently turned into a scan, or a scan into a read, by range parameters.
+func TestReadRejectsKeyWithRange(t *testing.T) {
+	srv := newTestServer(t)
+	srv.put(t, false, "a", "b", "c")
+
+	for _, query := range []string{"start=a", "end=c", "prefix=a"} {
+		if rec := srv.do(t, http.MethodGet, "/kv/b?"+query); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET /kv/b?%s: expected 400, got %d: %s", query, rec.Code, rec.Body)
+		}
+	}
+	if value := srv.read(t, "/kv/b"); value != "v:b" {
+		t.Errorf("Expected b = %q, got %q", "v:b", value)
+	}
+}
+
+// TestDeleteRejectsKeyWithRange verifies that a delete naming a key with
+// range parameters deletes nothing, rather than the range.
+func TestDeleteRejectsKeyWithRange(t *testing.T) {
+	srv := newTestServer(t)
+	srv.put(t, false, "a", "b", "c")
+
+	for _, query := range []string{"start=a&end=c", "end=c", "prefix=a"} {
+		if rec := srv.do(t, http.MethodDelete, "/kv/b?"+query); rec.Code != http.StatusBadRequest {
+			t.Errorf("DELETE /kv/b?%s: expected 400, got %d: %s", query, rec.Code, rec.Body)
+		}
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if value := srv.read(t, "/kv/"+key); value != "v:"+key {
+			t.Errorf("Expected %s = %q, got %q", key, "v:"+key, value)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"moniepoint/internal/storage"
+)
+
+// StatsHandler reports engine statistics.
+type StatsHandler struct {
+	wal       *storage.WAL
+	memtable  *storage.Memtable
+	tree      *storage.LSMTree
+	compactor *storage.Compactor
+	budget    *storage.MemoryBudget // nil when no budget is configured
+}
+
+// NewStatsHandler initializes StatsHandler.
+func NewStatsHandler(wal *storage.WAL, memtable *storage.Memtable, tree *storage.LSMTree, compactor *storage.Compactor, budget *storage.MemoryBudget) *StatsHandler {
+	return &StatsHandler{wal, memtable, tree, compactor, budget}
+}
+
+// HandleStats processes an HTTP GET request for the WAL and Memtable
+// counters, the tree shape, the compaction counters, including
+// write/read/space amplification, and how the memory budget is spent.
+func (sh *StatsHandler) HandleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := map[string]any{
+		"wal":        sh.wal.Stats(),
+		"memtable":   sh.memtable.Stats(),
+		"lsm":        sh.tree.Stats(),
+		"compaction": sh.compactor.Stats(),
+	}
+	if sh.budget != nil {
+		stats["memory"] = sh.budget.Stats()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
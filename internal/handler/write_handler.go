@@ -2,75 +2,89 @@ package handler
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"sync"
 
 	"moniepoint/internal/storage"
 	"moniepoint/internal/utils"
 )
 
 type WriteHandler struct {
-	wal      *storage.WAL
-	memtable *storage.Memtable
-	sstable  *storage.SSTable
+	writer          *storage.Writer
+	maxRequestBytes int64 // 0 for no limit
 }
 
+// DurabilityHeader names the acknowledgement level on a write request (also
+// accepted as the "durability" query parameter) and, on the response, the
+// level the write actually reached.
+const DurabilityHeader = "X-Durability"
+
+// BatchWriteRequest is one entry of a batch write. Encoding, if set, is
+// "base64" and applies to both Key and Value (see encoding.go). An entry
+// with Delete set deletes the key and has no Value.
 type BatchWriteRequest struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+	Delete   bool   `json:"delete,omitempty"`
 }
 
-// NewWriteHandler initializes WriteHandler.
-func NewWriteHandler(wal *storage.WAL, memtable *storage.Memtable, sstable *storage.SSTable) *WriteHandler {
+// NewWriteHandler initializes WriteHandler, which rejects request bodies
+// over maxRequestBytes, and writes over the writer's limits, with
+// machine-readable errors (see limits.go).
+func NewWriteHandler(writer *storage.Writer, maxRequestBytes int64) *WriteHandler {
 	return &WriteHandler{
-		wal:      wal,
-		memtable: memtable,
-		sstable:  sstable,
+		writer:          writer,
+		maxRequestBytes: maxRequestBytes,
 	}
 }
 
-// HandleWrite processes an HTTP POST request for writing a value.
+// HandleWrite processes an HTTP POST request for writing a value, given as
+// a JSON object or, with Content-Type application/octet-stream, as the raw
+// request body.
 func (wh *WriteHandler) HandleWrite(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	key := utils.GetKeyFromPath(r.URL.Path)
+	key := utils.GetKeyFromPath(r.URL.EscapedPath())
 	if key == "" {
 		http.Error(w, "Missing key in URL", http.StatusBadRequest)
 		return
 	}
 
-	var req struct {
-		Value string `json:"value"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+	durability, err := requestedDurability(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Step 1: Append to WAL (Durability)
-	if err := wh.wal.Append(key, req.Value); err != nil {
-		log.Printf("[ERROR] WAL write failed for key=%s: %v", key, err)
-		http.Error(w, "WAL Write Failed", http.StatusInternalServerError)
+	limitBody(w, r, wh.maxRequestBytes)
+	value, err := readValue(r)
+	if limitError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Step 2: Ensure WAL is flushed before updating Memtable & SSTable
-	wh.wal.Flush()
-
-	// Step 3: Store in Memtable (Fast Read Access)
-	wh.memtable.Set(key, req.Value)
-
-	// Step 4: Store in SSTable (Persistent Storage)
-	if err := wh.sstable.Write(key, req.Value); err != nil {
-		log.Printf("[ERROR] SSTable write failed for key=%s: %v", key, err)
-		http.Error(w, "SSTable Write Failed", http.StatusInternalServerError)
+	// Append to WAL and store in Memtable (persisted to an SSTable when it flushes).
+	// Put returns once the record is as durable as requested.
+	achieved, err := wh.writer.Put(key, value, durability)
+	if limitError(w, err) {
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] WAL write failed for key=%s: %v", key, err)
+		http.Error(w, "WAL Write Failed", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set(DurabilityHeader, achieved)
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -81,48 +95,83 @@ func (wh *WriteHandler) HandleBatchWrite(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	durability, err := requestedDurability(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limitBody(w, r, wh.maxRequestBytes)
 	var batchReq []BatchWriteRequest
 	if err := json.NewDecoder(r.Body).Decode(&batchReq); err != nil {
-		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		err = bodyError(err, "Invalid JSON request")
+		if !limitError(w, err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
 		return
 	}
 
-	// Step 1: Prepare batch for WAL writing
-	var walEntries []struct{ Key, Value string }
-	for _, entry := range batchReq {
-		walEntries = append(walEntries, struct{ Key, Value string }{
-			Key:   entry.Key,
-			Value: entry.Value,
-		})
+	if len(batchReq) == 0 {
+		http.Error(w, "Empty batch", http.StatusBadRequest)
+		return
 	}
 
-	// Step 2: Write each entry to WAL
-	for _, entry := range walEntries {
-		if err := wh.wal.Append(entry.Key, entry.Value); err != nil {
-			log.Printf("[ERROR] WAL batch write failed for key=%s: %v", entry.Key, err)
-			http.Error(w, "Batch WAL Write Failed", http.StatusInternalServerError)
+	// Write the entries, and deletes, as one atomic batch, in request order, as durable as requested
+	kvs := make([]storage.KV, len(batchReq))
+	for i, entry := range batchReq {
+		key, err := decodeText(entry.Key, entry.Encoding)
+		if err == nil {
+			kvs[i].Value, err = decodeText(entry.Value, entry.Encoding)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Entry %d: %v", i, err), http.StatusBadRequest)
 			return
 		}
+		kvs[i].Key, kvs[i].Delete = key, entry.Delete
+	}
+	achieved, err := wh.writer.PutBatch(kvs, durability)
+	if limitError(w, err) {
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] WAL batch write failed: %v", err)
+		http.Error(w, "Batch WAL Write Failed", http.StatusInternalServerError)
+		return
 	}
 
-	// Step 3: Ensure WAL is flushed before updating Memtable & SSTable
-	wh.wal.Flush()
-
-	// Step 4: Store batch in Memtable & SSTable concurrently
-	var wg sync.WaitGroup
+	w.Header().Set(DurabilityHeader, achieved)
+	w.WriteHeader(http.StatusCreated)
+}
 
-	for _, entry := range walEntries {
-		wg.Add(1)
-		go func(entry struct{ Key, Value string }) {
-			defer wg.Done()
-			wh.memtable.Set(entry.Key, entry.Value)
-			if err := wh.sstable.Write(entry.Key, entry.Value); err != nil {
-				log.Printf("[ERROR] SSTable batch write failed for key=%s: %v", entry.Key, err)
-			}
-		}(entry)
+// readValue returns the value in the body of a write request.
+func readValue(r *http.Request) (string, error) {
+	if isOctetStream(r) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", bodyError(err, "Failed to read request body")
+		}
+		return string(data), nil
 	}
 
-	wg.Wait()
+	var req struct {
+		Value    string `json:"value"`
+		Encoding string `json:"encoding"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return "", bodyError(err, "Invalid JSON request")
+	}
+	return decodeText(req.Value, req.Encoding)
+}
 
-	w.WriteHeader(http.StatusCreated)
+// requestedDurability returns the acknowledgement level asked for by the
+// request: memory, wal-buffered or fsync, or empty for the server default.
+func requestedDurability(r *http.Request) (string, error) {
+	durability := r.URL.Query().Get("durability")
+	if durability == "" {
+		durability = r.Header.Get(DurabilityHeader)
+	}
+	if err := storage.CheckDurability(durability); err != nil {
+		return "", err
+	}
+	return durability, nil
 }
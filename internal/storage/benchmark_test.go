@@ -53,6 +53,15 @@ func BenchmarkSSTableRead(b *testing.B) {
 
 	os.Remove(sstableFile)
 
+	// ✅ Insert test data
+	data := make(map[string]string, 100000)
+	for i := 0; i < 100000; i++ {
+		data[fmt.Sprintf("key_%d", i)] = fmt.Sprintf("value_%d", i)
+	}
+	if err := storage.WriteSSTable(sstableFile, data, storage.DefaultSSTableOptions()); err != nil {
+		b.Fatalf("Failed to write SSTable: %v", err)
+	}
+
 	sstable, err := storage.NewSSTable(sstableFile)
 	if err != nil {
 		b.Fatalf("Failed to initialize SSTable: %v", err)
@@ -63,11 +72,6 @@ func BenchmarkSSTableRead(b *testing.B) {
 		os.Remove(sstableFile)
 	}()
 
-	// ✅ Insert test data
-	for i := 0; i < 1000; i++ {
-		sstable.Write(fmt.Sprintf("key_%d", i), fmt.Sprintf("value_%d", i))
-	}
-
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		_, _ = sstable.Read("key_50000")
@@ -76,7 +80,7 @@ func BenchmarkSSTableRead(b *testing.B) {
 
 // Benchmark Memtable Write Performance
 func BenchmarkMemtableWrite(b *testing.B) {
-	memtable := storage.NewMemtable(100000, nil)
+	memtable := storage.NewMemtable(storage.MemtableOptions{MaxBytes: 1 << 30}, nil)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -86,7 +90,7 @@ func BenchmarkMemtableWrite(b *testing.B) {
 
 // Benchmark Memtable Read Performance
 func BenchmarkMemtableRead(b *testing.B) {
-	memtable := storage.NewMemtable(100000, nil)
+	memtable := storage.NewMemtable(storage.MemtableOptions{MaxBytes: 1 << 30}, nil)
 	for i := 0; i < 100000; i++ {
 		memtable.Set(fmt.Sprintf("key_%d", i), "value")
 	}
@@ -102,20 +106,19 @@ func BenchmarkSSTableBatchWrite(b *testing.B) {
 	sstableFile := "benchmark_sstable.db"
 
 	os.Remove(sstableFile)
+	defer os.Remove(sstableFile)
 
-	sstable, err := storage.NewSSTable(sstableFile)
+	writer, err := storage.NewSSTableWriter(sstableFile, storage.DefaultSSTableOptions())
 	if err != nil {
-		b.Fatalf("Failed to initialize SSTable: %v", err)
+		b.Fatalf("Failed to initialize SSTable writer: %v", err)
 	}
 
-	defer func() {
-		sstable.Close()
-		os.Remove(sstableFile)
-	}()
-
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = sstable.Write(fmt.Sprintf("batch_key_%d", i), "batch_value")
+		_ = writer.Add(fmt.Sprintf("batch_key_%012d", i), "batch_value")
+	}
+	if err := writer.Finish(); err != nil {
+		b.Fatalf("Failed to finish SSTable: %v", err)
 	}
 }
 
@@ -130,10 +133,9 @@ func BenchmarkSSTableCompaction(b *testing.B) {
 			filepath.Join(tmpDir, "sstable3.db"),
 		}
 
-		validContent := []byte(`{"key":"dummy1","value":"value1"}` + "\n" +
-			`{"key":"dummy2","value":"value2"}` + "\n")
+		validContent := map[string]string{"dummy1": "value1", "dummy2": "value2"}
 		for _, file := range sstables {
-			err := os.WriteFile(file, validContent, 0644)
+			err := storage.WriteSSTable(file, validContent, storage.DefaultSSTableOptions())
 			if err != nil {
 				b.Fatalf("Failed to create dummy SSTable file %s: %v", file, err)
 			}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DefaultBlockCacheCapacity = 8 * 1024 * 1024 // Used when there is neither a capacity nor a budget
+
+	blockCacheShards        = 16
+	blockCacheEntryOverhead = 80 // List element, map entry and key of a cached block
+)
+
+// BlockCacheOptions configures a BlockCache.
+type BlockCacheOptions struct {
+	Capacity          int64         // Bytes; 0 takes whatever the budget leaves
+	PinIndexAndFilter bool          // Keep SSTable indexes and Bloom filters in memory instead of in the cache
+	Budget            *MemoryBudget // Optional process-wide budget shared with memtables and indexes
+}
+
+// DefaultBlockCacheOptions returns the options used when none are configured.
+func DefaultBlockCacheOptions() BlockCacheOptions {
+	return BlockCacheOptions{
+		PinIndexAndFilter: true,
+	}
+}
+
+// BlockCache is a size-bounded LRU cache of SSTable blocks shared by every
+// open table, so hot keys are served from memory without a read syscall.
+//   - Blocks are keyed by the table's file ID and the block's offset.
+//   - The cache is split into shards, each with its own lock and LRU list,
+//     so concurrent readers rarely contend.
+//   - With a budget, the cache is charged for what it holds and shrinks to
+//     what memtables and indexes leave; eviction happens on insert.
+//   - Unless index and filter blocks are pinned, they are cached and
+//     evicted like data blocks.
+type BlockCache struct {
+	opts   BlockCacheOptions
+	shards [blockCacheShards]blockCacheShard
+	nextID atomic.Uint64
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// blockCacheKey identifies a block: the table it belongs to and its offset.
+type blockCacheKey struct {
+	file   uint64
+	offset uint64
+}
+
+// blockCacheEntry is a cached block, raw or decoded, and the bytes it is
+// charged for.
+type blockCacheEntry struct {
+	key    blockCacheKey
+	value  any
+	charge int64
+}
+
+// blockCacheShard is an independently locked part of the cache.
+type blockCacheShard struct {
+	mu      sync.Mutex
+	entries map[blockCacheKey]*list.Element
+	lru     list.List // Most recently used first
+	bytes   int64
+}
+
+// BlockCacheStats reports the cache's size and effectiveness.
+type BlockCacheStats struct {
+	Capacity int64   `json:"capacity"`
+	Bytes    int64   `json:"bytes"`
+	Blocks   int     `json:"blocks"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRate  float64 `json:"hit_rate"`
+}
+
+// NewBlockCache creates an empty cache.
+func NewBlockCache(opts BlockCacheOptions) *BlockCache {
+	c := &BlockCache{opts: opts}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[blockCacheKey]*list.Element)
+	}
+	return c
+}
+
+// newFileID returns a cache key prefix for a newly opened table.
+func (c *BlockCache) newFileID() uint64 {
+	return c.nextID.Add(1)
+}
+
+// Capacity returns how many bytes the cache may hold right now.
+func (c *BlockCache) Capacity() int64 {
+	capacity := c.opts.Capacity
+	if c.opts.Budget != nil {
+		if limit := c.opts.Budget.BlockCacheLimit(); capacity <= 0 || limit < capacity {
+			capacity = limit
+		}
+	} else if capacity <= 0 {
+		capacity = DefaultBlockCacheCapacity
+	}
+	return capacity
+}
+
+// shard returns the shard holding key.
+func (c *BlockCache) shard(key blockCacheKey) *blockCacheShard {
+	h := key.file*0x9e3779b97f4a7c15 ^ key.offset*0xbf58476d1ce4e5b9
+	return &c.shards[(h>>32)%blockCacheShards]
+}
+
+// getOrLoad returns the cached block at offset of file, calling load on a
+// miss and caching what it returns with its size in bytes.
+func (c *BlockCache) getOrLoad(file, offset uint64, load func() (any, int64, error)) (any, error) {
+	key := blockCacheKey{file: file, offset: offset}
+	s := c.shard(key)
+
+	s.mu.Lock()
+	if elem, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(elem)
+		s.mu.Unlock()
+		c.hits.Add(1)
+		return elem.Value.(*blockCacheEntry).value, nil
+	}
+	s.mu.Unlock()
+	c.misses.Add(1)
+
+	value, size, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.insert(s, &blockCacheEntry{key: key, value: value, charge: size + blockCacheEntryOverhead})
+	return value, nil
+}
+
+// insert adds entry to s and evicts least recently used blocks until the
+// shard is back within its share of the capacity. Blocks larger than the
+// share are not cached.
+func (c *BlockCache) insert(s *blockCacheShard, entry *blockCacheEntry) {
+	limit := c.Capacity() / blockCacheShards
+	if entry.charge > limit {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[entry.key]; ok {
+		return // Loaded concurrently by another reader
+	}
+	s.entries[entry.key] = s.lru.PushFront(entry)
+	s.bytes += entry.charge
+	charged := entry.charge
+
+	for s.bytes > limit {
+		charged -= s.remove(s.lru.Back())
+	}
+	if c.opts.Budget != nil {
+		c.opts.Budget.blockCache.Add(charged)
+	}
+}
+
+// evictFile drops every block of a closed table.
+func (c *BlockCache) evictFile(file uint64) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		var released int64
+
+		s.mu.Lock()
+		for elem := s.lru.Front(); elem != nil; {
+			next := elem.Next()
+			if elem.Value.(*blockCacheEntry).key.file == file {
+				released += s.remove(elem)
+			}
+			elem = next
+		}
+		s.mu.Unlock()
+
+		if c.opts.Budget != nil {
+			c.opts.Budget.blockCache.Add(-released)
+		}
+	}
+}
+
+// remove unlinks elem from the shard and returns the bytes it released.
+// Callers hold s.mu.
+func (s *blockCacheShard) remove(elem *list.Element) int64 {
+	entry := elem.Value.(*blockCacheEntry)
+	s.lru.Remove(elem)
+	delete(s.entries, entry.key)
+	s.bytes -= entry.charge
+	return entry.charge
+}
+
+// Stats returns the cache's size and hit counters.
+func (c *BlockCache) Stats() BlockCacheStats {
+	stats := BlockCacheStats{
+		Capacity: c.Capacity(),
+		Hits:     c.hits.Load(),
+		Misses:   c.misses.Load(),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Bytes += s.bytes
+		stats.Blocks += s.lru.Len()
+		s.mu.Unlock()
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
@@ -0,0 +1,123 @@
+package storage_test
+
+import (
+	"fmt"
+	"testing"
+
+	"moniepoint/internal/storage"
+)
+
+// openCachedTree opens an LSM tree whose tables share cache, with numKeys
+// keys flushed to a single multi-block file.
+func openCachedTree(t *testing.T, cache *storage.BlockCache, budget *storage.MemoryBudget, numKeys int) *storage.LSMTree {
+	t.Helper()
+	opts := storage.DefaultLSMOptions()
+	opts.BlockCache = cache
+	opts.Budget = budget
+	tree, err := storage.OpenLSMTree(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+
+	data := make(map[string]string, numKeys)
+	for i := 0; i < numKeys; i++ {
+		data[fmt.Sprintf("key_%06d", i)] = fmt.Sprintf("value_%d", i)
+	}
+	if err := tree.Flush(values(data)); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	return tree
+}
+
+// TestBlockCacheHits verifies that a repeated lookup is served from the
+// cache and that the hit shows up in the tree's stats.
+func TestBlockCacheHits(t *testing.T) {
+	cache := storage.NewBlockCache(storage.DefaultBlockCacheOptions())
+	tree := openCachedTree(t, cache, nil, 1000)
+	defer tree.Close()
+
+	for i := 0; i < 3; i++ {
+		if got, err := tree.Get("key_000500"); err != nil || got != "value_500" {
+			t.Fatalf("Expected 'value_500', got '%s' (err=%v)", got, err)
+		}
+	}
+
+	stats := tree.Stats().BlockCache
+	if stats == nil {
+		t.Fatalf("Expected block cache stats")
+	}
+	if stats.Misses != 1 || stats.Hits != 2 || stats.Blocks != 1 {
+		t.Errorf("Expected 1 miss, 2 hits and 1 cached block, got %+v", *stats)
+	}
+}
+
+// TestBlockCacheEviction verifies that the cache stays within its capacity
+// while reads keep returning the right values.
+func TestBlockCacheEviction(t *testing.T) {
+	capacity := int64(16 * 8 * 1024) // Two blocks per shard
+	cache := storage.NewBlockCache(storage.BlockCacheOptions{Capacity: capacity, PinIndexAndFilter: true})
+	tree := openCachedTree(t, cache, nil, 20000)
+	defer tree.Close()
+
+	for i := 0; i < 20000; i += 7 {
+		key := fmt.Sprintf("key_%06d", i)
+		if got, err := tree.Get(key); err != nil || got != fmt.Sprintf("value_%d", i) {
+			t.Fatalf("Expected %s='value_%d', got '%s' (err=%v)", key, i, got, err)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Bytes > capacity {
+		t.Errorf("Expected at most %d cached bytes, got %d", capacity, stats.Bytes)
+	}
+	if stats.Blocks == 0 || stats.Misses == 0 {
+		t.Errorf("Expected blocks to be cached and evicted, got %+v", stats)
+	}
+}
+
+// TestBlockCacheBudget verifies that cached blocks are charged to the memory
+// budget and released when their table is closed.
+func TestBlockCacheBudget(t *testing.T) {
+	budget := storage.NewMemoryBudget(1 << 20)
+	opts := storage.DefaultBlockCacheOptions()
+	opts.Budget = budget
+	cache := storage.NewBlockCache(opts)
+	tree := openCachedTree(t, cache, budget, 1000)
+
+	if _, err := tree.GetRange("key_000000", "key_000999"); err != nil {
+		t.Fatalf("GetRange failed: %v", err)
+	}
+	if cached, charged := cache.Stats().Bytes, budget.Stats().BlockCache; cached == 0 || cached != charged {
+		t.Errorf("Expected the %d cached bytes to be charged, got %d", cached, charged)
+	}
+	if capacity := cache.Capacity(); capacity != budget.BlockCacheLimit() {
+		t.Errorf("Expected the cache to take what the budget leaves, got %d", capacity)
+	}
+
+	tree.Close()
+	if charged := budget.Stats().BlockCache; charged != 0 {
+		t.Errorf("Expected closed tables to release their blocks, got %d bytes", charged)
+	}
+}
+
+// TestBlockCacheUnpinnedIndexes verifies that without pinning, indexes and
+// Bloom filters live in the cache instead of being charged as indexes.
+func TestBlockCacheUnpinnedIndexes(t *testing.T) {
+	budget := storage.NewMemoryBudget(1 << 20)
+	cache := storage.NewBlockCache(storage.BlockCacheOptions{Budget: budget})
+	tree := openCachedTree(t, cache, budget, 1000)
+	defer tree.Close()
+
+	if indexes := budget.Stats().Indexes; indexes != 0 {
+		t.Errorf("Expected no pinned index memory, got %d bytes", indexes)
+	}
+	if got, err := tree.Get("key_000123"); err != nil || got != "value_123" {
+		t.Fatalf("Expected 'value_123', got '%s' (err=%v)", got, err)
+	}
+	if _, err := tree.Get("missing"); err != storage.ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if blocks := cache.Stats().Blocks; blocks != 3 {
+		t.Errorf("Expected the filter, index and one data block to be cached, got %d blocks", blocks)
+	}
+}
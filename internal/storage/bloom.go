@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+const (
+	DefaultBloomBitsPerKey = 10 // ~1% false-positive rate
+
+	bloomMaxProbes = 30
+)
+
+// BloomFilter is an immutable bit array answering "definitely absent" or
+// "possibly present" for keys. It is built once per SSTable and stored in the
+// file's filter block as the raw bits followed by one byte holding the number
+// of probes.
+type BloomFilter struct {
+	bits   []byte
+	probes uint8
+}
+
+// NewBloomFilter builds a filter over the given key hashes using bitsPerKey
+// bits of space per key.
+func NewBloomFilter(hashes []uint64, bitsPerKey int) *BloomFilter {
+	// ln(2) * bits/key minimises the false-positive rate for a given size.
+	probes := int(math.Round(float64(bitsPerKey) * math.Ln2))
+	if probes < 1 {
+		probes = 1
+	}
+	if probes > bloomMaxProbes {
+		probes = bloomMaxProbes
+	}
+
+	nbits := len(hashes) * bitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	nbytes := (nbits + 7) / 8
+	nbits = nbytes * 8
+
+	f := &BloomFilter{bits: make([]byte, nbytes), probes: uint8(probes)}
+	for _, h := range hashes {
+		f.add(h, uint64(nbits))
+	}
+	return f
+}
+
+// add sets the probe bits for one key hash using double hashing.
+func (f *BloomFilter) add(h, nbits uint64) {
+	delta := h>>33 | h<<31
+	for i := uint8(0); i < f.probes; i++ {
+		pos := h % nbits
+		f.bits[pos/8] |= 1 << (pos % 8)
+		h += delta
+	}
+}
+
+// MayContain reports whether key might be in the set. A false result is exact.
+func (f *BloomFilter) MayContain(key string) bool {
+	if f == nil || len(f.bits) == 0 {
+		return true
+	}
+
+	nbits := uint64(len(f.bits) * 8)
+	h := bloomHash(key)
+	delta := h>>33 | h<<31
+	for i := uint8(0); i < f.probes; i++ {
+		pos := h % nbits
+		if f.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// Encode serialises the filter for the SSTable filter block.
+func (f *BloomFilter) Encode() []byte {
+	buf := make([]byte, 0, len(f.bits)+1)
+	buf = append(buf, f.bits...)
+	return append(buf, f.probes)
+}
+
+// decodeBloomFilter parses a filter block. An empty block means the table was
+// written without a filter.
+func decodeBloomFilter(data []byte) *BloomFilter {
+	if len(data) < 2 {
+		return nil
+	}
+	probes := data[len(data)-1]
+	if probes == 0 || probes > bloomMaxProbes {
+		// Unknown encoding: fall back to reading the table without a filter.
+		return nil
+	}
+	return &BloomFilter{bits: data[:len(data)-1], probes: probes}
+}
+
+// bloomHash is the 64-bit FNV-1a hash of key passed through the murmur3
+// finaliser, so that similar keys spread over the whole bit array.
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
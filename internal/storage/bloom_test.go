@@ -0,0 +1,78 @@
+package storage_test
+
+import (
+	"fmt"
+	"testing"
+
+	"moniepoint/internal/storage"
+)
+
+// TestSSTableBloomFilter checks that the filter never rejects a stored key and
+// rejects the vast majority of absent keys within the table's key range.
+func TestSSTableBloomFilter(t *testing.T) {
+	filePath := "test_bloom_sstable.db"
+	defer cleanup(filePath)
+
+	data := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		data[fmt.Sprintf("user_%06d", i*2)] = "present"
+	}
+	if err := storage.WriteSSTable(filePath, data, storage.DefaultSSTableOptions()); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+
+	sstable, err := storage.NewSSTable(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer sstable.Close()
+
+	for key := range data {
+		if !sstable.MayContain(key) {
+			t.Fatalf("Bloom filter rejected stored key %s", key)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if sstable.MayContain(fmt.Sprintf("user_%06d", i*2+1)) {
+			falsePositives++
+		}
+	}
+	// 10 bits per key gives ~1%; allow generous headroom.
+	if rate := float64(falsePositives) / 10000; rate > 0.03 {
+		t.Errorf("False-positive rate too high: %.2f%%", rate*100)
+	}
+}
+
+// TestSSTableBloomFilterDisabled verifies that tables written without a filter
+// still answer lookups correctly.
+func TestSSTableBloomFilterDisabled(t *testing.T) {
+	filePath := "test_bloom_sstable.db"
+	defer cleanup(filePath)
+
+	opts := storage.DefaultSSTableOptions()
+	opts.BloomBitsPerKey = 0
+	if err := storage.WriteSSTable(filePath, map[string]string{"a": "1", "c": "3"}, opts); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+
+	sstable, err := storage.NewSSTable(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer sstable.Close()
+
+	if !sstable.MayContain("b") {
+		t.Errorf("Expected in-range key to pass when no filter is stored")
+	}
+	if sstable.MayContain("d") {
+		t.Errorf("Expected out-of-range key to be rejected by key bounds")
+	}
+	if value, err := sstable.Read("c"); err != nil || value != "3" {
+		t.Errorf("Expected 'c'='3', got '%s' (err=%v)", value, err)
+	}
+	if _, err := sstable.Read("b"); err != storage.ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for 'b', got %v", err)
+	}
+}
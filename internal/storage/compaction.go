@@ -1,87 +1,513 @@
 package storage
 
 import (
-	"bufio"
-	"encoding/json"
+	"container/heap"
 	"log"
 	"os"
+	"sync"
+	"time"
 )
 
 const (
-	compactionThreshold = 2 // Reduced threshold for test compaction
-	compactedFilePath   = "data/compacted_sstable.db"
-	deleteMarker        = "DELETE"
+	deadRatioSampleBlocks  = 16 // Data blocks read to estimate a file's dead-entry ratio
+	deadRatioSamplesPerRun = 8  // Files re-sampled per scheduling pass
 )
 
 func isTestMode() bool {
 	return os.Getenv("TEST_MODE") == "true"
 }
 
-// Compact SSTables while filtering out deleted entries
-func CompactSSTables(sstables []string, compactionPath string) error {
-	compactCandidates := []string{}
-	for _, sstable := range sstables {
-		deletedRatio := calculateDeletedRatio(sstable)
-		if deletedRatio > 0.1 { // Reduce threshold to force compaction in test mode
-			compactCandidates = append(compactCandidates, sstable)
+// CompactionOptions controls when and how the background compactor runs.
+type CompactionOptions struct {
+	Strategy             string        // StrategyLeveled (default), StrategySizeTiered or StrategyTimeWindow
+	Interval             time.Duration // How often the scheduler re-evaluates the tree
+	L0Trigger            int           // Leveled: compact L0 into L1 once it holds this many files
+	LevelBaseBytes       int64         // Leveled: target size of L1
+	LevelMultiplier      int           // Leveled: each deeper level may be this many times larger
+	TargetFileSize       int64         // Leveled: compaction outputs are cut at this size
+	TierMinFiles         int           // Size-tiered and time-window: merge once a tier or window holds this many files
+	TimeWindow           time.Duration // Time-window: width of a window
+	WindowRetention      time.Duration // Time-window: drop windows older than this; 0 keeps them
+	DeadRatioThreshold   float64       // Rewrite files whose dead-entry ratio exceeds this
+	RateLimitBytesPerSec int64         // Compaction I/O budget; 0 disables throttling
+}
+
+// DefaultCompactionOptions returns the options used when none are configured.
+func DefaultCompactionOptions() CompactionOptions {
+	return CompactionOptions{
+		Strategy:             StrategyLeveled,
+		Interval:             10 * time.Second,
+		L0Trigger:            4,
+		LevelBaseBytes:       10 * 1024 * 1024,
+		LevelMultiplier:      10,
+		TargetFileSize:       2 * 1024 * 1024,
+		TierMinFiles:         4,
+		TimeWindow:           time.Hour,
+		DeadRatioThreshold:   0.3,
+		RateLimitBytesPerSec: 16 * 1024 * 1024,
+	}
+}
+
+// CompactionStats counts the work done by a Compactor and the resulting
+// amplification, so strategies can be compared on the same workload.
+//   - Write amplification: bytes written by flushes and compactions per byte
+//     flushed.
+//   - Read amplification: files read per point lookup, after key-range and
+//     Bloom filter checks.
+//   - Space amplification: bytes on disk per byte in the bottom non-empty
+//     level, which approximates the live data size.
+type CompactionStats struct {
+	Strategy               string  `json:"strategy"`
+	Compactions            uint64  `json:"compactions"`
+	TrivialMoves           uint64  `json:"trivial_moves"`
+	FilesDropped           uint64  `json:"files_dropped"`
+	BytesRead              uint64  `json:"bytes_read"`
+	BytesWritten           uint64  `json:"bytes_written"`
+	EntriesRead            uint64  `json:"entries_read"`
+	EntriesWritten         uint64  `json:"entries_written"`
+	TombstonesDropped      uint64  `json:"tombstones_dropped"`
+	RangeTombstonesDropped uint64  `json:"range_tombstones_dropped"`
+	WriteAmplification     float64 `json:"write_amplification"`
+	ReadAmplification      float64 `json:"read_amplification"`
+	SpaceAmplification     float64 `json:"space_amplification"`
+}
+
+// deadRatioSample caches the estimated dead-entry ratio of a file.
+type deadRatioSample struct {
+	version uint64 // Tree version the estimate was taken at
+	ratio   float64
+}
+
+// Compactor runs compactions on a background goroutine, off the request path.
+// It wakes up on a timer or when notified after a flush, asks its
+// CompactionStrategy for the most urgent job, merges the inputs with
+// throttled I/O and atomically swaps them for the outputs in the manifest.
+type Compactor struct {
+	tree      *LSMTree
+	opts      CompactionOptions
+	strategy  CompactionStrategy
+	limiter   *ioRateLimiter
+	notify    chan struct{}
+	closeChan chan struct{}
+	wg        sync.WaitGroup
+
+	mu         sync.Mutex // Guards stats and deadRatios; also serialises RunOnce
+	stats      CompactionStats
+	deadRatios map[uint64]deadRatioSample
+}
+
+// NewCompactor creates a compactor for tree using the strategy named in
+// opts. Call Start to run it.
+func NewCompactor(tree *LSMTree, opts CompactionOptions) (*Compactor, error) {
+	defaults := DefaultCompactionOptions()
+	if opts.Interval <= 0 {
+		opts.Interval = defaults.Interval
+	}
+	if opts.L0Trigger <= 0 {
+		opts.L0Trigger = defaults.L0Trigger
+	}
+	if opts.LevelMultiplier <= 1 {
+		opts.LevelMultiplier = defaults.LevelMultiplier
+	}
+	if opts.TierMinFiles <= 1 {
+		opts.TierMinFiles = defaults.TierMinFiles
+	}
+	if opts.TimeWindow <= 0 {
+		opts.TimeWindow = defaults.TimeWindow
+	}
+
+	strategy, err := NewCompactionStrategy(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Compactor{
+		tree:       tree,
+		opts:       opts,
+		strategy:   strategy,
+		limiter:    newIORateLimiter(opts.RateLimitBytesPerSec),
+		notify:     make(chan struct{}, 1),
+		closeChan:  make(chan struct{}),
+		stats:      CompactionStats{Strategy: strategy.Name()},
+		deadRatios: make(map[uint64]deadRatioSample),
+	}, nil
+}
+
+// Start launches the background scheduler.
+func (c *Compactor) Start() {
+	c.wg.Add(1)
+	go c.run()
+}
+
+// Stop waits for a running compaction to finish and stops the scheduler.
+func (c *Compactor) Stop() {
+	close(c.closeChan)
+	c.wg.Wait()
+}
+
+// Notify wakes the scheduler, e.g. after a Memtable flush added an L0 file.
+func (c *Compactor) Notify() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run is the scheduler loop.
+func (c *Compactor) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.notify:
+		case <-c.closeChan:
+			return
 		}
+
+		// Keep compacting while there is work, checking for shutdown between jobs.
+		for {
+			ran, err := c.RunOnce()
+			if err != nil {
+				log.Printf("[ERROR] Compaction failed: %v", err)
+				break
+			}
+			if !ran {
+				break
+			}
+			select {
+			case <-c.closeChan:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// RunOnce picks and runs the most urgent compaction, if any. It reports
+// whether a compaction was performed.
+func (c *Compactor) RunOnce() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	job := c.strategy.Pick(c.newState())
+	if job == nil {
+		return false, nil
 	}
 
-	if len(compactCandidates) < 2 {
+	if job.isTrivialMove() {
+		if err := c.tree.moveFile(job.Inputs[0], job.Level, job.OutputLevel); err != nil {
+			return false, err
+		}
+		c.stats.TrivialMoves++
+		return true, nil
+	}
+
+	result, err := c.tree.compact(job, c.limiter)
+	if err != nil {
+		return false, err
+	}
+
+	if job.Drop {
+		c.stats.FilesDropped += uint64(len(job.Inputs))
+		if !isTestMode() {
+			log.Printf("[INFO] Dropped %d files from L%d (%s)", len(job.Inputs), job.Level, job.Reason)
+		}
+		return true, nil
+	}
+
+	c.stats.Compactions++
+	c.stats.BytesRead += result.BytesRead
+	c.stats.BytesWritten += result.BytesWritten
+	c.stats.EntriesRead += result.EntriesRead
+	c.stats.EntriesWritten += result.EntriesWritten
+	c.stats.TombstonesDropped += result.TombstonesDropped
+	c.stats.RangeTombstonesDropped += result.RangeTombstonesDropped
+
+	if !isTestMode() {
+		log.Printf("[INFO] Compacted %d files L%d->L%d (%s, %s): %d -> %d entries, %d -> %d bytes",
+			len(job.Inputs)+len(job.Overlaps), job.Level, job.OutputLevel, c.strategy.Name(), job.Reason,
+			result.EntriesRead, result.EntriesWritten, result.BytesRead, result.BytesWritten)
+	}
+	return true, nil
+}
+
+// newState snapshots the tree for the strategy. Dead-entry ratios are cached
+// per file until the tree changes, and at most deadRatioSamplesPerRun files
+// are sampled per pass. Callers must hold c.mu.
+func (c *Compactor) newState() *CompactionState {
+	levels := c.tree.LevelFiles()
+	version := c.tree.Version()
+
+	live := make(map[uint64]bool)
+	for _, files := range levels {
+		for _, f := range files {
+			live[f.Number] = true
+		}
+	}
+	for number := range c.deadRatios {
+		if !live[number] {
+			delete(c.deadRatios, number)
+		}
+	}
+
+	sampled := 0
+	return &CompactionState{
+		Levels: levels,
+		Now:    time.Now(),
+		deadRatio: func(level int, f FileMeta) (float64, bool) {
+			sample, ok := c.deadRatios[f.Number]
+			if ok && sample.version == version {
+				return sample.ratio, true
+			}
+			if sampled >= deadRatioSamplesPerRun {
+				return 0, false
+			}
+			ratio, err := c.tree.estimateDeadRatio(level, f, deadRatioSampleBlocks)
+			if err != nil {
+				log.Printf("[WARN] Failed to sample SSTable %d: %v", f.Number, err)
+				return 0, false
+			}
+			c.deadRatios[f.Number] = deadRatioSample{version: version, ratio: ratio}
+			sampled++
+			return ratio, true
+		},
+	}
+}
+
+// Stats returns a snapshot of the compaction counters and the amplification
+// they have produced so far.
+func (c *Compactor) Stats() CompactionStats {
+	c.mu.Lock()
+	stats := c.stats
+	c.mu.Unlock()
+
+	tree := c.tree.Stats()
+	if tree.BytesFlushed > 0 {
+		stats.WriteAmplification = float64(tree.BytesFlushed+stats.BytesWritten) / float64(tree.BytesFlushed)
+	}
+	if tree.Lookups > 0 {
+		stats.ReadAmplification = float64(tree.TablesRead) / float64(tree.Lookups)
+	}
+	for level := len(tree.Levels) - 1; level >= 0; level-- {
+		if bottom := tree.Levels[level].Bytes; bottom > 0 {
+			stats.SpaceAmplification = float64(tree.TotalBytes) / float64(bottom)
+			break
+		}
+	}
+	return stats
+}
+
+// CompactSSTables merges the given SSTable files into a single file at
+// compactionPath and removes the inputs. Files are listed oldest first, so
+// later files win when a key appears more than once. The files are laid out
+// as the L0 of a one-level tree and merged as fullMergeStrategy picks them,
+// through the same mergeTables as the Compactor. The output is the bottom
+// level, so tombstones, point and range, are dropped along with the values
+// they shadow.
+func CompactSSTables(sstables []string, compactionPath string) error {
+	if len(sstables) == 0 {
 		if !isTestMode() {
 			log.Println("[INFO] No compaction needed.")
 		}
 		return nil
 	}
 
-	compactedFile, err := os.Create(compactionPath)
+	state := &CompactionState{Levels: [][]FileMeta{make([]FileMeta, len(sstables))}, Now: time.Now()}
+	for i := range sstables {
+		state.Levels[0][i] = FileMeta{Number: uint64(i)}
+	}
+	var strategy CompactionStrategy = fullMergeStrategy{}
+	job := strategy.Pick(state)
+
+	// mergeTables expects the newest table first.
+	tables := make([]*SSTable, 0, len(job.Inputs))
+	defer func() {
+		for _, table := range tables {
+			table.Close()
+		}
+	}()
+	for i := len(job.Inputs) - 1; i >= 0; i-- {
+		table, err := openSSTable(sstables[job.Inputs[i].Number], nil)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, table)
+	}
+
+	writer, err := NewSSTableWriter(compactionPath, DefaultSSTableOptions())
 	if err != nil {
 		return err
 	}
-	defer compactedFile.Close()
+	_, err = mergeTables(tables, func(key string, entry Entry) error {
+		if entry.Tombstone {
+			return nil
+		}
+		return writer.AddEntry(key, entry)
+	})
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+	if err := writer.Finish(); err != nil {
+		os.Remove(compactionPath)
+		return err
+	}
 
-	data := make(map[string]string)
-	for _, sstable := range compactCandidates {
-		file, err := os.Open(sstable)
-		if err != nil {
-			if !isTestMode() {
-				log.Printf("[ERROR] Failed to open SSTable %s: %v", sstable, err)
+	for _, input := range job.Inputs {
+		os.Remove(sstables[input.Number])
+	}
+	return nil
+}
+
+// fullMergeStrategy merges every file of every level into a single file at
+// the bottom level. CompactSSTables uses it for files outside an LSMTree,
+// where all of them are merged at once.
+type fullMergeStrategy struct{}
+
+// Name implements CompactionStrategy.
+func (fullMergeStrategy) Name() string { return "full" }
+
+// Pick implements CompactionStrategy.
+func (fullMergeStrategy) Pick(state *CompactionState) *Compaction {
+	var inputs []FileMeta
+	for _, files := range state.Levels {
+		inputs = append(inputs, files...)
+	}
+	if len(inputs) == 0 {
+		return nil
+	}
+	return &Compaction{Level: 0, OutputLevel: len(state.Levels) - 1, Inputs: inputs, Reason: "manual"}
+}
+
+// mergeTables walks tables (newest first) in key order and calls emit with
+// the newest record of every key, which may be a tombstone, unless a range
+// tombstone of a newer table covers it. It returns the number of entries
+// read.
+func mergeTables(tables []*SSTable, emit func(key string, entry Entry) error) (uint64, error) {
+	var entriesRead uint64
+	h := &mergeHeap{}
+	for priority, table := range tables {
+		it := table.newTableIterator()
+		if it.next() {
+			heap.Push(h, mergeItem{it: it, priority: priority})
+		} else if it.err != nil {
+			return entriesRead, it.err
+		}
+	}
+
+	for h.Len() > 0 {
+		top := heap.Pop(h).(mergeItem)
+		key, entry := top.it.key, top.it.entry
+		entriesRead++
+
+		// Skip older versions of the same key in the other tables.
+		if err := h.advance(top); err != nil {
+			return entriesRead, err
+		}
+		for h.Len() > 0 && (*h)[0].it.key == key {
+			entriesRead++
+			if err := h.advance(heap.Pop(h).(mergeItem)); err != nil {
+				return entriesRead, err
 			}
+		}
+
+		if rangeDeleted(tables[:top.priority], key) {
 			continue
 		}
-		defer file.Close()
+		if err := emit(key, entry); err != nil {
+			return entriesRead, err
+		}
+	}
+	return entriesRead, nil
+}
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			var entry map[string]string
-			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
-				if !isTestMode() {
-					log.Printf("[WARNING] Skipping malformed entry in %s", sstable)
-				}
-				continue
-			}
-			if entry["value"] != deleteMarker {
-				data[entry["key"]] = entry["value"]
-			}
+// rangeDeleted reports whether a range tombstone of any of tables covers key.
+func rangeDeleted(tables []*SSTable, key string) bool {
+	for _, table := range tables {
+		if _, ok := table.ranges.covering(key); ok {
+			return true
 		}
 	}
+	return false
+}
+
+// mergeItem is a table iterator positioned at its current entry.
+type mergeItem struct {
+	it       *tableIterator
+	priority int // Lower is newer
+}
+
+// mergeHeap orders iterators by key, then by recency.
+type mergeHeap []mergeItem
 
-	encoder := json.NewEncoder(compactedFile)
-	for key, value := range data {
-		encoder.Encode(map[string]string{"key": key, "value": value})
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].it.key != h[j].it.key {
+		return h[i].it.key < h[j].it.key
 	}
+	return h[i].priority < h[j].priority
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(mergeItem)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
 
-	for _, sstable := range compactCandidates {
-		os.Remove(sstable)
+// advance moves item to its next entry and pushes it back if not exhausted.
+func (h *mergeHeap) advance(item mergeItem) error {
+	if item.it.next() {
+		heap.Push(h, item)
+		return nil
 	}
+	return item.it.err
+}
 
-	return nil
+// ioRateLimiter is a token bucket limiting compaction I/O to a number of
+// bytes per second, with up to one second of burst.
+type ioRateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	available float64
+	last      time.Time
+}
+
+// newIORateLimiter returns nil (no throttling) for a non-positive rate.
+func newIORateLimiter(bytesPerSec int64) *ioRateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &ioRateLimiter{
+		rate:      float64(bytesPerSec),
+		available: float64(bytesPerSec),
+		last:      time.Now(),
+	}
 }
 
-// Adjust for test runs
-func calculateDeletedRatio(_ string) float64 {
-	if isTestMode() {
-		return 0.5 // Ensure compaction is triggered
+// wait blocks until n bytes of budget are available.
+func (l *ioRateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.available += now.Sub(l.last).Seconds() * l.rate
+	if l.available > l.rate {
+		l.available = l.rate
+	}
+	l.last = now
+	l.available -= float64(n)
+	deficit := -l.available
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
 	}
-	return 0.3
 }
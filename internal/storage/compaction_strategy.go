@@ -0,0 +1,377 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// Compaction strategy names accepted by CompactionOptions.Strategy.
+const (
+	StrategyLeveled    = "leveled"
+	StrategySizeTiered = "size-tiered"
+	StrategyTimeWindow = "time-window"
+)
+
+// CompactionStrategy decides which files the Compactor merges and where the
+// output goes. The Compactor owns scheduling, I/O and the manifest swap; a
+// strategy only looks at the file layout and returns the next job.
+//
+// Strategies must keep two invariants the read path relies on: every level
+// holds newer data than the levels below it, and within a level a file with
+// a higher number holds newer data than any file it overlaps.
+type CompactionStrategy interface {
+	// Name identifies the strategy in configuration and stats.
+	Name() string
+	// Pick returns the most urgent compaction, or nil if there is none.
+	Pick(state *CompactionState) *Compaction
+}
+
+// NewCompactionStrategy returns the strategy named by opts.Strategy. An empty
+// name selects leveled compaction.
+func NewCompactionStrategy(opts CompactionOptions) (CompactionStrategy, error) {
+	switch opts.Strategy {
+	case "", StrategyLeveled:
+		return &LeveledStrategy{opts: opts}, nil
+	case StrategySizeTiered:
+		return &SizeTieredStrategy{opts: opts}, nil
+	case StrategyTimeWindow:
+		return &TimeWindowStrategy{opts: opts}, nil
+	}
+	return nil, fmt.Errorf("unknown compaction strategy %q", opts.Strategy)
+}
+
+// Compaction describes one job: every input file at Level is merged with the
+// Overlaps at OutputLevel into new files at OutputLevel.
+type Compaction struct {
+	Level          int
+	OutputLevel    int
+	Inputs         []FileMeta
+	Overlaps       []FileMeta
+	Reason         string
+	TargetFileSize int64 // Outputs are cut at this size; 0 writes a single file
+	Drop           bool  // Delete the inputs without merging them
+}
+
+// isTrivialMove reports whether the compaction can be done by moving a single
+// file to the next level without rewriting it.
+func (c *Compaction) isTrivialMove() bool {
+	return c.Reason == "size" && c.Level > 0 && c.Level != c.OutputLevel &&
+		len(c.Inputs) == 1 && len(c.Overlaps) == 0
+}
+
+// CompactionState is the view of the tree a strategy picks from.
+type CompactionState struct {
+	Levels [][]FileMeta // Live files per level, oldest first
+	Now    time.Time
+
+	deadRatio func(level int, f FileMeta) (float64, bool)
+}
+
+// DeadRatio returns the estimated fraction of f's entries that merging it
+// into the next level would reclaim. ok is false when f has not been sampled
+// and the sampling budget of the current pass is spent.
+func (s *CompactionState) DeadRatio(level int, f FileMeta) (ratio float64, ok bool) {
+	if s.deadRatio == nil {
+		return 0, false
+	}
+	return s.deadRatio(level, f)
+}
+
+// LeveledStrategy keeps L1..Ln as non-overlapping sorted runs, each level
+// LevelMultiplier times larger than the one above. Lookups read at most one
+// file per level, at the cost of rewriting data once per level.
+type LeveledStrategy struct {
+	opts CompactionOptions
+}
+
+// Name implements CompactionStrategy.
+func (s *LeveledStrategy) Name() string { return StrategyLeveled }
+
+// Pick chooses the next compaction. In order of priority:
+//  1. L0 holding L0Trigger or more files (read amplification).
+//  2. The level most over its size target; the file with the least overlap
+//     in the next level is chosen to minimise write amplification.
+//  3. A file whose sampled dead-entry ratio exceeds DeadRatioThreshold
+//     (space amplification). Dead entries are those a merge with the next
+//     level would reclaim: deleted keys and keys the next level also holds.
+func (s *LeveledStrategy) Pick(state *CompactionState) *Compaction {
+	levels := state.Levels
+	last := len(levels) - 1
+
+	bestLevel, bestScore := -1, 1.0
+	if score := float64(len(levels[0])) / float64(s.opts.L0Trigger); score >= bestScore {
+		bestLevel, bestScore = 0, score
+	}
+	for level := 1; level < last; level++ {
+		score := float64(levelBytes(levels[level])) / float64(s.maxBytesForLevel(level))
+		if score > bestScore {
+			bestLevel, bestScore = level, score
+		}
+	}
+
+	switch {
+	case bestLevel == 0:
+		return s.newL0Compaction(levels, "file-count")
+	case bestLevel > 0:
+		f := leastOverlapping(levels[bestLevel], levels[bestLevel+1])
+		return s.newCompaction(levels, bestLevel, bestLevel+1, f, "size")
+	}
+
+	return s.pickByDeadRatio(state)
+}
+
+// pickByDeadRatio returns a compaction for the first file whose estimated
+// dead-entry ratio is above the threshold.
+func (s *LeveledStrategy) pickByDeadRatio(state *CompactionState) *Compaction {
+	if s.opts.DeadRatioThreshold <= 0 {
+		return nil
+	}
+
+	levels := state.Levels
+	for level, files := range levels {
+		for _, f := range files {
+			ratio, ok := state.DeadRatio(level, f)
+			if !ok || ratio < s.opts.DeadRatioThreshold {
+				continue
+			}
+			if level == 0 {
+				return s.newL0Compaction(levels, "dead-ratio")
+			}
+			outputLevel := level + 1
+			if outputLevel > len(levels)-1 {
+				outputLevel = level
+			}
+			return s.newCompaction(levels, level, outputLevel, f, "dead-ratio")
+		}
+	}
+	return nil
+}
+
+// maxBytesForLevel returns the size target of a sorted level.
+func (s *LeveledStrategy) maxBytesForLevel(level int) int64 {
+	target := s.opts.LevelBaseBytes
+	for i := 1; i < level; i++ {
+		target *= int64(s.opts.LevelMultiplier)
+	}
+	return target
+}
+
+// newL0Compaction merges every L0 file into L1. L0 files overlap, so they
+// are always compacted together to keep newer data above older data.
+func (s *LeveledStrategy) newL0Compaction(levels [][]FileMeta, reason string) *Compaction {
+	inputs := append([]FileMeta(nil), levels[0]...)
+	minKey, maxKey := keyRange(inputs)
+	return &Compaction{
+		Level:          0,
+		OutputLevel:    1,
+		Inputs:         inputs,
+		Overlaps:       overlappingRuns(levels[1], minKey, maxKey),
+		Reason:         reason,
+		TargetFileSize: s.opts.TargetFileSize,
+	}
+}
+
+// newCompaction merges f, and any file of its level that overlaps it, into
+// outputLevel.
+func (s *LeveledStrategy) newCompaction(levels [][]FileMeta, level, outputLevel int, f FileMeta, reason string) *Compaction {
+	c := &Compaction{
+		Level:          level,
+		OutputLevel:    outputLevel,
+		Inputs:         overlappingRuns(levels[level], f.MinKey, f.MaxKey),
+		Reason:         reason,
+		TargetFileSize: s.opts.TargetFileSize,
+	}
+	if outputLevel != level {
+		minKey, maxKey := keyRange(c.Inputs)
+		c.Overlaps = overlappingRuns(levels[outputLevel], minKey, maxKey)
+	}
+	return c
+}
+
+// SizeTieredStrategy treats each level as a tier of overlapping runs of
+// similar size. Once a tier holds TierMinFiles runs they are merged into a
+// single run in the next tier; the bottom tier is merged in place. Data is
+// rewritten once per tier, far less than leveled compaction, but lookups may
+// have to search every run.
+type SizeTieredStrategy struct {
+	opts CompactionOptions
+}
+
+// Name implements CompactionStrategy.
+func (s *SizeTieredStrategy) Name() string { return StrategySizeTiered }
+
+// Pick merges the shallowest full tier. Failing that, the bottom tier is
+// rewritten once a file in it has a dead-entry ratio over the threshold.
+func (s *SizeTieredStrategy) Pick(state *CompactionState) *Compaction {
+	levels := state.Levels
+	last := len(levels) - 1
+
+	for level, files := range levels {
+		if len(files) < s.opts.TierMinFiles {
+			continue
+		}
+		outputLevel := level + 1
+		if level == last {
+			outputLevel = level
+		}
+		return &Compaction{
+			Level:       level,
+			OutputLevel: outputLevel,
+			Inputs:      append([]FileMeta(nil), files...),
+			Reason:      "tier-full",
+		}
+	}
+
+	if s.opts.DeadRatioThreshold <= 0 {
+		return nil
+	}
+	for _, f := range levels[last] {
+		if ratio, ok := state.DeadRatio(last, f); ok && ratio >= s.opts.DeadRatioThreshold {
+			return &Compaction{
+				Level:       last,
+				OutputLevel: last,
+				Inputs:      append([]FileMeta(nil), levels[last]...),
+				Reason:      "dead-ratio",
+			}
+		}
+	}
+	return nil
+}
+
+// TimeWindowStrategy groups files by the time window their data was written
+// in. Flushes of the current window are merged with each other in L0; once a
+// window has passed, its files are merged into a single L1 file that is
+// never rewritten again. Windows older than WindowRetention are dropped
+// whole, which suits append-mostly data that expires by age.
+type TimeWindowStrategy struct {
+	opts CompactionOptions
+}
+
+// Name implements CompactionStrategy.
+func (s *TimeWindowStrategy) Name() string { return StrategyTimeWindow }
+
+// Pick chooses, in order: expired files to drop, the oldest closed window
+// still in L0, and the current window once it holds TierMinFiles L0 files.
+func (s *TimeWindowStrategy) Pick(state *CompactionState) *Compaction {
+	levels := state.Levels
+	current := s.window(state.Now.Unix())
+
+	if s.opts.WindowRetention > 0 {
+		cutoff := s.window(state.Now.Add(-s.opts.WindowRetention).Unix())
+		for level, files := range levels {
+			var expired []FileMeta
+			for _, f := range files {
+				if s.window(f.CreatedAt) < cutoff {
+					expired = append(expired, f)
+				}
+			}
+			if len(expired) > 0 {
+				return &Compaction{Level: level, OutputLevel: level, Inputs: expired, Reason: "expired", Drop: true}
+			}
+		}
+	}
+
+	// L0 is in flush order, so the oldest window's files come first.
+	if len(levels[0]) == 0 {
+		return nil
+	}
+	oldest := s.window(levels[0][0].CreatedAt)
+	if oldest < current {
+		var inputs, overlaps []FileMeta
+		for _, f := range levels[0] {
+			if s.window(f.CreatedAt) == oldest {
+				inputs = append(inputs, f)
+			}
+		}
+		for _, f := range levels[1] {
+			if s.window(f.CreatedAt) == oldest {
+				overlaps = append(overlaps, f)
+			}
+		}
+		return &Compaction{Level: 0, OutputLevel: 1, Inputs: inputs, Overlaps: overlaps, Reason: "window-closed"}
+	}
+
+	if len(levels[0]) >= s.opts.TierMinFiles {
+		return &Compaction{
+			Level:       0,
+			OutputLevel: 0,
+			Inputs:      append([]FileMeta(nil), levels[0]...),
+			Reason:      "window-file-count",
+		}
+	}
+	return nil
+}
+
+// window returns the index of the time window containing a Unix timestamp.
+func (s *TimeWindowStrategy) window(unix int64) int64 {
+	width := int64(s.opts.TimeWindow / time.Second)
+	if width <= 0 {
+		width = 1
+	}
+	return unix / width
+}
+
+// leastOverlapping returns the file of a level that overlaps the fewest bytes
+// of the next level relative to its own size.
+func leastOverlapping(files, next []FileMeta) FileMeta {
+	best, bestRatio := files[0], -1.0
+	for _, f := range files {
+		ratio := float64(levelBytes(overlapping(next, f.MinKey, f.MaxKey))) / float64(f.Size+1)
+		if bestRatio < 0 || ratio < bestRatio {
+			best, bestRatio = f, ratio
+		}
+	}
+	return best
+}
+
+// overlapping returns the files whose key range intersects [minKey, maxKey].
+func overlapping(files []FileMeta, minKey, maxKey string) []FileMeta {
+	var result []FileMeta
+	for _, f := range files {
+		if f.MaxKey >= minKey && f.MinKey <= maxKey {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// overlappingRuns is overlapping with the range widened until no other file
+// intersects it. On a level of non-overlapping files the two are the same;
+// on a level of stacked runs it ensures no file left behind overlaps, and
+// could be wrongly shadowed by, the newer-numbered compaction output.
+func overlappingRuns(files []FileMeta, minKey, maxKey string) []FileMeta {
+	for {
+		result := overlapping(files, minKey, maxKey)
+		if len(result) == 0 {
+			return nil
+		}
+		lo, hi := keyRange(result)
+		if lo >= minKey && hi <= maxKey {
+			return result
+		}
+		minKey, maxKey = min(lo, minKey), max(hi, maxKey)
+	}
+}
+
+// keyRange returns the smallest and largest key covered by files.
+func keyRange(files []FileMeta) (string, string) {
+	minKey, maxKey := files[0].MinKey, files[0].MaxKey
+	for _, f := range files[1:] {
+		if f.MinKey < minKey {
+			minKey = f.MinKey
+		}
+		if f.MaxKey > maxKey {
+			maxKey = f.MaxKey
+		}
+	}
+	return minKey, maxKey
+}
+
+// levelBytes returns the total size of files.
+func levelBytes(files []FileMeta) int64 {
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+	return total
+}
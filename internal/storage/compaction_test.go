@@ -1,11 +1,12 @@
 package storage_test
 
 import (
-	"bufio"
-	"encoding/json"
+	"fmt"
 	"moniepoint/internal/storage"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 // Test SSTable Compaction with proper cleanup
@@ -22,24 +23,15 @@ func TestSSTableCompaction(t *testing.T) {
 	defer cleanTestFiles(testFiles)
 
 	for _, filePath := range testFiles {
-		file, err := os.Create(filePath)
+		writer, err := storage.NewSSTableWriter(filePath, storage.DefaultSSTableOptions())
 		if err != nil {
 			t.Fatalf("[FATAL] Failed to create SSTable %s: %v", filePath, err)
 		}
-		defer file.Close()
-
-		entries := []map[string]string{
-			{"key": "key1", "value": "value1"},
-			{"key": "key2", "value": "value2"},
-			{"key": "key3", "value": "DELETE"},
-		}
-
-		for _, entry := range entries {
-			jsonData, _ := json.Marshal(entry)
-			_, err = file.WriteString(string(jsonData) + "\n")
-			if err != nil {
-				t.Fatalf("[FATAL] Failed to write to SSTable %s: %v", filePath, err)
-			}
+		writer.Add("key1", "value1")
+		writer.Add("key2", "value2")
+		writer.AddEntry("key3", storage.Entry{Tombstone: true})
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("[FATAL] Failed to write SSTable %s: %v", filePath, err)
 		}
 	}
 
@@ -55,36 +47,38 @@ func TestSSTableCompaction(t *testing.T) {
 		t.Fatalf("[FATAL] Compacted SSTable not found")
 	}
 
-	compactedFileHandle, err := os.Open(compactedFile)
+	compacted, err := storage.NewSSTable(compactedFile)
 	if err != nil {
 		t.Fatalf("[FATAL] Failed to open compacted SSTable: %v", err)
 	}
-	defer compactedFileHandle.Close()
+	defer compacted.Close()
 
 	expectedData := map[string]string{
 		"key1": "value1",
 		"key2": "value2",
 	}
 
-	scanner := bufio.NewScanner(compactedFileHandle)
-	for scanner.Scan() {
-		var entry map[string]string
-		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
-			t.Fatalf("[FATAL] Failed to unmarshal entry in compacted SSTable: %v", err)
-		}
+	entries, err := compacted.ReadRange("", "\xff")
+	if err != nil {
+		t.Fatalf("[FATAL] Failed to read compacted SSTable: %v", err)
+	}
 
-		if entry["key"] == "key3" {
+	for key, value := range entries {
+		if key == "key3" {
 			t.Fatalf("[FATAL] Deleted key 'key3' was found in compacted SSTable")
 		}
 
-		if val, exists := expectedData[entry["key"]]; exists {
-			if val != entry["value"] {
-				t.Errorf("[ERROR] Expected value '%s' for key '%s', got '%s'", val, entry["key"], entry["value"])
+		if val, exists := expectedData[key]; exists {
+			if val != value {
+				t.Errorf("[ERROR] Expected value '%s' for key '%s', got '%s'", val, key, value)
 			}
 		} else {
-			t.Errorf("[ERROR] Unexpected key '%s' found in compacted SSTable", entry["key"])
+			t.Errorf("[ERROR] Unexpected key '%s' found in compacted SSTable", key)
 		}
 	}
+	if len(entries) != len(expectedData) {
+		t.Errorf("[ERROR] Expected %d entries in compacted SSTable, got %d", len(expectedData), len(entries))
+	}
 
 	for _, filePath := range testFiles {
 		if _, err := os.Stat(filePath); !os.IsNotExist(err) {
@@ -98,3 +92,461 @@ func cleanTestFiles(files []string) {
 		_ = os.Remove(file)
 	}
 }
+
+// flushBatches writes each batch to tree as its own L0 file.
+func flushBatches(t *testing.T, tree *storage.LSMTree, batches ...map[string]string) {
+	t.Helper()
+	for _, batch := range batches {
+		if err := tree.Flush(values(batch)); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+}
+
+// TestCompactorL0ToL1 verifies that reaching the L0 file trigger merges every
+// L0 file into L1, keeps the newest values and deletes the input files.
+func TestCompactorL0ToL1(t *testing.T) {
+	os.Setenv("TEST_MODE", "true")
+	defer os.Unsetenv("TEST_MODE")
+
+	dir := t.TempDir()
+	tree, err := storage.OpenLSMTree(dir, storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	opts := storage.DefaultCompactionOptions()
+	opts.L0Trigger = 3
+	opts.DeadRatioThreshold = 0 // Isolate the file-count trigger
+	opts.RateLimitBytesPerSec = 0
+	compactor, err := storage.NewCompactor(tree, opts)
+	if err != nil {
+		t.Fatalf("Failed to create compactor: %v", err)
+	}
+
+	flushBatches(t, tree,
+		map[string]string{"a": "1", "b": "1", "c": "1"},
+		map[string]string{"b": "2"},
+	)
+	if ran, err := compactor.RunOnce(); err != nil || ran {
+		t.Fatalf("Expected no compaction below the trigger (ran=%v, err=%v)", ran, err)
+	}
+
+	flushBatches(t, tree, map[string]string{"c": "3", "d": "3"})
+	if ran, err := compactor.RunOnce(); err != nil || !ran {
+		t.Fatalf("Expected a compaction at the trigger (ran=%v, err=%v)", ran, err)
+	}
+
+	levels := tree.LevelFiles()
+	if len(levels[0]) != 0 || len(levels[1]) != 1 {
+		t.Fatalf("Expected 0 L0 and 1 L1 files, got %d and %d", len(levels[0]), len(levels[1]))
+	}
+	if levels[1][0].EntryCount != 4 {
+		t.Errorf("Expected 4 entries after merge, got %d", levels[1][0].EntryCount)
+	}
+
+	expected := map[string]string{"a": "1", "b": "2", "c": "3", "d": "3"}
+	for key, want := range expected {
+		if got, err := tree.Get(key); err != nil || got != want {
+			t.Errorf("Expected %s=%s, got '%s' (err=%v)", key, want, got, err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if len(files) != 1 {
+		t.Errorf("Expected input files to be deleted, found %v", files)
+	}
+
+	stats := compactor.Stats()
+	if stats.Compactions != 1 || stats.EntriesRead != 6 || stats.EntriesWritten != 4 {
+		t.Errorf("Unexpected compaction stats: %+v", stats)
+	}
+}
+
+// TestCompactorDeadRatio verifies that a file whose entries are mostly
+// overwritten by the level it merges into is compacted even though no size
+// or file-count trigger has fired.
+func TestCompactorDeadRatio(t *testing.T) {
+	os.Setenv("TEST_MODE", "true")
+	defer os.Unsetenv("TEST_MODE")
+
+	tree, err := storage.OpenLSMTree(t.TempDir(), storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	opts := storage.DefaultCompactionOptions()
+	opts.L0Trigger = 100
+	opts.RateLimitBytesPerSec = 0
+	compactor, err := storage.NewCompactor(tree, opts)
+	if err != nil {
+		t.Fatalf("Failed to create compactor: %v", err)
+	}
+
+	original := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		original[fmt.Sprintf("key%03d", i)] = "old"
+	}
+	flushBatches(t, tree, original)
+	if ran, err := compactor.RunOnce(); err != nil || ran {
+		t.Fatalf("Expected no compaction for a single clean file (ran=%v, err=%v)", ran, err)
+	}
+
+	overwrites := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		overwrites[fmt.Sprintf("key%03d", i)] = "new"
+	}
+	flushBatches(t, tree, overwrites)
+
+	if ran, err := compactor.RunOnce(); err != nil || !ran {
+		t.Fatalf("Expected a dead-ratio compaction (ran=%v, err=%v)", ran, err)
+	}
+
+	levels := tree.LevelFiles()
+	if len(levels[0]) != 0 || len(levels[1]) != 1 || levels[1][0].EntryCount != 100 {
+		t.Fatalf("Expected one L1 file with 100 entries, got levels %+v", levels[:2])
+	}
+	if got, _ := tree.Get("key010"); got != "new" {
+		t.Errorf("Expected overwritten value 'new', got '%s'", got)
+	}
+	if got, _ := tree.Get("key090"); got != "old" {
+		t.Errorf("Expected untouched value 'old', got '%s'", got)
+	}
+}
+
+// TestCompactorDropsDeletedKeys verifies that tombstones reaching the bottom
+// level are dropped together with the values they shadow.
+func TestCompactorDropsDeletedKeys(t *testing.T) {
+	os.Setenv("TEST_MODE", "true")
+	defer os.Unsetenv("TEST_MODE")
+
+	lsmOpts := storage.DefaultLSMOptions()
+	lsmOpts.NumLevels = 2
+	tree, err := storage.OpenLSMTree(t.TempDir(), lsmOpts)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	opts := storage.DefaultCompactionOptions()
+	opts.L0Trigger = 1
+	opts.RateLimitBytesPerSec = 0
+	compactor, err := storage.NewCompactor(tree, opts)
+	if err != nil {
+		t.Fatalf("Failed to create compactor: %v", err)
+	}
+
+	flushBatches(t, tree, map[string]string{"a": "1", "b": "2", "c": "3"})
+	if ran, err := compactor.RunOnce(); err != nil || !ran {
+		t.Fatalf("Expected L0 compaction (ran=%v, err=%v)", ran, err)
+	}
+
+	tombstones := map[string]storage.Entry{"a": {Tombstone: true}, "b": {Tombstone: true}}
+	if err := tree.Flush(tombstones); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if ran, err := compactor.RunOnce(); err != nil || !ran {
+		t.Fatalf("Expected the tombstones to be merged into L1 (ran=%v, err=%v)", ran, err)
+	}
+
+	levels := tree.LevelFiles()
+	if len(levels[1]) != 1 || levels[1][0].EntryCount != 1 || levels[1][0].Tombstones != 0 {
+		t.Fatalf("Expected a single L1 file holding 1 live entry, got %+v", levels[1])
+	}
+	if stats := compactor.Stats(); stats.TombstonesDropped != 2 {
+		t.Errorf("Expected 2 tombstones dropped, got %+v", stats)
+	}
+	if ran, err := compactor.RunOnce(); err != nil || ran {
+		t.Errorf("Expected the tree to be fully compacted (ran=%v, err=%v)", ran, err)
+	}
+}
+
+// TestCompactorKeepsTombstonesOverOlderData verifies that a tombstone is not
+// dropped while a deeper level still holds an older value of its key.
+func TestCompactorKeepsTombstonesOverOlderData(t *testing.T) {
+	os.Setenv("TEST_MODE", "true")
+	defer os.Unsetenv("TEST_MODE")
+
+	tree, err := storage.OpenLSMTree(t.TempDir(), storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	opts := storage.DefaultCompactionOptions()
+	opts.Strategy = storage.StrategySizeTiered
+	opts.TierMinFiles = 2
+	opts.DeadRatioThreshold = 0
+	opts.RateLimitBytesPerSec = 0
+	compactor, err := storage.NewCompactor(tree, opts)
+	if err != nil {
+		t.Fatalf("Failed to create compactor: %v", err)
+	}
+
+	// Leave "a" in a run in L1, then delete it through a newer L0 tier.
+	flushBatches(t, tree, map[string]string{"a": "1"}, map[string]string{"b": "1"})
+	runUntilIdle(t, compactor)
+	flushBatches(t, tree, map[string]string{"c": "1"})
+	if err := tree.Flush(map[string]storage.Entry{"a": {Tombstone: true}}); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if ran, err := compactor.RunOnce(); err != nil || !ran {
+		t.Fatalf("Expected the L0 tier to be merged (ran=%v, err=%v)", ran, err)
+	}
+
+	levels := tree.LevelFiles()
+	if len(levels[1]) != 2 {
+		t.Fatalf("Expected two overlapping runs in L1, got %+v", levels[1])
+	}
+	if levels[1][1].Tombstones != 1 {
+		t.Errorf("Expected the tombstone to be kept above the older run, got %+v", levels[1][1])
+	}
+	if _, err := tree.Get("a"); err != storage.ErrKeyNotFound {
+		t.Errorf("Expected deleted key to stay hidden, got %v", err)
+	}
+
+	// Merging both runs meets the older value, so both can go.
+	runUntilIdle(t, compactor)
+	if _, err := tree.Get("a"); err != storage.ErrKeyNotFound {
+		t.Errorf("Expected deleted key to stay hidden after the final merge, got %v", err)
+	}
+	if stats := compactor.Stats(); stats.TombstonesDropped != 1 {
+		t.Errorf("Expected the tombstone to be dropped at the bottom, got %+v", stats)
+	}
+}
+
+// TestCompactorRangeDeletes verifies that a range tombstone is kept, within
+// outputs that do not overlap, while a deeper level holds keys it covers, and
+// that the keys and then the tombstone are reclaimed as it reaches the bottom.
+func TestCompactorRangeDeletes(t *testing.T) {
+	os.Setenv("TEST_MODE", "true")
+	defer os.Unsetenv("TEST_MODE")
+
+	lsmOpts := storage.DefaultLSMOptions()
+	lsmOpts.NumLevels = 3
+	tree, err := storage.OpenLSMTree(t.TempDir(), lsmOpts)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	opts := storage.DefaultCompactionOptions()
+	opts.L0Trigger = 2
+	opts.LevelBaseBytes = 1 // Push everything to the bottom
+	opts.RateLimitBytesPerSec = 0
+	deep, err := storage.NewCompactor(tree, opts)
+	if err != nil {
+		t.Fatalf("Failed to create compactor: %v", err)
+	}
+	opts.LevelBaseBytes = 1 << 30 // Stop at L1
+	opts.TargetFileSize = 1       // A file per key, where the range tombstone allows
+	shallow, err := storage.NewCompactor(tree, opts)
+	if err != nil {
+		t.Fatalf("Failed to create compactor: %v", err)
+	}
+
+	data := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		data[fmt.Sprintf("k%03d", i)] = "1"
+	}
+	flushBatches(t, tree, data, map[string]string{"k000": "1"}) // Two files for the L0 trigger
+	runUntilIdle(t, deep)
+
+	// Delete [k050, k150) over newer values, then write k100 again.
+	for key := range data {
+		data[key] = "2"
+	}
+	flushBatches(t, tree, data)
+	memtable := storage.NewMemtable(storage.DefaultMemtableOptions(), func(it *storage.MemtableIterator, seq uint64) error {
+		if err := tree.FlushMemtable(it); err != nil {
+			t.Errorf("FlushMemtable failed: %v", err)
+		}
+		return nil
+	})
+	memtable.DeleteRange("k050", "k150")
+	memtable.Set("k100", "3")
+	memtable.Flush()
+	memtable.Close()
+
+	check := func(stage string) {
+		t.Helper()
+		for key, want := range map[string]string{"k049": "2", "k050": "", "k100": "3", "k149": "", "k150": "2"} {
+			if got, err := tree.Get(key); got != want || (want == "") != (err == storage.ErrKeyNotFound) {
+				t.Errorf("%s: expected %s=%q, got %q (err=%v)", stage, key, want, got, err)
+			}
+		}
+		results, err := tree.GetRange("k000", "k999")
+		if err != nil || len(results) != 101 {
+			t.Errorf("%s: expected 101 keys in range, got %d (err=%v)", stage, len(results), err)
+		}
+	}
+
+	if ran, err := shallow.RunOnce(); err != nil || !ran {
+		t.Fatalf("Expected L0 compaction (ran=%v, err=%v)", ran, err)
+	}
+	levels := tree.LevelFiles()
+	var ranges uint64
+	for i, f := range levels[1] {
+		ranges += f.RangeTombstones
+		if i > 0 && levels[1][i-1].MaxKey >= f.MinKey {
+			t.Errorf("Expected L1 files not to overlap, got %+v and %+v", levels[1][i-1], f)
+		}
+	}
+	if len(levels[1]) < 2 || ranges != 1 {
+		t.Fatalf("Expected several L1 files and the range tombstone kept over L2, got %+v", levels[1])
+	}
+	check("Over L2")
+
+	runUntilIdle(t, deep)
+	levels = tree.LevelFiles()
+	var entries uint64
+	for _, f := range levels[2] {
+		entries += f.EntryCount
+	}
+	if len(levels[1]) != 0 || entries != 101 {
+		t.Errorf("Expected the 101 live keys alone in L2, got %d (%+v)", entries, levels)
+	}
+	if stats := deep.Stats(); stats.RangeTombstonesDropped != 1 {
+		t.Errorf("Expected the range tombstone to be dropped at the bottom, got %+v", stats)
+	}
+	check("At the bottom")
+}
+
+// TestCompactorSizeTiered verifies that full tiers are merged into a single
+// run in the next tier, and that overlapping runs in a tier are searched
+// newest first.
+func TestCompactorSizeTiered(t *testing.T) {
+	os.Setenv("TEST_MODE", "true")
+	defer os.Unsetenv("TEST_MODE")
+
+	tree, err := storage.OpenLSMTree(t.TempDir(), storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	opts := storage.DefaultCompactionOptions()
+	opts.Strategy = storage.StrategySizeTiered
+	opts.TierMinFiles = 2
+	opts.RateLimitBytesPerSec = 0
+	compactor, err := storage.NewCompactor(tree, opts)
+	if err != nil {
+		t.Fatalf("Failed to create compactor: %v", err)
+	}
+
+	// Two rounds of two flushes each leave two overlapping runs in L1.
+	for round := 1; round <= 2; round++ {
+		flushBatches(t, tree,
+			map[string]string{"a": fmt.Sprintf("a%d", round), "m": fmt.Sprintf("m%d", round)},
+			map[string]string{"c": fmt.Sprintf("c%d", round), "z": fmt.Sprintf("z%d", round)},
+		)
+		if ran, err := compactor.RunOnce(); err != nil || !ran {
+			t.Fatalf("Expected L0 tier to be merged (ran=%v, err=%v)", ran, err)
+		}
+		if ran, err := compactor.RunOnce(); err != nil || ran != (round == 2) {
+			t.Fatalf("Round %d: unexpected L1 tier merge (ran=%v, err=%v)", round, ran, err)
+		}
+	}
+
+	levels := tree.LevelFiles()
+	if len(levels[0]) != 0 || len(levels[1]) != 0 || len(levels[2]) != 1 {
+		t.Fatalf("Expected a single run in L2, got %+v", levels[:3])
+	}
+	for _, key := range []string{"a", "c", "m", "z"} {
+		if got, err := tree.Get(key); err != nil || got != key+"2" {
+			t.Errorf("Expected %s=%s2, got '%s' (err=%v)", key, key, got, err)
+		}
+	}
+
+	stats := compactor.Stats()
+	if stats.Strategy != storage.StrategySizeTiered || stats.Compactions != 3 {
+		t.Errorf("Unexpected compaction stats: %+v", stats)
+	}
+	if stats.WriteAmplification <= 1 || stats.ReadAmplification != 1 || stats.SpaceAmplification != 1 {
+		t.Errorf("Unexpected amplification: %+v", stats)
+	}
+}
+
+// TestCompactorTimeWindow verifies that each closed window is merged into a
+// single L1 file and that windows past their retention are dropped whole.
+func TestCompactorTimeWindow(t *testing.T) {
+	os.Setenv("TEST_MODE", "true")
+	defer os.Unsetenv("TEST_MODE")
+
+	tree, err := storage.OpenLSMTree(t.TempDir(), storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	opts := storage.DefaultCompactionOptions()
+	opts.Strategy = storage.StrategyTimeWindow
+	opts.TimeWindow = time.Second
+	opts.WindowRetention = 2 * time.Second
+	opts.RateLimitBytesPerSec = 0
+	compactor, err := storage.NewCompactor(tree, opts)
+	if err != nil {
+		t.Fatalf("Failed to create compactor: %v", err)
+	}
+
+	flushBatches(t, tree,
+		map[string]string{"event1": "old"},
+		map[string]string{"event2": "old"},
+	)
+	time.Sleep(1100 * time.Millisecond)
+	flushBatches(t, tree, map[string]string{"event1": "new"})
+
+	// The first two flushes may straddle a window boundary.
+	runUntilIdle(t, compactor)
+	levels := tree.LevelFiles()
+	var closed uint64
+	for _, f := range levels[1] {
+		closed += f.EntryCount
+	}
+	if len(levels[0]) != 1 || closed != 2 {
+		t.Fatalf("Expected closed windows in L1 and the current one in L0, got %+v", levels[:2])
+	}
+	if got, _ := tree.Get("event1"); got != "new" {
+		t.Errorf("Expected the newer window to win, got '%s'", got)
+	}
+
+	time.Sleep(2 * time.Second)
+	runUntilIdle(t, compactor)
+	if _, err := tree.Get("event2"); err != storage.ErrKeyNotFound {
+		t.Errorf("Expected expired window to be dropped, got %v", err)
+	}
+	if stats := compactor.Stats(); stats.FilesDropped == 0 {
+		t.Errorf("Expected dropped files in stats: %+v", stats)
+	}
+}
+
+// runUntilIdle runs compactions until the strategy has nothing left to do.
+func runUntilIdle(t *testing.T, compactor *storage.Compactor) {
+	t.Helper()
+	for {
+		ran, err := compactor.RunOnce()
+		if err != nil {
+			t.Fatalf("Compaction failed: %v", err)
+		}
+		if !ran {
+			return
+		}
+	}
+}
+
+// TestCompactorUnknownStrategy verifies that a misspelt strategy is rejected.
+func TestCompactorUnknownStrategy(t *testing.T) {
+	tree, err := storage.OpenLSMTree(t.TempDir(), storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	opts := storage.DefaultCompactionOptions()
+	opts.Strategy = "universal"
+	if _, err := storage.NewCompactor(tree, opts); err == nil {
+		t.Errorf("Expected an error for an unknown strategy")
+	}
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	CompressionNone  = "none"
+	CompressionFlate = "flate"
+
+	codecIDNone  byte = 0
+	codecIDFlate byte = 1
+)
+
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// Codec compresses SSTable data blocks. Every block records the ID of the
+// codec that wrote it, so a file may mix codecs and readers need nothing
+// but the registry to decode it. IDs are part of the file format and must
+// never be reused for a different codec.
+type Codec interface {
+	ID() byte
+	Name() string
+	Encode(dst, src []byte) ([]byte, error) // Appends the compressed src to dst
+	Decode(src []byte) ([]byte, error)
+}
+
+var codecs = struct {
+	sync.RWMutex
+	byID   map[byte]Codec
+	byName map[string]Codec
+}{
+	byID:   make(map[byte]Codec),
+	byName: make(map[string]Codec),
+}
+
+func init() {
+	RegisterCodec(noneCodec{})
+	RegisterCodec(&flateCodec{level: flate.DefaultCompression})
+}
+
+// RegisterCodec makes a codec available for writing, by name, and for
+// reading, by ID. It fails if either is already taken.
+func RegisterCodec(c Codec) error {
+	codecs.Lock()
+	defer codecs.Unlock()
+
+	if _, ok := codecs.byID[c.ID()]; ok {
+		return fmt.Errorf("codec ID %d is already registered", c.ID())
+	}
+	if _, ok := codecs.byName[c.Name()]; ok {
+		return fmt.Errorf("codec %q is already registered", c.Name())
+	}
+	codecs.byID[c.ID()] = c
+	codecs.byName[c.Name()] = c
+	return nil
+}
+
+// CodecByName returns the registered codec called name; an empty name means
+// no compression.
+func CodecByName(name string) (Codec, error) {
+	if name == "" {
+		name = CompressionNone
+	}
+
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+	}
+	return c, nil
+}
+
+// compressBlock appends block, compressed with c, and a trailer byte naming
+// the codec to dst. Blocks c cannot shrink by at least an eighth are stored
+// uncompressed, as decoding them would cost more than it saves.
+func compressBlock(dst []byte, c Codec, block []byte) ([]byte, error) {
+	if c.ID() != codecIDNone {
+		start := len(dst)
+		compressed, err := c.Encode(dst, block)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed)-start < len(block)-len(block)/8 {
+			return append(compressed, c.ID()), nil
+		}
+		dst = compressed[:start]
+	}
+	dst = append(dst, block...)
+	return append(dst, codecIDNone), nil
+}
+
+// decompressBlock decodes a block written by compressBlock.
+func decompressBlock(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: block has no codec trailer", ErrInvalidSSTable)
+	}
+	id := data[len(data)-1]
+	data = data[:len(data)-1]
+	if id == codecIDNone {
+		return data, nil
+	}
+
+	codecs.RLock()
+	c, ok := codecs.byID[id]
+	codecs.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: ID %d", ErrUnknownCodec, id)
+	}
+	return c.Decode(data)
+}
+
+// noneCodec stores blocks as they are.
+type noneCodec struct{}
+
+func (noneCodec) ID() byte     { return codecIDNone }
+func (noneCodec) Name() string { return CompressionNone }
+
+func (noneCodec) Encode(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noneCodec) Decode(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+// flateCodec compresses blocks with DEFLATE. Compressors are large, so they
+// are pooled rather than allocated per block.
+type flateCodec struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (c *flateCodec) ID() byte     { return codecIDFlate }
+func (c *flateCodec) Name() string { return CompressionFlate }
+
+func (c *flateCodec) Encode(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(buf, c.level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(buf)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCodec) Decode(src []byte) ([]byte, error) {
+	r, _ := c.readers.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(bytes.NewReader(src))
+	} else if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return nil, err
+	}
+	defer c.readers.Put(r)
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSSTable, err)
+	}
+	return data, nil
+}
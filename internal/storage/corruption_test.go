@@ -0,0 +1,289 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"moniepoint/internal/storage"
+)
+
+// flipByte corrupts one byte of a file in place.
+func flipByte(t *testing.T, path string, offset int64) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	b := make([]byte, 1)
+	if offset < 0 {
+		info, err := file.Stat()
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		offset += info.Size()
+	}
+	if _, err := file.ReadAt(b, offset); err != nil {
+		t.Fatalf("Failed to read byte: %v", err)
+	}
+	b[0] ^= 0xff
+	if _, err := file.WriteAt(b, offset); err != nil {
+		t.Fatalf("Failed to write byte: %v", err)
+	}
+}
+
+// TestSSTable_ChecksumMismatch verifies that a damaged data block is
+// reported as ErrCorruption by reads and by Verify.
+func TestSSTable_ChecksumMismatch(t *testing.T) {
+	filePath := "test_sstable.db"
+	defer cleanup(filePath)
+
+	if err := storage.WriteSSTable(filePath, map[string]string{"txn1": "approved", "txn2": "failed"}, storage.DefaultSSTableOptions()); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+	flipByte(t, filePath, 2) // Inside the first data block
+
+	sstable, err := storage.NewSSTable(filePath)
+	if err != nil {
+		t.Fatalf("Expected the footer and index to be intact, got %v", err)
+	}
+	defer sstable.Close()
+
+	if _, err := sstable.Read("txn1"); !errors.Is(err, storage.ErrCorruption) {
+		t.Errorf("Expected ErrCorruption from Read, got %v", err)
+	}
+	if _, err := sstable.ReadRange("txn1", "txn2"); !errors.Is(err, storage.ErrCorruption) {
+		t.Errorf("Expected ErrCorruption from ReadRange, got %v", err)
+	}
+	if err := sstable.Verify(); !errors.Is(err, storage.ErrCorruption) {
+		t.Errorf("Expected ErrCorruption from Verify, got %v", err)
+	}
+}
+
+// TestSSTable_FooterChecksum verifies that a damaged footer is caught on open.
+func TestSSTable_FooterChecksum(t *testing.T) {
+	filePath := "test_sstable.db"
+	defer cleanup(filePath)
+
+	if err := storage.WriteSSTable(filePath, map[string]string{"txn1": "approved"}, storage.DefaultSSTableOptions()); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+	flipByte(t, filePath, -20) // Inside the footer's block handles
+
+	if _, err := storage.NewSSTable(filePath); !errors.Is(err, storage.ErrCorruption) {
+		t.Errorf("Expected ErrCorruption, got %v", err)
+	}
+}
+
+// TestLSMTreeQuarantinesOnOpen verifies that a file that can neither be
+// opened nor rebuilt is moved to the quarantine directory on open while the
+// rest of the tree is served.
+func TestLSMTreeQuarantinesOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := storage.OpenLSMTree(dir, storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	if err := tree.Flush(values(map[string]string{"a": "1"})); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if err := tree.Flush(values(map[string]string{"b": "2"})); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	newest := tree.LevelFiles()[0][1].Number
+	tree.Close()
+
+	name := fmt.Sprintf("%06d.sst", newest)
+	flipByte(t, filepath.Join(dir, name), -1) // The magic number
+	flipByte(t, filepath.Join(dir, name), 2)  // The data block
+
+	reopened, err := storage.OpenLSMTree(dir, storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer reopened.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, storage.QuarantineDirectory, name)); err != nil {
+		t.Errorf("Expected %s in quarantine: %v", name, err)
+	}
+	if n := len(reopened.LevelFiles()[0]); n != 1 {
+		t.Errorf("Expected 1 L0 file left, got %d", n)
+	}
+	if n := reopened.Stats().Quarantined; n != 1 {
+		t.Errorf("Expected 1 quarantined file, got %d", n)
+	}
+	if got, err := reopened.Get("a"); err != nil || got != "1" {
+		t.Errorf("Expected 'a'='1', got '%s' (err=%v)", got, err)
+	}
+}
+
+// TestLSMTreeQuarantinesOnRead verifies that a read hitting a damaged block
+// fails with ErrCorruption and takes the file out of service.
+func TestLSMTreeQuarantinesOnRead(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := storage.OpenLSMTree(dir, storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	if err := tree.Flush(values(map[string]string{"a": "1", "b": "2"})); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	name := fmt.Sprintf("%06d.sst", tree.LevelFiles()[0][0].Number)
+	flipByte(t, filepath.Join(dir, name), 2)
+
+	if _, err := tree.Get("a"); !errors.Is(err, storage.ErrCorruption) {
+		t.Fatalf("Expected ErrCorruption, got %v", err)
+	}
+	tree.Close() // Waits for the quarantine
+
+	if _, err := os.Stat(filepath.Join(dir, storage.QuarantineDirectory, name)); err != nil {
+		t.Errorf("Expected %s in quarantine: %v", name, err)
+	}
+	if files := tree.LevelFiles()[0]; len(files) != 0 {
+		t.Errorf("Expected the corrupt file to leave the manifest, got %+v", files)
+	}
+}
+
+// TestRepairSSTable verifies that a file whose metadata is damaged is
+// rebuilt from its data blocks and replaced atomically.
+func TestRepairSSTable(t *testing.T) {
+	filePath := "test_sstable.db"
+	defer cleanup(filePath)
+
+	data := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		data[fmt.Sprintf("key_%06d", i)] = fmt.Sprintf("value_%d", i)
+	}
+	if err := storage.WriteSSTable(filePath, data, storage.DefaultSSTableOptions()); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+	flipByte(t, filePath, -77) // The checksum of the meta block, just before the footer
+
+	if _, err := storage.NewSSTable(filePath); !errors.Is(err, storage.ErrCorruption) {
+		t.Fatalf("Expected ErrCorruption, got %v", err)
+	}
+	if err := storage.RepairSSTable(filePath, storage.DefaultSSTableOptions()); err != nil {
+		t.Fatalf("RepairSSTable failed: %v", err)
+	}
+
+	sstable, err := storage.NewSSTable(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open repaired SSTable: %v", err)
+	}
+	defer sstable.Close()
+	if meta := sstable.Meta(); meta.EntryCount != 2000 || meta.MinKey != "key_000000" || meta.MaxKey != "key_001999" {
+		t.Errorf("Unexpected metadata after repair: %+v", meta)
+	}
+	results, err := sstable.ReadRange("key_000000", "key_999999")
+	if err != nil || len(results) != len(data) {
+		t.Fatalf("Expected %d records after repair, got %d (err=%v)", len(data), len(results), err)
+	}
+	if _, err := os.Stat(filePath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected no temporary file after repair, got %v", err)
+	}
+}
+
+// TestRepairSSTableKeepsRangeTombstones verifies that a table's range
+// tombstones count in its key bounds and survive a repair.
+func TestRepairSSTableKeepsRangeTombstones(t *testing.T) {
+	filePath := "test_sstable.db"
+	defer cleanup(filePath)
+
+	writer, err := storage.NewSSTableWriter(filePath, storage.DefaultSSTableOptions())
+	if err != nil {
+		t.Fatalf("Failed to create SSTable writer: %v", err)
+	}
+	for _, key := range []string{"b", "c"} {
+		if err := writer.AddEntry(key, storage.Entry{Value: "1"}); err != nil {
+			t.Fatalf("AddEntry failed: %v", err)
+		}
+	}
+	ranges := []storage.RangeTombstone{{Start: "a", End: "b"}, {Start: "x", End: "z"}}
+	for _, r := range ranges {
+		if err := writer.AddRangeTombstone(r); err != nil {
+			t.Fatalf("AddRangeTombstone failed: %v", err)
+		}
+	}
+	if err := writer.AddRangeTombstone(storage.RangeTombstone{Start: "y", End: "y"}); !errors.Is(err, storage.ErrInvalidRange) {
+		t.Errorf("Expected ErrInvalidRange for an empty range, got %v", err)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	flipByte(t, filePath, -77) // The checksum of the meta block
+
+	if err := storage.RepairSSTable(filePath, storage.DefaultSSTableOptions()); err != nil {
+		t.Fatalf("RepairSSTable failed: %v", err)
+	}
+	sstable, err := storage.NewSSTable(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open repaired SSTable: %v", err)
+	}
+	defer sstable.Close()
+	if meta := sstable.Meta(); meta.EntryCount != 2 || meta.RangeTombstoneCount != 2 || meta.MinKey != "a" || meta.MaxKey != "z" {
+		t.Errorf("Unexpected metadata after repair: %+v", meta)
+	}
+	if got := sstable.RangeTombstones(); !reflect.DeepEqual(got, ranges) {
+		t.Errorf("Expected range tombstones %v after repair, got %v", ranges, got)
+	}
+}
+
+// TestRepairSSTableRefusesDamagedData verifies that a damaged data block is
+// never dropped to make a repair succeed.
+func TestRepairSSTableRefusesDamagedData(t *testing.T) {
+	filePath := "test_sstable.db"
+	defer cleanup(filePath)
+
+	if err := storage.WriteSSTable(filePath, map[string]string{"txn1": "approved"}, storage.DefaultSSTableOptions()); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+	flipByte(t, filePath, 6)
+	before, _ := os.ReadFile(filePath)
+
+	if err := storage.RepairSSTable(filePath, storage.DefaultSSTableOptions()); !errors.Is(err, storage.ErrCorruption) {
+		t.Errorf("Expected ErrCorruption, got %v", err)
+	}
+	if after, _ := os.ReadFile(filePath); string(after) != string(before) {
+		t.Errorf("Expected the damaged file to be left untouched")
+	}
+}
+
+// TestLSMTreeRebuildsIndexOnOpen verifies that a file with a damaged footer
+// is rebuilt on open instead of being quarantined.
+func TestLSMTreeRebuildsIndexOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := storage.OpenLSMTree(dir, storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	if err := tree.Flush(values(map[string]string{"a": "1", "b": "2"})); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	number := tree.LevelFiles()[0][0].Number
+	tree.Close()
+
+	flipByte(t, filepath.Join(dir, fmt.Sprintf("%06d.sst", number)), -1)
+
+	reopened, err := storage.OpenLSMTree(dir, storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer reopened.Close()
+
+	if n := reopened.Stats().Quarantined; n != 0 {
+		t.Errorf("Expected nothing quarantined, got %d", n)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if got, err := reopened.Get(key); err != nil || got != want {
+			t.Errorf("Expected %s=%s, got '%s' (err=%v)", key, want, got, err)
+		}
+	}
+	if files := reopened.LevelFiles()[0]; len(files) != 1 || files[0].Number != number || files[0].EntryCount != 2 {
+		t.Errorf("Expected the rebuilt file in the manifest, got %+v", files)
+	}
+}
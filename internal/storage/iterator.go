@@ -0,0 +1,425 @@
+package storage
+
+import "sort"
+
+// Iterator walks records in key order, in either direction.
+//   - A new iterator is unpositioned: call Seek, SeekToFirst or SeekToLast.
+//   - Key, Value and Entry may only be called while Valid.
+//   - Iterators over a single source (a skiplist or an SSTable) yield every
+//     record, tombstones included, and leave out range tombstones; a
+//     MergingIterator yields only the newest visible version of each key.
+//   - Once Valid is false, Err reports whether the walk ended or failed.
+//   - Close releases what the iterator holds, such as SSTable references.
+type Iterator interface {
+	Seek(key string) // First key >= key
+	SeekToFirst()
+	SeekToLast()
+	Valid() bool
+	Next()
+	Prev()
+	Key() string
+	Value() string
+	Entry() Entry
+	Err() error
+	Close() error
+}
+
+// MergingIterator combines iterators over sources of different ages, newest
+// first, into one ordered view. For a key held by several sources it yields
+// the record of the newest, and skips the key if that record is a tombstone
+// or a newer source has a range tombstone over it. The keys under a range
+// tombstone are stepped over with one seek per source, not one by one.
+//
+// In forward mode every child is positioned at or after the current key; in
+// backward mode at or before it. Changing direction repositions all children.
+type MergingIterator struct {
+	children []Iterator // Newest first
+	current  int        // Child holding the current key, -1 if none
+	forward  bool
+	err      error
+}
+
+// NewMergingIterator merges children, listed newest first, and takes
+// ownership of them: Close closes them all.
+func NewMergingIterator(children ...Iterator) *MergingIterator {
+	return &MergingIterator{children: children, current: -1, forward: true}
+}
+
+// Seek positions the iterator at the first visible key >= key.
+func (m *MergingIterator) Seek(key string) {
+	for _, c := range m.children {
+		c.Seek(key)
+	}
+	m.forward = true
+	m.findSmallest()
+	m.skipForward()
+}
+
+// SeekToFirst positions the iterator at the smallest visible key.
+func (m *MergingIterator) SeekToFirst() {
+	for _, c := range m.children {
+		c.SeekToFirst()
+	}
+	m.forward = true
+	m.findSmallest()
+	m.skipForward()
+}
+
+// SeekToLast positions the iterator at the largest visible key.
+func (m *MergingIterator) SeekToLast() {
+	for _, c := range m.children {
+		c.SeekToLast()
+	}
+	m.forward = false
+	m.findLargest()
+	m.skipBackward()
+}
+
+// Valid reports whether the iterator is positioned at a record.
+func (m *MergingIterator) Valid() bool {
+	return m.current >= 0 && m.err == nil
+}
+
+// Next advances to the next visible key.
+func (m *MergingIterator) Next() {
+	m.step()
+	m.findSmallest()
+	m.skipForward()
+}
+
+// Prev moves back to the previous visible key.
+func (m *MergingIterator) Prev() {
+	m.stepBack()
+	m.findLargest()
+	m.skipBackward()
+}
+
+// step moves every child past the current key.
+func (m *MergingIterator) step() {
+	key := m.Key()
+	for _, c := range m.children {
+		if !m.forward {
+			c.Seek(key)
+		}
+		if c.Valid() && c.Key() == key {
+			c.Next()
+		}
+	}
+	m.forward = true
+}
+
+// stepBack moves every child before the current key.
+func (m *MergingIterator) stepBack() {
+	key := m.Key()
+	for _, c := range m.children {
+		if m.forward {
+			if c.Seek(key); c.Valid() {
+				c.Prev()
+			} else if c.Err() == nil {
+				c.SeekToLast()
+			}
+			continue
+		}
+		if c.Valid() && c.Key() == key {
+			c.Prev()
+		}
+	}
+	m.forward = false
+}
+
+// skipForward steps over keys whose newest record is a tombstone, and over
+// whole ranges deleted by a newer source.
+func (m *MergingIterator) skipForward() {
+	for m.Valid() {
+		if m.Entry().Tombstone {
+			m.step()
+		} else if t, owner, ok := m.deletedBy(); ok {
+			m.skipPast(t, owner)
+		} else {
+			return
+		}
+		m.findSmallest()
+	}
+}
+
+// skipBackward is skipForward in reverse.
+func (m *MergingIterator) skipBackward() {
+	for m.Valid() {
+		if m.Entry().Tombstone {
+			m.stepBack()
+		} else if t, owner, ok := m.deletedBy(); ok {
+			m.skipBefore(t, owner)
+		} else {
+			return
+		}
+		m.findLargest()
+	}
+}
+
+// deletedBy returns the range tombstone, and the child holding it, of a
+// source newer than the current record's that covers the current key.
+func (m *MergingIterator) deletedBy() (RangeTombstone, int, bool) {
+	key := m.Key()
+	for i, c := range m.children[:m.current] {
+		if d, ok := c.(rangeDeleter); ok {
+			if t, ok := d.coveringTombstone(key); ok {
+				return t, i, true
+			}
+		}
+	}
+	return RangeTombstone{}, -1, false
+}
+
+// skipPast moves the children older than owner to the end of t, and the
+// others past the current key.
+func (m *MergingIterator) skipPast(t RangeTombstone, owner int) {
+	key := m.Key()
+	for i, c := range m.children {
+		if !c.Valid() {
+			continue
+		}
+		if i > owner && c.Key() < t.End {
+			c.Seek(t.End)
+		} else if c.Key() == key {
+			c.Next()
+		}
+	}
+}
+
+// skipBefore is skipPast in reverse, moving the children older than owner
+// before the start of t.
+func (m *MergingIterator) skipBefore(t RangeTombstone, owner int) {
+	key := m.Key()
+	for i, c := range m.children {
+		if !c.Valid() {
+			continue
+		}
+		if i > owner && c.Key() >= t.Start {
+			if c.Seek(t.Start); c.Valid() {
+				c.Prev()
+			}
+		} else if c.Key() == key {
+			c.Prev()
+		}
+	}
+}
+
+// findSmallest points current at the newest child holding the smallest key.
+func (m *MergingIterator) findSmallest() {
+	m.current = -1
+	for i, c := range m.children {
+		if m.checkErr(c) || !c.Valid() {
+			continue
+		}
+		if m.current < 0 || c.Key() < m.children[m.current].Key() {
+			m.current = i
+		}
+	}
+}
+
+// findLargest points current at the newest child holding the largest key.
+func (m *MergingIterator) findLargest() {
+	m.current = -1
+	for i, c := range m.children {
+		if m.checkErr(c) || !c.Valid() {
+			continue
+		}
+		if m.current < 0 || c.Key() > m.children[m.current].Key() {
+			m.current = i
+		}
+	}
+}
+
+// checkErr records the first error of any child; the iterator is invalid
+// from then on.
+func (m *MergingIterator) checkErr(c Iterator) bool {
+	if err := c.Err(); err != nil {
+		if m.err == nil {
+			m.err = err
+		}
+		return true
+	}
+	return false
+}
+
+// Key returns the current key.
+func (m *MergingIterator) Key() string {
+	return m.children[m.current].Key()
+}
+
+// Value returns the current value.
+func (m *MergingIterator) Value() string {
+	return m.children[m.current].Value()
+}
+
+// Entry returns the current record, which is never a tombstone.
+func (m *MergingIterator) Entry() Entry {
+	return m.children[m.current].Entry()
+}
+
+// Err returns the first error met by any child.
+func (m *MergingIterator) Err() error {
+	return m.err
+}
+
+// Close closes every child.
+func (m *MergingIterator) Close() error {
+	var firstErr error
+	for _, c := range m.children {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	m.current = -1
+	return firstErr
+}
+
+// readRange returns the live keys of it in [startKey, endKey] and closes it.
+func readRange(it *MergingIterator, startKey, endKey string) (map[string]string, error) {
+	defer it.Close()
+
+	results := make(map[string]string)
+	for it.Seek(startKey); it.Valid() && it.Key() <= endKey; it.Next() {
+		results[it.Key()] = it.Value()
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// levelIterator walks a level whose files do not overlap as one sorted run,
+// opening one file's iterator at a time, so a seek touches a single file.
+type levelIterator struct {
+	tables []*SSTable               // By key; the iterator holds a reference to each
+	report func(pos int, err error) // Told of the first error, with the position of the file; may be nil
+	pos    int                      // Position in tables of cur
+	cur    Iterator                 // nil if unpositioned
+	err    error
+}
+
+// newLevelIterator takes over one reference to each of tables, which must
+// be sorted by key and not overlap.
+func newLevelIterator(tables []*SSTable, report func(pos int, err error)) *levelIterator {
+	return &levelIterator{tables: tables, report: report}
+}
+
+// fail records the first error, met in the current file.
+func (it *levelIterator) fail(err error) {
+	if it.err != nil {
+		return
+	}
+	it.err = err
+	if it.report != nil {
+		it.report(it.pos, err)
+	}
+}
+
+// open replaces the current file iterator with one over tables[pos]; it
+// returns false when pos is out of range.
+func (it *levelIterator) open(pos int) bool {
+	if it.cur != nil {
+		if err := it.cur.Err(); err != nil {
+			it.fail(err)
+		}
+		it.cur.Close()
+		it.cur = nil
+	}
+	it.pos = pos
+	if pos < 0 || pos >= len(it.tables) {
+		return false
+	}
+	it.cur = it.tables[pos].NewIterator()
+	return true
+}
+
+func (it *levelIterator) Seek(key string) {
+	pos := sort.Search(len(it.tables), func(i int) bool { return it.tables[i].meta.MaxKey >= key })
+	if it.open(pos) {
+		it.cur.Seek(key)
+		it.skipEmptyForward()
+	}
+}
+
+func (it *levelIterator) SeekToFirst() {
+	if it.open(0) {
+		it.cur.SeekToFirst()
+		it.skipEmptyForward()
+	}
+}
+
+func (it *levelIterator) SeekToLast() {
+	if it.open(len(it.tables) - 1) {
+		it.cur.SeekToLast()
+		it.skipEmptyBackward()
+	}
+}
+
+func (it *levelIterator) Valid() bool {
+	return it.cur != nil && it.cur.Valid()
+}
+
+func (it *levelIterator) Next() {
+	it.cur.Next()
+	it.skipEmptyForward()
+}
+
+func (it *levelIterator) Prev() {
+	it.cur.Prev()
+	it.skipEmptyBackward()
+}
+
+// skipEmptyForward moves on to the following files while the current one
+// is exhausted.
+func (it *levelIterator) skipEmptyForward() {
+	for it.cur != nil && !it.cur.Valid() && it.cur.Err() == nil {
+		if !it.open(it.pos + 1) {
+			return
+		}
+		it.cur.SeekToFirst()
+	}
+}
+
+// skipEmptyBackward moves back to the preceding files while the current one
+// is exhausted.
+func (it *levelIterator) skipEmptyBackward() {
+	for it.cur != nil && !it.cur.Valid() && it.cur.Err() == nil {
+		if !it.open(it.pos - 1) {
+			return
+		}
+		it.cur.SeekToLast()
+	}
+}
+
+// coveringTombstone returns the range tombstone over key of the one file
+// whose bounds may hold it.
+func (it *levelIterator) coveringTombstone(key string) (RangeTombstone, bool) {
+	pos := sort.Search(len(it.tables), func(i int) bool { return it.tables[i].meta.MaxKey >= key })
+	if pos == len(it.tables) || it.tables[pos].meta.MinKey > key {
+		return RangeTombstone{}, false
+	}
+	return it.tables[pos].ranges.covering(key)
+}
+
+func (it *levelIterator) Key() string   { return it.cur.Key() }
+func (it *levelIterator) Value() string { return it.cur.Value() }
+func (it *levelIterator) Entry() Entry  { return it.cur.Entry() }
+
+func (it *levelIterator) Err() error {
+	if it.err == nil && it.cur != nil {
+		if err := it.cur.Err(); err != nil {
+			it.fail(err)
+		}
+	}
+	return it.err
+}
+
+// Close closes the current file iterator and releases every file.
+func (it *levelIterator) Close() error {
+	it.open(-1)
+	for _, table := range it.tables {
+		table.release()
+	}
+	it.tables = nil
+	return nil
+}
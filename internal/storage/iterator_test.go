@@ -0,0 +1,178 @@
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"moniepoint/internal/storage"
+)
+
+// TestSSTableIterator verifies that a table is walked in both directions
+// across block boundaries, tombstones included.
+func TestSSTableIterator(t *testing.T) {
+	filePath := "test_sstable.db"
+	defer cleanup(filePath)
+
+	writer, err := storage.NewSSTableWriter(filePath, storage.DefaultSSTableOptions())
+	if err != nil {
+		t.Fatalf("Failed to create SSTable writer: %v", err)
+	}
+	numEntries := 5000
+	for i := 0; i < numEntries; i++ {
+		if err := writer.AddEntry(fmt.Sprintf("key_%06d", i*2), storage.Entry{Value: fmt.Sprint(i), Tombstone: i == 7}); err != nil {
+			t.Fatalf("AddEntry failed: %v", err)
+		}
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	sstable, err := storage.NewSSTable(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer sstable.Close()
+
+	it := sstable.NewIterator()
+	defer it.Close()
+
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if want := fmt.Sprintf("key_%06d", n*2); it.Key() != want {
+			t.Fatalf("Expected %s at position %d, got %s", want, n, it.Key())
+		}
+		if it.Entry().Tombstone != (n == 7) {
+			t.Errorf("Unexpected tombstone flag at %s: %+v", it.Key(), it.Entry())
+		}
+		n++
+	}
+	if n != numEntries {
+		t.Errorf("Expected %d records forwards, got %d", numEntries, n)
+	}
+
+	n = 0
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		if want := fmt.Sprintf("key_%06d", (numEntries-1-n)*2); it.Key() != want {
+			t.Fatalf("Expected %s at position %d from the end, got %s", want, n, it.Key())
+		}
+		n++
+	}
+	if n != numEntries {
+		t.Errorf("Expected %d records backwards, got %d", numEntries, n)
+	}
+
+	it.Seek("key_003001") // Between two keys
+	if !it.Valid() || it.Key() != "key_003002" {
+		t.Errorf("Expected seek to land on key_003002, got valid=%v", it.Valid())
+	}
+	if it.Prev(); !it.Valid() || it.Key() != "key_003000" {
+		t.Errorf("Expected Prev to reach key_003000")
+	}
+	if err := it.Err(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+// TestMergingIterator verifies that the merged view yields only the newest
+// version of each key across the memtable and several SSTables, hides
+// deleted keys, and can change direction at any point.
+func TestMergingIterator(t *testing.T) {
+	tree, err := storage.OpenLSMTree(t.TempDir(), storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	flushBatches(t, tree, map[string]string{"a": "1", "b": "1", "c": "1", "d": "1", "f": "1"})
+	if err := tree.Flush(map[string]storage.Entry{"b": {Value: "2"}, "c": {Tombstone: true}}); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	memtable := storage.NewMemtable(storage.DefaultMemtableOptions(), nil)
+	memtable.Set("d", "3")
+	memtable.Set("e", "3")
+	memtable.Delete("a")
+	memtable.Delete("f")
+
+	it := storage.NewMergingIterator(append(memtable.Iterators(), tree.Iterators()...)...)
+	defer it.Close()
+
+	var forward, backward []string
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		forward = append(forward, it.Key()+"="+it.Value())
+	}
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		backward = append(backward, it.Key()+"="+it.Value())
+	}
+	if want := []string{"b=2", "d=3", "e=3"}; !reflect.DeepEqual(forward, want) {
+		t.Errorf("Expected %v forwards, got %v", want, forward)
+	}
+	if want := []string{"e=3", "d=3", "b=2"}; !reflect.DeepEqual(backward, want) {
+		t.Errorf("Expected %v backwards, got %v", want, backward)
+	}
+
+	var steps []string
+	it.Seek("c")
+	for _, step := range []func(){it.Prev, it.Next, it.Next, it.Prev, it.Prev, it.Prev} {
+		if !it.Valid() {
+			break
+		}
+		steps = append(steps, it.Key())
+		step()
+	}
+	if want := []string{"d", "b", "d", "e", "d", "b"}; !reflect.DeepEqual(steps, want) || it.Valid() {
+		t.Errorf("Expected the walk %v then exhaustion, got %v (valid=%v)", want, steps, it.Valid())
+	}
+	if err := it.Err(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+// TestIteratorOutlivesCompaction verifies that an open iterator keeps the
+// files it reads from after a compaction replaces them, and that they are
+// deleted once it is closed.
+func TestIteratorOutlivesCompaction(t *testing.T) {
+	os.Setenv("TEST_MODE", "true")
+	defer os.Unsetenv("TEST_MODE")
+
+	dir := t.TempDir()
+	tree, err := storage.OpenLSMTree(dir, storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	opts := storage.DefaultCompactionOptions()
+	opts.L0Trigger = 2
+	opts.RateLimitBytesPerSec = 0
+	compactor, err := storage.NewCompactor(tree, opts)
+	if err != nil {
+		t.Fatalf("Failed to create compactor: %v", err)
+	}
+	flushBatches(t, tree, map[string]string{"a": "1", "b": "1"}, map[string]string{"b": "2", "c": "2"})
+
+	it := storage.NewMergingIterator(tree.Iterators()...)
+	it.Seek("a")
+	if ran, err := compactor.RunOnce(); err != nil || !ran {
+		t.Fatalf("Expected a compaction (ran=%v, err=%v)", ran, err)
+	}
+
+	var got []string
+	for ; it.Valid(); it.Next() {
+		got = append(got, it.Key()+"="+it.Value())
+	}
+	if want := []string{"a=1", "b=2", "c=2"}; !reflect.DeepEqual(got, want) || it.Err() != nil {
+		t.Errorf("Expected %v from the replaced files, got %v (err=%v)", want, got, it.Err())
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.sst")); len(files) != 3 {
+		t.Errorf("Expected the replaced files to stay while the iterator is open, found %v", files)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.sst")); len(files) != 1 {
+		t.Errorf("Expected the replaced files to be deleted on close, found %v", files)
+	}
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	DefaultMaxKeyBytes     = 4 << 10
+	DefaultMaxValueBytes   = 1 << 20
+	DefaultMaxBatchEntries = 1000
+	DefaultMaxBatchBytes   = 4 << 20
+)
+
+var (
+	ErrEmptyKey      = errors.New("empty key")
+	ErrKeyTooLarge   = errors.New("key too large")
+	ErrValueTooLarge = errors.New("value too large")
+	ErrBatchTooLarge = errors.New("batch too large")
+)
+
+// Limits caps what a Writer accepts, so that one request cannot take an
+// outsized share of the WAL, the Memtable or the memory budget. A zero
+// field means no limit beyond what the WAL format can hold (4GB per key or
+// value).
+type Limits struct {
+	MaxKeyBytes     int `json:"max_key_bytes"`
+	MaxValueBytes   int `json:"max_value_bytes"`
+	MaxBatchEntries int `json:"max_batch_entries"`
+	MaxBatchBytes   int `json:"max_batch_bytes"` // Keys and values of all entries
+}
+
+// DefaultLimits returns 4KB keys, 1MB values and batches of up to 1000
+// entries and 4MB.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxKeyBytes:     DefaultMaxKeyBytes,
+		MaxValueBytes:   DefaultMaxValueBytes,
+		MaxBatchEntries: DefaultMaxBatchEntries,
+		MaxBatchBytes:   DefaultMaxBatchBytes,
+	}
+}
+
+// check returns an error wrapping ErrEmptyKey, ErrKeyTooLarge,
+// ErrValueTooLarge or ErrBatchTooLarge if records break the limits, or
+// ErrInvalidRange for a range delete that ends before it starts; for a
+// batch, the error names the offending entry. Both bounds of a range delete
+// are held to the key limit.
+func (l Limits) check(records []WALRecord) error {
+	if l.MaxBatchEntries > 0 && len(records) > l.MaxBatchEntries {
+		return fmt.Errorf("%w: %d entries, limit %d", ErrBatchTooLarge, len(records), l.MaxBatchEntries)
+	}
+
+	total := 0
+	for i, rec := range records {
+		if err := l.checkRecord(rec); err != nil {
+			if len(records) > 1 {
+				return fmt.Errorf("entry %d: %w", i, err)
+			}
+			return err
+		}
+		total += len(rec.Key) + len(rec.Entry.Value) + len(rec.End)
+	}
+	if l.MaxBatchBytes > 0 && len(records) > 1 && total > l.MaxBatchBytes {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrBatchTooLarge, total, l.MaxBatchBytes)
+	}
+	return nil
+}
+
+func (l Limits) checkRecord(rec WALRecord) error {
+	if rec.Key == "" {
+		return ErrEmptyKey
+	}
+	for _, key := range []string{rec.Key, rec.End} {
+		if n, limit := uint64(len(key)), maxBytes(l.MaxKeyBytes); n > limit {
+			return fmt.Errorf("%w: %d bytes, limit %d", ErrKeyTooLarge, n, limit)
+		}
+	}
+	if rec.End != "" && rec.End <= rec.Key {
+		return fmt.Errorf("%w: end %q is not after start %q", ErrInvalidRange, rec.End, rec.Key)
+	}
+	if n, limit := uint64(len(rec.Entry.Value)), maxBytes(l.MaxValueBytes); n > limit {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrValueTooLarge, n, limit)
+	}
+	return nil
+}
+
+// maxBytes returns the size a limit allows; the WAL stores sizes in 32 bits.
+func maxBytes(limit int) uint64 {
+	if limit > 0 && uint64(limit) < math.MaxUint32 {
+		return uint64(limit)
+	}
+	return math.MaxUint32
+}
@@ -0,0 +1,924 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sstableFileExt = ".sst"
+
+	QuarantineDirectory = "quarantine" // Corrupt files are moved here, inside the tree's directory
+)
+
+// LSMOptions configures an LSMTree.
+type LSMOptions struct {
+	NumLevels  int
+	SSTable    SSTableOptions
+	Budget     *MemoryBudget // Optional; charged for the indexes and filters of open tables
+	BlockCache *BlockCache   // Optional; caches blocks of every open table
+}
+
+// DefaultLSMOptions returns the options used when none are configured.
+func DefaultLSMOptions() LSMOptions {
+	return LSMOptions{
+		NumLevels: DefaultNumLevels,
+		SSTable:   DefaultSSTableOptions(),
+	}
+}
+
+// LSMTree is the on-disk part of the store: a set of immutable SSTables
+// organised in levels and tracked by a Manifest.
+//   - Memtable flushes become new L0 files; L0 files may overlap.
+//   - L1..Ln are shaped by the CompactionStrategy: leveled compaction keeps
+//     them non-overlapping, tiered strategies stack overlapping runs.
+//   - Reads search L0 newest-first, then each deeper level, and stop at the
+//     first file that has a record of the key; a tombstone ends the search
+//     with ErrKeyNotFound.
+//   - A file found to be corrupt fails the read with ErrCorruption and is
+//     moved to the quarantine directory, so it is never half-served.
+type LSMTree struct {
+	dir      string
+	opts     LSMOptions
+	mu       sync.RWMutex
+	manifest *Manifest
+	views    []levelView         // Read index over manifest.Levels
+	tables   map[uint64]*SSTable // Open handles for every live file
+	version  uint64              // Incremented on every change to the file set
+
+	bytesFlushed atomic.Uint64
+	lookups      atomic.Uint64
+	tablesRead   atomic.Uint64
+	quarantined  atomic.Uint64
+	wg           sync.WaitGroup // Pending quarantines
+}
+
+// levelView indexes the files of one level for reads. Files are listed
+// newest first; when none of them overlap they are also kept sorted by key
+// so a lookup needs a single binary search.
+type levelView struct {
+	files  []FileMeta // Newest first
+	sorted []FileMeta // By MinKey; nil if any files overlap
+}
+
+// newLevelView builds the read index for files.
+func newLevelView(files []FileMeta) levelView {
+	v := levelView{files: make([]FileMeta, len(files))}
+	for i, f := range files {
+		v.files[len(files)-1-i] = f
+	}
+
+	sorted := append([]FileMeta(nil), files...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].MinKey < sorted[j].MinKey })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].MinKey <= sorted[i-1].MaxKey {
+			return v
+		}
+	}
+	v.sorted = sorted
+	return v
+}
+
+// OpenLSMTree opens (or creates) the tree stored in dir. Files not referenced
+// by the manifest, e.g. left behind by a crash during a flush, are removed.
+func OpenLSMTree(dir string, opts LSMOptions) (*LSMTree, error) {
+	if opts.NumLevels < 2 {
+		opts.NumLevels = DefaultNumLevels
+	}
+	if _, err := CodecByName(opts.SSTable.Compression); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	manifest, err := LoadManifest(dir, opts.NumLevels)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &LSMTree{
+		dir:      dir,
+		opts:     opts,
+		manifest: manifest,
+		tables:   make(map[uint64]*SSTable),
+	}
+
+	live := manifest.LiveFiles()
+	recovered := ManifestEdit{}
+	for number, level := range live {
+		table, err := openSSTable(t.tablePath(number), t.opts.BlockCache)
+		if errors.Is(err, ErrCorruption) {
+			table, err = t.repair(number, level, err, &recovered)
+		}
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		if table != nil {
+			t.tables[number] = table
+		}
+	}
+	if len(recovered.Removed) > 0 {
+		if err := manifest.Apply(recovered); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	t.refreshViews()
+
+	t.removeOrphans(live)
+	return t, nil
+}
+
+// tablePath returns the path of the SSTable with the given file number.
+func (t *LSMTree) tablePath(number uint64) string {
+	return filepath.Join(t.dir, fmt.Sprintf("%06d%s", number, sstableFileExt))
+}
+
+// refreshViews rebuilds the read index after the manifest changed, and
+// recharges the memory budget for the indexes of the open tables. Callers
+// must hold t.mu for writing.
+func (t *LSMTree) refreshViews() {
+	t.views = make([]levelView, len(t.manifest.Levels))
+	for level, files := range t.manifest.Levels {
+		t.views[level] = newLevelView(files)
+	}
+	t.chargeIndexes()
+}
+
+// chargeIndexes records the index memory of the open tables in the budget.
+func (t *LSMTree) chargeIndexes() {
+	if t.opts.Budget == nil {
+		return
+	}
+	var size int64
+	for _, table := range t.tables {
+		size += table.IndexBytes()
+	}
+	t.opts.Budget.indexes.Store(size)
+}
+
+// repair handles a file that failed to open with cause. Its index and other
+// metadata are rebuilt from the data blocks if those are intact; otherwise
+// the file is quarantined and a nil table returned. Either way the manifest
+// changes are added to edit.
+func (t *LSMTree) repair(number uint64, level int, cause error, edit *ManifestEdit) (*SSTable, error) {
+	var old FileMeta
+	for _, f := range t.manifest.Levels[level] {
+		if f.Number == number {
+			old = f
+		}
+	}
+	edit.Removed = append(edit.Removed, LevelFile{Level: level, File: old})
+
+	path := t.tablePath(number)
+	if err := RepairSSTable(path, t.opts.SSTable); err != nil {
+		log.Printf("[ERROR] Failed to rebuild SSTable %s (%v): %v", path, cause, err)
+		t.moveToQuarantine(number, err)
+		return nil, nil
+	}
+	table, err := openSSTable(path, t.opts.BlockCache)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[WARN] Rebuilt the index of SSTable %s from its data blocks: %v", path, cause)
+
+	meta := fileMetaFor(number, table)
+	meta.CreatedAt = old.CreatedAt
+	edit.Added = append(edit.Added, LevelFile{Level: level, File: meta})
+	return table, nil
+}
+
+// checkCorruption takes the file out of service if err shows it is corrupt.
+// Readers hold t.mu, so the quarantine waits for them on its own goroutine.
+func (t *LSMTree) checkCorruption(number uint64, err error) {
+	if !errors.Is(err, ErrCorruption) {
+		return
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.quarantine(number, err)
+	}()
+}
+
+// quarantine removes a corrupt file from the manifest and moves it to the
+// quarantine directory. Reads stop seeing it, and with it any records that
+// could still be read from it, rather than serving what is left.
+func (t *LSMTree) quarantine(number uint64, cause error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	table, ok := t.tables[number]
+	if !ok {
+		return // Already quarantined or compacted away
+	}
+	edit := ManifestEdit{}
+	for level, files := range t.manifest.Levels {
+		for _, f := range files {
+			if f.Number == number {
+				edit.Removed = append(edit.Removed, LevelFile{Level: level, File: f})
+			}
+		}
+	}
+	if err := t.manifest.Apply(edit); err != nil {
+		log.Printf("[ERROR] Failed to quarantine SSTable %s: %v", table.Path(), err)
+		return
+	}
+	delete(t.tables, number)
+	t.refreshViews()
+	t.version++
+
+	t.moveToQuarantine(number, cause)
+	table.release()
+}
+
+// moveToQuarantine moves the file out of the tree's directory, keeping it
+// for inspection.
+func (t *LSMTree) moveToQuarantine(number uint64, cause error) {
+	path := t.tablePath(number)
+	dir := filepath.Join(t.dir, QuarantineDirectory)
+	log.Printf("[ERROR] Quarantining corrupt SSTable %s: %v", path, cause)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("[ERROR] Failed to create quarantine directory: %v", err)
+		return
+	}
+	if err := os.Rename(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+		log.Printf("[ERROR] Failed to move %s to quarantine: %v", path, err)
+		return
+	}
+	t.quarantined.Add(1)
+}
+
+// removeOrphans deletes SSTable files that the manifest does not reference,
+// and files whose writing was interrupted.
+func (t *LSMTree) removeOrphans(live map[uint64]int) {
+	files, err := filepath.Glob(filepath.Join(t.dir, "*"+sstableFileExt))
+	if err != nil {
+		log.Printf("[ERROR] Failed to list SSTable files: %v", err)
+		return
+	}
+	partial, _ := filepath.Glob(filepath.Join(t.dir, "*"+sstableFileExt+sstableTempExt))
+	for _, path := range partial {
+		log.Printf("[INFO] Removing partial SSTable %s", path)
+		os.Remove(path)
+	}
+
+	for _, path := range files {
+		number, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), sstableFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, ok := live[number]; !ok {
+			log.Printf("[INFO] Removing orphaned SSTable %s", path)
+			os.Remove(path)
+		}
+	}
+}
+
+// Flush writes data, values and tombstones, as a new L0 file and records it
+// in the manifest.
+func (t *LSMTree) Flush(data map[string]Entry) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return t.flush(func(path string) error {
+		return writeSSTableEntries(path, data, t.opts.SSTable)
+	})
+}
+
+// FlushMemtable streams a Memtable's records, already in key order, and its
+// range tombstones into a new L0 file and records it in the manifest.
+func (t *LSMTree) FlushMemtable(it *MemtableIterator) error {
+	if it.SeekToFirst(); !it.Valid() && len(it.list.rangeTombstones()) == 0 {
+		return nil
+	}
+	return t.flush(func(path string) error {
+		return writeSSTableIterator(path, it, t.opts.SSTable)
+	})
+}
+
+// flush builds a new L0 file with write and installs it.
+func (t *LSMTree) flush(write func(path string) error) error {
+	number := t.newFileNumber()
+	path := t.tablePath(number)
+	if err := write(path); err != nil {
+		return err
+	}
+	table, err := openSSTable(path, t.opts.BlockCache)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	meta := fileMetaFor(number, table)
+	meta.CreatedAt = time.Now().Unix()
+	edit := ManifestEdit{Added: []LevelFile{{Level: 0, File: meta}}}
+	if err := t.manifest.Apply(edit); err != nil {
+		table.Close()
+		os.Remove(path)
+		return err
+	}
+	t.tables[number] = table
+	t.refreshViews()
+	t.version++
+	t.bytesFlushed.Add(uint64(meta.Size))
+	return nil
+}
+
+// newFileNumber reserves a number for a new SSTable file.
+func (t *LSMTree) newFileNumber() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.manifest.NewFileNumber()
+}
+
+// fileMetaFor builds the manifest entry describing an open table.
+func fileMetaFor(number uint64, table *SSTable) FileMeta {
+	var size int64
+	if info, err := os.Stat(table.Path()); err == nil {
+		size = info.Size()
+	}
+	meta := table.Meta()
+	return FileMeta{
+		Number:          number,
+		Size:            size,
+		EntryCount:      meta.EntryCount,
+		MinKey:          meta.MinKey,
+		MaxKey:          meta.MaxKey,
+		Tombstones:      meta.TombstoneCount,
+		RangeTombstones: meta.RangeTombstoneCount,
+	}
+}
+
+// Get returns the newest value of key: L0 newest-first, then L1..Ln. A file
+// without a record of key ends the search if one of its range tombstones
+// covers it.
+func (t *LSMTree) Get(key string) (string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	t.lookups.Add(1)
+	for _, number := range t.candidates(key) {
+		table := t.tables[number]
+		if table.MayContain(key) {
+			t.tablesRead.Add(1)
+			entry, err := table.Get(key)
+			t.checkCorruption(number, err)
+			if err == nil {
+				if entry.Tombstone {
+					return "", ErrKeyNotFound
+				}
+				return entry.Value, nil
+			}
+			if !errors.Is(err, ErrKeyNotFound) {
+				return "", err
+			}
+		}
+		if _, ok := table.ranges.covering(key); ok {
+			return "", ErrKeyNotFound
+		}
+	}
+	return "", ErrKeyNotFound
+}
+
+// candidates lists, in search order, the files whose key range covers key.
+// Callers must hold t.mu.
+func (t *LSMTree) candidates(key string) []uint64 {
+	var numbers []uint64
+	for _, v := range t.views {
+		if files := v.sorted; files != nil {
+			i := sort.Search(len(files), func(i int) bool { return files[i].MaxKey >= key })
+			if i < len(files) && files[i].MinKey <= key {
+				numbers = append(numbers, files[i].Number)
+			}
+			continue
+		}
+		for _, f := range v.files {
+			if key >= f.MinKey && key <= f.MaxKey {
+				numbers = append(numbers, f.Number)
+			}
+		}
+	}
+	return numbers
+}
+
+// Iterators returns iterators over every live file, newest data first, for
+// use in a MergingIterator: one per file of a level whose files overlap,
+// such as L0, or one per level walked as a single sorted run. They keep the
+// files readable after compaction replaces them, until closed, and a file
+// they find corrupt is quarantined as it would be by Get.
+func (t *LSMTree) Iterators() []Iterator {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var iters []Iterator
+	for _, v := range t.views {
+		if v.sorted == nil {
+			for _, f := range v.files {
+				iters = append(iters, t.levelIterator([]FileMeta{f}))
+			}
+			continue
+		}
+		iters = append(iters, t.levelIterator(v.sorted))
+	}
+	return iters
+}
+
+// levelIterator returns an iterator over files, which must be sorted by key
+// and not overlap. Callers must hold t.mu.
+func (t *LSMTree) levelIterator(files []FileMeta) Iterator {
+	tables := make([]*SSTable, len(files))
+	for i, f := range files {
+		tables[i] = t.tables[f.Number]
+		tables[i].acquire()
+	}
+	return newLevelIterator(tables, func(pos int, err error) {
+		t.checkCorruption(files[pos].Number, err)
+	})
+}
+
+// GetRange returns all live keys in [startKey, endKey] across every level.
+// It reads through the same MergingIterator as range scans, so newer files
+// take precedence over older ones and range tombstones apply.
+func (t *LSMTree) GetRange(startKey, endKey string) (map[string]string, error) {
+	return readRange(NewMergingIterator(t.Iterators()...), startKey, endKey)
+}
+
+// compactionResult summarises the I/O done by one compaction.
+type compactionResult struct {
+	BytesRead              uint64
+	BytesWritten           uint64
+	EntriesRead            uint64
+	EntriesWritten         uint64
+	TombstonesDropped      uint64
+	RangeTombstonesDropped uint64
+}
+
+// compact merges the compaction's inputs into new files at its output level,
+// cutting a new file every TargetFileSize bytes. The inputs are swapped for
+// the outputs in a single manifest edit and deleted afterwards; a crash before
+// the edit leaves only orphaned outputs, which are removed on the next open.
+//
+// A tombstone is written out again unless no file outside the compaction
+// could still hold an older version of its key; only then is it safe to
+// drop, together with the versions it shadowed. Range tombstones are kept on
+// the same terms, while the keys they cover in older inputs are dropped. A
+// file is only cut where the ranges it holds end, so that outputs never
+// overlap.
+func (t *LSMTree) compact(c *Compaction, limiter *ioRateLimiter) (compactionResult, error) {
+	var result compactionResult
+	if c.Drop {
+		return result, t.dropFiles(c.Level, c.Inputs)
+	}
+
+	// Newest first: the input level, then the output level, each by
+	// descending file number.
+	sources := make([]FileMeta, 0, len(c.Inputs)+len(c.Overlaps))
+	sources = append(sources, newestFirst(c.Inputs)...)
+	sources = append(sources, newestFirst(c.Overlaps)...)
+
+	var createdAt int64
+	t.mu.RLock()
+	tables := make([]*SSTable, 0, len(sources))
+	defer func() {
+		for _, table := range tables {
+			table.release()
+		}
+	}()
+	merged := make(map[uint64]bool, len(sources))
+	for _, f := range sources {
+		table, ok := t.tables[f.Number]
+		if !ok {
+			t.mu.RUnlock()
+			return result, fmt.Errorf("compaction input %06d is no longer live", f.Number)
+		}
+		table.acquire()
+		tables = append(tables, table)
+		merged[f.Number] = true
+		result.BytesRead += uint64(f.Size)
+		if f.CreatedAt > createdAt {
+			createdAt = f.CreatedAt
+		}
+	}
+	// Files at or below the input level that are not being merged may hold
+	// older versions that a dropped tombstone would resurrect.
+	var others []*SSTable
+	for level := c.Level; level < len(t.manifest.Levels); level++ {
+		for _, f := range t.manifest.Levels[level] {
+			if !merged[f.Number] {
+				others = append(others, t.tables[f.Number])
+			}
+		}
+	}
+	t.mu.RUnlock()
+
+	shadowsOlder := func(key string) bool {
+		for _, other := range others {
+			if other.MayContain(key) {
+				return true
+			}
+		}
+		return false
+	}
+	rangeShadowsOlder := func(r RangeTombstone) bool {
+		for _, other := range others {
+			if r.overlaps(other.meta.MinKey, other.meta.MaxKey) {
+				return true
+			}
+		}
+		return false
+	}
+	var ranges rangeSet
+	for _, table := range tables {
+		for _, r := range table.ranges {
+			ranges = ranges.add(r)
+		}
+	}
+	var kept rangeSet
+	for _, r := range ranges {
+		if rangeShadowsOlder(r) {
+			kept = append(kept, r)
+		} else {
+			result.RangeTombstonesDropped++
+		}
+	}
+	ranges = kept
+
+	var outputs []*SSTable
+	var outputMetas []FileMeta
+	var writer *SSTableWriter
+	var number uint64
+	var cut bool         // The current output is full
+	var rangesEnd string // Largest end of the ranges in the current output
+
+	abort := func() {
+		if writer != nil {
+			writer.Abort()
+		}
+		for _, table := range outputs {
+			table.Close()
+			os.Remove(table.Path())
+		}
+	}
+	openOutput := func() error {
+		if writer != nil {
+			return nil
+		}
+		number = t.newFileNumber()
+		w, err := NewSSTableWriter(t.tablePath(number), t.opts.SSTable)
+		if err != nil {
+			return err
+		}
+		writer = w
+		return nil
+	}
+	finishOutput := func() error {
+		if err := writer.Finish(); err != nil {
+			os.Remove(t.tablePath(number))
+			writer = nil
+			return err
+		}
+		writer, cut, rangesEnd = nil, false, ""
+		table, err := openSSTable(t.tablePath(number), t.opts.BlockCache)
+		if err != nil {
+			return err
+		}
+		meta := fileMetaFor(number, table)
+		meta.CreatedAt = createdAt
+		outputs = append(outputs, table)
+		outputMetas = append(outputMetas, meta)
+		result.BytesWritten += uint64(meta.Size)
+		return nil
+	}
+
+	// addRanges moves the ranges still to be written that start early enough
+	// into the current output, opening one if needed.
+	addRanges := func(early func(RangeTombstone) bool) error {
+		for ; len(ranges) > 0 && early(ranges[0]); ranges = ranges[1:] {
+			if err := openOutput(); err != nil {
+				return err
+			}
+			if err := writer.AddRangeTombstone(ranges[0]); err != nil {
+				return err
+			}
+			rangesEnd = max(rangesEnd, ranges[0].End)
+		}
+		return nil
+	}
+
+	entriesRead, err := mergeTables(tables, func(key string, entry Entry) error {
+		limiter.wait(len(key) + len(entry.Value))
+		if entry.Tombstone && !shadowsOlder(key) {
+			result.TombstonesDropped++
+			return nil
+		}
+
+		if cut {
+			if err := addRanges(func(r RangeTombstone) bool { return r.Start < key }); err != nil {
+				return err
+			}
+			if rangesEnd < key {
+				if err := finishOutput(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := addRanges(func(r RangeTombstone) bool { return r.Start <= key }); err != nil {
+			return err
+		}
+		if err := openOutput(); err != nil {
+			return err
+		}
+		if err := writer.AddEntry(key, entry); err != nil {
+			return err
+		}
+		result.EntriesWritten++
+		cut = c.TargetFileSize > 0 && int64(writer.Size()) >= c.TargetFileSize
+		return nil
+	})
+	result.EntriesRead = entriesRead
+	if err == nil {
+		err = addRanges(func(RangeTombstone) bool { return true })
+	}
+	if err == nil && writer != nil {
+		err = finishOutput()
+	}
+	if err != nil {
+		abort()
+		if errors.Is(err, ErrCorruption) {
+			for i, table := range tables {
+				t.checkCorruption(sources[i].Number, table.Verify())
+			}
+		}
+		return result, err
+	}
+
+	edit := ManifestEdit{}
+	for _, f := range c.Inputs {
+		edit.Removed = append(edit.Removed, LevelFile{Level: c.Level, File: f})
+	}
+	for _, f := range c.Overlaps {
+		edit.Removed = append(edit.Removed, LevelFile{Level: c.OutputLevel, File: f})
+	}
+	for _, f := range outputMetas {
+		edit.Added = append(edit.Added, LevelFile{Level: c.OutputLevel, File: f})
+	}
+
+	t.mu.Lock()
+	if err := t.manifest.Apply(edit); err != nil {
+		t.mu.Unlock()
+		abort()
+		return result, err
+	}
+	for i, table := range outputs {
+		t.tables[outputMetas[i].Number] = table
+	}
+	var replaced []*SSTable
+	for _, f := range sources {
+		if table, ok := t.tables[f.Number]; ok {
+			replaced = append(replaced, table)
+			delete(t.tables, f.Number)
+		}
+	}
+	t.refreshViews()
+	t.version++
+	t.mu.Unlock()
+
+	// Open iterators keep the inputs readable until they are closed.
+	for _, table := range replaced {
+		table.retire()
+	}
+	return result, nil
+}
+
+// dropFiles removes files from a level without merging them anywhere, e.g.
+// time windows past their retention.
+func (t *LSMTree) dropFiles(level int, files []FileMeta) error {
+	edit := ManifestEdit{}
+	for _, f := range files {
+		edit.Removed = append(edit.Removed, LevelFile{Level: level, File: f})
+	}
+
+	t.mu.Lock()
+	if err := t.manifest.Apply(edit); err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	tables := make([]*SSTable, 0, len(files))
+	for _, f := range files {
+		if table, ok := t.tables[f.Number]; ok {
+			tables = append(tables, table)
+			delete(t.tables, f.Number)
+		}
+	}
+	t.refreshViews()
+	t.version++
+	t.mu.Unlock()
+
+	for _, table := range tables {
+		table.retire()
+	}
+	return nil
+}
+
+// newestFirst returns files ordered by descending file number.
+func newestFirst(files []FileMeta) []FileMeta {
+	sorted := append([]FileMeta(nil), files...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Number > sorted[j].Number })
+	return sorted
+}
+
+// moveFile moves a file to another level without rewriting it.
+func (t *LSMTree) moveFile(f FileMeta, from, to int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.tables[f.Number]; !ok {
+		return nil // Quarantined since the move was planned
+	}
+	edit := ManifestEdit{
+		Removed: []LevelFile{{Level: from, File: f}},
+		Added:   []LevelFile{{Level: to, File: f}},
+	}
+	if err := t.manifest.Apply(edit); err != nil {
+		return err
+	}
+	t.refreshViews()
+	t.version++
+	return nil
+}
+
+// estimateDeadRatio samples up to maxBlocks blocks of a file and returns the
+// fraction of sampled entries that compacting it into the next level would
+// reclaim: tombstones, and keys also present in the files it would be merged
+// with (the other L0 files and L1 for an L0 file, the next level otherwise).
+func (t *LSMTree) estimateDeadRatio(level int, f FileMeta, maxBlocks int) (float64, error) {
+	// Take references under the lock and read without it, so sampling does
+	// not hold up compactions and quarantines; the files stay readable even
+	// if compaction replaces them meanwhile.
+	t.mu.RLock()
+	table := t.tables[f.Number]
+	if table == nil {
+		t.mu.RUnlock()
+		return 0, nil
+	}
+	tables := []*SSTable{table}
+	if level == 0 {
+		for _, other := range t.manifest.Levels[0] {
+			if other.Number != f.Number {
+				tables = append(tables, t.tables[other.Number])
+			}
+		}
+	}
+	if level+1 < len(t.manifest.Levels) {
+		for _, other := range overlapping(t.manifest.Levels[level+1], f.MinKey, f.MaxKey) {
+			tables = append(tables, t.tables[other.Number])
+		}
+	}
+	for _, table := range tables {
+		table.acquire()
+	}
+	t.mu.RUnlock()
+	defer func() {
+		for _, table := range tables {
+			table.release()
+		}
+	}()
+	others := tables[1:]
+
+	var sampled, dead int
+	err := table.sampleEntries(maxBlocks, func(key string, entry Entry) {
+		sampled++
+		if entry.Tombstone {
+			dead++
+			return
+		}
+		for _, other := range others {
+			if _, err := other.Get(key); err == nil {
+				dead++
+				return
+			}
+		}
+	})
+	if err != nil || sampled == 0 {
+		t.checkCorruption(f.Number, err)
+		return 0, err
+	}
+	return float64(dead) / float64(sampled), nil
+}
+
+// LevelStats describes the files at one level.
+type LevelStats struct {
+	Files   int    `json:"files"`
+	Bytes   int64  `json:"bytes"`
+	Entries uint64 `json:"entries"`
+	Sorted  bool   `json:"sorted"` // Files do not overlap
+}
+
+// LSMStats describes the shape of the tree and the work done by lookups.
+type LSMStats struct {
+	Levels           []LevelStats     `json:"levels"`
+	SortedRuns       int              `json:"sorted_runs"` // Independent runs a lookup may have to search
+	TotalBytes       int64            `json:"total_bytes"`
+	BytesFlushed     uint64           `json:"bytes_flushed"`
+	Lookups          uint64           `json:"lookups"`
+	TablesRead       uint64           `json:"tables_read"`       // Files read by lookups after key-range and Bloom checks
+	RawDataBytes     uint64           `json:"raw_data_bytes"`    // Data blocks before compression
+	DataBytes        uint64           `json:"data_bytes"`        // Data blocks as stored
+	CompressionRatio float64          `json:"compression_ratio"` // RawDataBytes / DataBytes
+	Quarantined      uint64           `json:"quarantined"`       // Corrupt files moved to the quarantine directory
+	BlockCache       *BlockCacheStats `json:"block_cache,omitempty"`
+}
+
+// Stats returns a snapshot of the tree's shape and counters.
+func (t *LSMTree) Stats() LSMStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	stats := LSMStats{
+		Levels:       make([]LevelStats, len(t.views)),
+		BytesFlushed: t.bytesFlushed.Load(),
+		Lookups:      t.lookups.Load(),
+		TablesRead:   t.tablesRead.Load(),
+		Quarantined:  t.quarantined.Load(),
+	}
+	for _, table := range t.tables {
+		stats.RawDataBytes += table.meta.RawDataBytes
+		stats.DataBytes += table.meta.DataBytes
+	}
+	if stats.DataBytes > 0 {
+		stats.CompressionRatio = float64(stats.RawDataBytes) / float64(stats.DataBytes)
+	}
+	if t.opts.BlockCache != nil {
+		cache := t.opts.BlockCache.Stats()
+		stats.BlockCache = &cache
+	}
+	for level, v := range t.views {
+		ls := LevelStats{Files: len(v.files), Sorted: v.sorted != nil}
+		for _, f := range v.files {
+			ls.Bytes += f.Size
+			ls.Entries += f.EntryCount
+		}
+		switch {
+		case ls.Files == 0:
+		case ls.Sorted:
+			stats.SortedRuns++
+		default:
+			stats.SortedRuns += ls.Files
+		}
+		stats.Levels[level] = ls
+		stats.TotalBytes += ls.Bytes
+	}
+	return stats
+}
+
+// Version returns a counter that changes whenever files are added or removed.
+func (t *LSMTree) Version() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.version
+}
+
+// LevelFiles returns a copy of the file list at each level.
+func (t *LSMTree) LevelFiles() [][]FileMeta {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	levels := make([][]FileMeta, len(t.manifest.Levels))
+	for i, files := range t.manifest.Levels {
+		levels[i] = append([]FileMeta(nil), files...)
+	}
+	return levels
+}
+
+// Close waits for pending quarantines and closes every open SSTable.
+func (t *LSMTree) Close() error {
+	t.wg.Wait()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var firstErr error
+	for number, table := range t.tables {
+		if err := table.release(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(t.tables, number)
+	}
+	t.chargeIndexes()
+	return firstErr
+}
@@ -0,0 +1,216 @@
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"moniepoint/internal/storage"
+)
+
+// values converts plain key-value pairs into Memtable entries for a flush.
+func values(data map[string]string) map[string]storage.Entry {
+	entries := make(map[string]storage.Entry, len(data))
+	for key, value := range data {
+		entries[key] = storage.Entry{Value: value}
+	}
+	return entries
+}
+
+// TestLSMTreeFlushCreatesL0Files verifies that every flush produces a new L0
+// file and that newer files shadow older ones.
+func TestLSMTreeFlushCreatesL0Files(t *testing.T) {
+	tree, err := storage.OpenLSMTree(t.TempDir(), storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	if err := tree.Flush(values(map[string]string{"txn1": "pending", "txn2": "pending"})); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if err := tree.Flush(values(map[string]string{"txn1": "approved", "txn3": "failed"})); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	levels := tree.LevelFiles()
+	if len(levels[0]) != 2 {
+		t.Fatalf("Expected 2 L0 files, got %d", len(levels[0]))
+	}
+
+	expected := map[string]string{"txn1": "approved", "txn2": "pending", "txn3": "failed"}
+	for key, want := range expected {
+		if got, err := tree.Get(key); err != nil || got != want {
+			t.Errorf("Expected %s=%s, got '%s' (err=%v)", key, want, got, err)
+		}
+	}
+	if _, err := tree.Get("txn4"); err != storage.ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for missing key, got %v", err)
+	}
+
+	results, err := tree.GetRange("txn1", "txn3")
+	if err != nil {
+		t.Fatalf("GetRange failed: %v", err)
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+}
+
+// TestLSMTreeTombstones verifies that a tombstone in a newer file hides the
+// key in older files for both point and range reads.
+func TestLSMTreeTombstones(t *testing.T) {
+	tree, err := storage.OpenLSMTree(t.TempDir(), storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	if err := tree.Flush(values(map[string]string{"a": "1", "b": "2"})); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if err := tree.Flush(map[string]storage.Entry{"a": {Tombstone: true}}); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if _, err := tree.Get("a"); err != storage.ErrKeyNotFound {
+		t.Errorf("Expected deleted key to be hidden, got %v", err)
+	}
+	results, err := tree.GetRange("a", "z")
+	if err != nil {
+		t.Fatalf("GetRange failed: %v", err)
+	}
+	if expected := map[string]string{"b": "2"}; !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+	if n := tree.LevelFiles()[0][1].Tombstones; n != 1 {
+		t.Errorf("Expected 1 tombstone recorded in the manifest, got %d", n)
+	}
+}
+
+// TestLSMTreeReopen verifies that the manifest restores all files on reopen.
+func TestLSMTreeReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	tree, err := storage.OpenLSMTree(dir, storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := tree.Flush(values(map[string]string{"key": fmt.Sprintf("v%d", i)})); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+	tree.Close()
+
+	reopened, err := storage.OpenLSMTree(dir, storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer reopened.Close()
+
+	if n := len(reopened.LevelFiles()[0]); n != 3 {
+		t.Errorf("Expected 3 L0 files after reopen, got %d", n)
+	}
+	if got, err := reopened.Get("key"); err != nil || got != "v2" {
+		t.Errorf("Expected newest value 'v2', got '%s' (err=%v)", got, err)
+	}
+}
+
+// TestLSMTreeBinaryKeys verifies that keys and values that are not UTF-8
+// survive a flush and a reopen byte for byte, including the key range
+// recorded in the manifest.
+func TestLSMTreeBinaryKeys(t *testing.T) {
+	dir := t.TempDir()
+	data := map[string]string{
+		"\x00":        "\xff\xfe",
+		"img\xff\x00": "\x89PNG\r\n\x1a\n\x00",
+		"\xff\xff":    "",
+	}
+
+	tree, err := storage.OpenLSMTree(dir, storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	if err := tree.Flush(values(data)); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	tree.Close()
+
+	reopened, err := storage.OpenLSMTree(dir, storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer reopened.Close()
+
+	if files := reopened.LevelFiles()[0]; len(files) != 1 || files[0].MinKey != "\x00" || files[0].MaxKey != "\xff\xff" {
+		t.Fatalf("Expected the binary key range in the manifest, got %+v", files)
+	}
+	for key, want := range data {
+		if got, err := reopened.Get(key); err != nil || got != want {
+			t.Errorf("Expected %q=%q, got %q (err=%v)", key, want, got, err)
+		}
+	}
+}
+
+// TestLSMTreeRemovesOrphans verifies that files missing from the manifest,
+// such as a flush interrupted by a crash, are deleted on open.
+func TestLSMTreeRemovesOrphans(t *testing.T) {
+	dir := t.TempDir()
+
+	tree, err := storage.OpenLSMTree(dir, storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	if err := tree.Flush(values(map[string]string{"a": "1"})); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	tree.Close()
+
+	orphan := filepath.Join(dir, "000099.sst")
+	if err := os.WriteFile(orphan, []byte("partial"), 0644); err != nil {
+		t.Fatalf("Failed to create orphan: %v", err)
+	}
+
+	reopened, err := storage.OpenLSMTree(dir, storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer reopened.Close()
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("Expected orphaned SSTable to be removed")
+	}
+	if got, err := reopened.Get("a"); err != nil || got != "1" {
+		t.Errorf("Expected 'a'='1', got '%s' (err=%v)", got, err)
+	}
+}
+
+// TestManifestKeepsRecencyOrder verifies that levels may hold overlapping
+// runs, which are persisted in file-number (recency) order.
+func TestManifestKeepsRecencyOrder(t *testing.T) {
+	dir := t.TempDir()
+	manifest, err := storage.LoadManifest(dir, storage.DefaultNumLevels)
+	if err != nil {
+		t.Fatalf("Failed to load manifest: %v", err)
+	}
+
+	err = manifest.Apply(storage.ManifestEdit{Added: []storage.LevelFile{
+		{Level: 1, File: storage.FileMeta{Number: 2, MinKey: "a", MaxKey: "m"}},
+		{Level: 1, File: storage.FileMeta{Number: 1, MinKey: "k", MaxKey: "z"}},
+	}})
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	reloaded, err := storage.LoadManifest(dir, storage.DefaultNumLevels)
+	if err != nil {
+		t.Fatalf("Failed to reload manifest: %v", err)
+	}
+	files := reloaded.Levels[1]
+	if len(files) != 2 || files[0].Number != 1 || files[1].Number != 2 {
+		t.Errorf("Expected L1 files [1 2] in recency order, got %+v", files)
+	}
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"unicode/utf8"
+)
+
+const (
+	ManifestFileName = "MANIFEST"
+	DefaultNumLevels = 7 // L0 plus six deeper levels
+)
+
+// FileMeta describes one SSTable file tracked by the manifest.
+type FileMeta struct {
+	Number          uint64 `json:"number"`
+	Size            int64  `json:"size"`
+	EntryCount      uint64 `json:"entry_count"`
+	MinKey          string `json:"min_key"` // Including range tombstones
+	MaxKey          string `json:"max_key"`
+	Tombstones      uint64 `json:"tombstones"`
+	RangeTombstones uint64 `json:"range_tombstones,omitempty"`
+	CreatedAt       int64  `json:"created_at"` // Unix seconds of the newest data in the file
+}
+
+// fileMetaJSON is the manifest encoding of a FileMeta. JSON strings must be
+// UTF-8, so a key that is not is stored, base64-encoded, in the *_bytes
+// field instead; manifests written before keys could be binary still load.
+type fileMetaJSON struct {
+	plainFileMeta
+	MinKeyBytes []byte `json:"min_key_bytes,omitempty"`
+	MaxKeyBytes []byte `json:"max_key_bytes,omitempty"`
+}
+
+// plainFileMeta is FileMeta without its JSON methods.
+type plainFileMeta FileMeta
+
+func (f FileMeta) MarshalJSON() ([]byte, error) {
+	j := fileMetaJSON{plainFileMeta: plainFileMeta(f)}
+	if !utf8.ValidString(f.MinKey) {
+		j.MinKey, j.MinKeyBytes = "", []byte(f.MinKey)
+	}
+	if !utf8.ValidString(f.MaxKey) {
+		j.MaxKey, j.MaxKeyBytes = "", []byte(f.MaxKey)
+	}
+	return json.Marshal(j)
+}
+
+func (f *FileMeta) UnmarshalJSON(data []byte) error {
+	var j fileMetaJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*f = FileMeta(j.plainFileMeta)
+	if j.MinKeyBytes != nil {
+		f.MinKey = string(j.MinKeyBytes)
+	}
+	if j.MaxKeyBytes != nil {
+		f.MaxKey = string(j.MaxKeyBytes)
+	}
+	return nil
+}
+
+// LevelFile places a file at a level in a ManifestEdit.
+type LevelFile struct {
+	Level int
+	File  FileMeta
+}
+
+// ManifestEdit is a set of file additions and removals applied atomically.
+type ManifestEdit struct {
+	Added   []LevelFile
+	Removed []LevelFile
+}
+
+// Manifest is the persisted version set: the list of live SSTable files at
+// every level, each level kept in file-number order (oldest first). Within a
+// level a higher number always holds newer data, and every level holds newer
+// data than the levels below it. L0 files may overlap; whether deeper levels
+// do depends on the CompactionStrategy that produced them.
+//
+// The manifest is rewritten in full on every change to a temporary file that
+// is synced and renamed over MANIFEST, so readers only ever see a complete
+// version.
+type Manifest struct {
+	path string
+
+	NextFileNumber uint64       `json:"next_file_number"`
+	Levels         [][]FileMeta `json:"levels"`
+}
+
+// LoadManifest reads the manifest in dir, or returns an empty one with
+// numLevels levels if none has been written yet.
+func LoadManifest(dir string, numLevels int) (*Manifest, error) {
+	m := &Manifest{
+		path:           filepath.Join(dir, ManifestFileName),
+		NextFileNumber: 1,
+	}
+
+	data, err := os.ReadFile(m.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("corrupt manifest %s: %w", m.path, err)
+		}
+	}
+
+	for len(m.Levels) < numLevels {
+		m.Levels = append(m.Levels, nil)
+	}
+	return m, nil
+}
+
+// NewFileNumber reserves the next SSTable file number. Numbers are persisted
+// with the next Apply; an unused number is simply skipped.
+func (m *Manifest) NewFileNumber() uint64 {
+	n := m.NextFileNumber
+	m.NextFileNumber++
+	return n
+}
+
+// Apply applies an edit and persists the resulting version. On error the
+// in-memory manifest is left unchanged.
+func (m *Manifest) Apply(edit ManifestEdit) error {
+	levels := make([][]FileMeta, len(m.Levels))
+	for i, files := range m.Levels {
+		levels[i] = append([]FileMeta(nil), files...)
+	}
+
+	for _, r := range edit.Removed {
+		if r.Level < 0 || r.Level >= len(levels) {
+			return fmt.Errorf("manifest edit: invalid level %d", r.Level)
+		}
+		files := levels[r.Level]
+		for i, f := range files {
+			if f.Number == r.File.Number {
+				levels[r.Level] = append(files[:i:i], files[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, a := range edit.Added {
+		if a.Level < 0 || a.Level >= len(levels) {
+			return fmt.Errorf("manifest edit: invalid level %d", a.Level)
+		}
+		levels[a.Level] = append(levels[a.Level], a.File)
+	}
+
+	for _, files := range levels {
+		sort.Slice(files, func(i, j int) bool { return files[i].Number < files[j].Number })
+	}
+
+	next := *m
+	next.Levels = levels
+	if err := next.save(); err != nil {
+		return err
+	}
+	m.Levels = levels
+	return nil
+}
+
+// save writes the manifest to a temporary file and renames it into place.
+func (m *Manifest) save() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, data)
+}
+
+// LiveFiles returns the numbers of all files referenced by the manifest.
+func (m *Manifest) LiveFiles() map[uint64]int {
+	live := make(map[uint64]int)
+	for level, files := range m.Levels {
+		for _, f := range files {
+			live[f.Number] = level
+		}
+	}
+	return live
+}
+
+// writeFileAtomic replaces path with data so that a crash leaves either the
+// old or the new contents, never a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory so that renames and new files in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package storage
+
+import "sync/atomic"
+
+// MemoryBudget is a process-wide limit on the memory held by the engine,
+// shared by memtables, the block cache and SSTable index structures
+// (sparse indexes and Bloom filters).
+//   - Memtables may use up to half of the limit; past it writes freeze the
+//     active memtable and stall until flushes release memory.
+//   - The block cache may use whatever memtables and indexes leave.
+//   - Indexes are needed by every read, so they are charged and reported
+//     but never evicted.
+type MemoryBudget struct {
+	limit      int64
+	memtables  atomic.Int64
+	blockCache atomic.Int64
+	indexes    atomic.Int64
+}
+
+// MemoryStats shows how a MemoryBudget is spent, in bytes.
+type MemoryStats struct {
+	Limit      int64 `json:"limit"`
+	Used       int64 `json:"used"`
+	Memtables  int64 `json:"memtables"`
+	BlockCache int64 `json:"block_cache"`
+	Indexes    int64 `json:"indexes"`
+}
+
+// NewMemoryBudget creates a budget of limit bytes.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// MemtableLimit returns how many bytes memtables, active and immutable, may hold.
+func (b *MemoryBudget) MemtableLimit() int64 {
+	return b.limit / 2
+}
+
+// BlockCacheLimit returns how many bytes the block cache may hold right now.
+func (b *MemoryBudget) BlockCacheLimit() int64 {
+	return max(0, b.limit-b.memtables.Load()-b.indexes.Load())
+}
+
+// memtablesFull reports whether memtables have reached their share.
+func (b *MemoryBudget) memtablesFull() bool {
+	return b.memtables.Load() >= b.MemtableLimit()
+}
+
+// Stats returns the current usage.
+func (b *MemoryBudget) Stats() MemoryStats {
+	stats := MemoryStats{
+		Limit:      b.limit,
+		Memtables:  b.memtables.Load(),
+		BlockCache: b.blockCache.Load(),
+		Indexes:    b.indexes.Load(),
+	}
+	stats.Used = stats.Memtables + stats.BlockCache + stats.Indexes
+	return stats
+}
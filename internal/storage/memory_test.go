@@ -0,0 +1,62 @@
+package storage_test
+
+import (
+	"strings"
+	"testing"
+
+	"moniepoint/internal/storage"
+)
+
+// TestMemoryBudgetMemtables verifies that memtables are frozen once they
+// reach their share of the budget, whatever their own size limit, and that
+// flushing releases the memory.
+func TestMemoryBudgetMemtables(t *testing.T) {
+	budget := storage.NewMemoryBudget(4000) // Memtables may use 2000 bytes
+	recorder := newFlushRecorder()
+	memtable := storage.NewMemtable(storage.MemtableOptions{MaxBytes: 1 << 20, Budget: budget}, recorder.flush)
+	defer memtable.Close()
+
+	value := strings.Repeat("v", 1000)
+	memtable.Set("key1", value)
+	if used := budget.Stats().Memtables; used < 1000 || used >= 2000 {
+		t.Fatalf("Expected the first record to be charged, got %d bytes", used)
+	}
+	memtable.Set("key2", value) // Over the memtable share: frozen and flushed
+
+	recorder.wait(t)
+	memtable.Flush()
+	if used := budget.Stats().Memtables; used != 0 {
+		t.Errorf("Expected flushed memtables to release their memory, got %d bytes", used)
+	}
+	if len(recorder.data) != 2 {
+		t.Errorf("Expected both records in the flush, got %d", len(recorder.data))
+	}
+}
+
+// TestMemoryBudgetIndexes verifies that the indexes of open SSTables are
+// charged to the budget and shrink what the block cache may use.
+func TestMemoryBudgetIndexes(t *testing.T) {
+	budget := storage.NewMemoryBudget(1 << 20)
+	opts := storage.DefaultLSMOptions()
+	opts.Budget = budget
+	tree, err := storage.OpenLSMTree(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+
+	if err := tree.Flush(values(map[string]string{"a": "1", "b": "2"})); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	stats := budget.Stats()
+	if stats.Indexes <= 0 || stats.Used != stats.Indexes {
+		t.Errorf("Expected only index memory to be charged, got %+v", stats)
+	}
+	if limit := budget.BlockCacheLimit(); limit != stats.Limit-stats.Indexes {
+		t.Errorf("Expected the block cache to get the rest of the budget, got %d", limit)
+	}
+
+	tree.Close()
+	if stats := budget.Stats(); stats.Indexes != 0 {
+		t.Errorf("Expected closed tables to release their indexes, got %d bytes", stats.Indexes)
+	}
+}
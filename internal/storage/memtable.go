@@ -1,94 +1,371 @@
 package storage
 
 import (
-	"sort"
+	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Entry is the newest record of a key: a value, or a tombstone recording that
+// the key was deleted. Tombstones are persisted in the WAL and in SSTables
+// like values, so a delete keeps shadowing older versions of the key across
+// restarts and until compaction can safely drop it.
+type Entry struct {
+	Value     string
+	Tombstone bool
+}
+
+// MemtableOptions configures a Memtable.
+type MemtableOptions struct {
+	MaxBytes        int64         // Freeze the active memtable once its keys, values and overhead reach this size
+	MaxImmutables   int           // Stall writes while this many frozen memtables wait to be flushed
+	FlushRetryDelay time.Duration // Wait before retrying a failed flush
+	Budget          *MemoryBudget // Optional process-wide budget shared with the block cache and indexes
+}
+
+// DefaultMemtableOptions returns the options used when none are configured.
+func DefaultMemtableOptions() MemtableOptions {
+	return MemtableOptions{
+		MaxBytes:        4 * 1024 * 1024,
+		MaxImmutables:   4,
+		FlushRetryDelay: time.Second,
+	}
+}
+
 // Memtable is a thread-safe in-memory key-value store.
-// - Uses RWMutex for concurrency control.
-// - Flushes to SSTable when reaching max capacity.
-// - Optimized range queries with binary search.
-// - Bloom Filters were considered but not included for now.
+// - Keeps records in a skiplist: lookups and range scans take no lock, so scans never stall writers.
+// - Writers are serialized by a mutex.
+// - Sized in bytes (keys, values and per-record overhead) and charged to the memory budget.
+// - When full, the skiplist is frozen into a readable immutable memtable and a fresh one takes writes.
+// - A background goroutine flushes immutables to SSTables, oldest first; a failed flush keeps its immutable queued and is retried.
+// - Writes stall only while MaxImmutables immutables wait, or memtables are over budget.
+// - Range queries seek to the start key and walk keys in order.
+// - Point-lookup misses are filtered by per-SSTable Bloom filters after flush.
+// - Deletes are kept as tombstones and flushed with the values.
+// - Tracks the last WAL sequence number applied, the position a flush covers.
 type Memtable struct {
-	data       map[string]string
-	mu         sync.RWMutex
-	maxEntries int
-	flushFunc  func(map[string]string) // Function to flush Memtable data to SSTable
+	state     atomic.Pointer[memtableState] // Replaced, never modified, under mu
+	mu        sync.Mutex
+	changed   *sync.Cond // Signalled when an immutable is queued or flushed
+	closed    bool
+	stop      chan struct{} // Closed by Close to cut a retry delay short
+	done      chan struct{}
+	opts      MemtableOptions
+	seq       uint64                                       // Last WAL sequence number applied
+	flushFunc func(it *MemtableIterator, seq uint64) error // Function to flush Memtable data, and the WAL position it covers, to SSTable
+
+	flushes     uint64
+	flushErrors uint64
+	stalls      uint64
+	stallTime   time.Duration
 }
 
-// NewMemtable initializes a Memtable with a maximum size and a flush function.
-func NewMemtable(maxEntries int, flushFunc func(map[string]string)) *Memtable {
-	return &Memtable{
-		data:       make(map[string]string, maxEntries),
-		maxEntries: maxEntries,
-		flushFunc:  flushFunc,
+// memtableState is what readers see: the active skiplist and the immutable
+// ones waiting to be flushed, oldest first.
+type memtableState struct {
+	active     *skiplist
+	immutables []immutableMemtable
+}
+
+// immutableMemtable is a frozen skiplist and the WAL position it covers.
+type immutableMemtable struct {
+	list *skiplist
+	seq  uint64
+}
+
+// MemtableStats reports the Memtable's size and flush activity.
+type MemtableStats struct {
+	Entries        int           `json:"entries"`         // Records in the active memtable
+	Bytes          int64         `json:"bytes"`           // Size of the active memtable
+	Immutables     int           `json:"immutables"`      // Frozen memtables waiting to be flushed
+	ImmutableBytes int64         `json:"immutable_bytes"` // Size of the frozen memtables
+	Flushes        uint64        `json:"flushes"`
+	FlushErrors    uint64        `json:"flush_errors"` // Failed flushes, each retried
+	Stalls         uint64        `json:"stalls"`       // Writes that waited for a flush
+	StallTime      time.Duration `json:"stall_time"`   // Total time writes spent stalled
+}
+
+// NewMemtable initializes a Memtable with size limits and a flush function,
+// and starts its background flush goroutine. An immutable memtable is only
+// dropped once flushFunc has returned nil for it.
+func NewMemtable(opts MemtableOptions, flushFunc func(it *MemtableIterator, seq uint64) error) *Memtable {
+	defaults := DefaultMemtableOptions()
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = defaults.MaxBytes
+	}
+	if opts.MaxImmutables <= 0 {
+		opts.MaxImmutables = defaults.MaxImmutables
+	}
+	if opts.FlushRetryDelay <= 0 {
+		opts.FlushRetryDelay = defaults.FlushRetryDelay
+	}
+
+	m := &Memtable{
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		opts:      opts,
+		flushFunc: flushFunc,
 	}
+	m.changed = sync.NewCond(&m.mu)
+	m.state.Store(&memtableState{active: newSkiplist()})
+
+	go m.flushLoop()
+	return m
 }
 
 // Set inserts or updates a key-value pair and triggers flush if needed.
 func (m *Memtable) Set(key, value string) {
+	m.Apply(0, key, Entry{Value: value})
+}
+
+// Delete records a tombstone for key, shadowing any older value in the
+// SSTables, and triggers flush if needed.
+func (m *Memtable) Delete(key string) {
+	m.Apply(0, key, Entry{Tombstone: true})
+}
+
+// DeleteRange records a range tombstone for [start, end), shadowing the
+// keys in older immutables and SSTables, and triggers flush if needed.
+func (m *Memtable) DeleteRange(start, end string) {
+	m.ApplyBatch(WALRecord{Key: start, Entry: Entry{Tombstone: true}, End: end})
+}
+
+// Apply stores the newest record of key, logged in the WAL as seq (0 if it
+// was not logged), and freezes the Memtable for flushing once it is full.
+// Records must be applied in sequence order for a flush to cover every
+// record up to its position.
+func (m *Memtable) Apply(seq uint64, key string, entry Entry) {
+	m.ApplyBatch(WALRecord{Seq: seq, Key: key, Entry: entry})
+}
+
+// ApplyBatch stores records in order, like Apply, and makes them visible
+// to readers all at once. They all go into the same skiplist: the Memtable
+// is only frozen once the whole batch is in. A record with an End is a
+// range delete.
+func (m *Memtable) ApplyBatch(records ...WALRecord) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.data[key] = value
+	// Write stall: wait for the flusher to catch up.
+	if m.mustStall() {
+		start := time.Now()
+		for m.mustStall() && !m.closed {
+			m.changed.Wait()
+		}
+		m.stalls++
+		m.stallTime += time.Since(start)
+	}
+
+	active := m.state.Load().active
+	before := active.Bytes()
+	for _, rec := range records {
+		if rec.End != "" {
+			active.DeleteRange(RangeTombstone{Start: rec.Key, End: rec.End})
+		} else {
+			active.Put(rec.Key, rec.Entry)
+		}
+		m.seq = max(m.seq, rec.Seq)
+	}
+	active.commit()
+	if m.opts.Budget != nil {
+		m.opts.Budget.memtables.Add(active.Bytes() - before)
+	}
+
+	if active.Bytes() >= m.opts.MaxBytes || (m.opts.Budget != nil && m.opts.Budget.memtablesFull()) {
+		m.freeze()
+	}
+}
 
-	if len(m.data) >= m.maxEntries {
-		m.Flush()
+// mustStall reports whether writes have to wait for a flush: too many
+// immutables are queued, or memtables are over budget and a flush in
+// progress will release memory. Callers hold mu.
+func (m *Memtable) mustStall() bool {
+	immutables := len(m.state.Load().immutables)
+	if immutables >= m.opts.MaxImmutables {
+		return true
 	}
+	return immutables > 0 && m.opts.Budget != nil && m.opts.Budget.memtablesFull()
 }
 
-// flushAndReset writes data to SSTable and resets the Memtable.
+// Flush freezes the active Memtable and waits until every immutable one
+// has been flushed to SSTable.
 func (m *Memtable) Flush() {
-	if m.flushFunc != nil {
-		m.flushFunc(m.data) // Flush Memtable data to SSTable
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.state.Load().active.Len() > 0 {
+		m.freeze()
+	}
+	for len(m.state.Load().immutables) > 0 && !m.closed {
+		m.changed.Wait()
 	}
+}
+
+// Close waits for queued immutables to be flushed and stops the flush
+// goroutine. Records still in the active Memtable, and in immutables whose
+// flush fails after Close, are left to WAL replay.
+func (m *Memtable) Close() {
+	m.mu.Lock()
+	m.closed = true
+	m.changed.Broadcast()
+	m.mu.Unlock()
+	close(m.stop)
 
-	// Reset Memtable to avoid memory leaks
-	m.data = make(map[string]string, m.maxEntries)
+	<-m.done
 }
 
-// Get retrieves a value for a given key.
-func (m *Memtable) Get(key string) (string, bool) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+// freeze queues the active skiplist for flushing and starts a fresh one.
+// Callers hold mu.
+func (m *Memtable) freeze() {
+	state := m.state.Load()
+	immutables := append(state.immutables[:len(state.immutables):len(state.immutables)], immutableMemtable{list: state.active, seq: m.seq})
+	m.state.Store(&memtableState{active: newSkiplist(), immutables: immutables})
+	m.changed.Broadcast()
+}
+
+// flushLoop hands immutables, oldest first, to the flush function in key
+// order. An immutable stays readable until its flush has succeeded, so
+// readers see its records until they are in an SSTable. A failed flush is
+// retried after FlushRetryDelay without moving on to newer immutables, so
+// the WAL is never checkpointed past records that are not in an SSTable.
+func (m *Memtable) flushLoop() {
+	defer close(m.done)
+
+	for {
+		m.mu.Lock()
+		for len(m.state.Load().immutables) == 0 && !m.closed {
+			m.changed.Wait()
+		}
+		if len(m.state.Load().immutables) == 0 {
+			m.mu.Unlock()
+			return
+		}
+		imm := m.state.Load().immutables[0]
+		m.mu.Unlock()
+
+		if m.flushFunc != nil {
+			// Flush Memtable data to SSTable
+			if err := m.flushFunc(&MemtableIterator{list: imm.list}, imm.seq); err != nil {
+				m.mu.Lock()
+				m.flushErrors++
+				closed := m.closed
+				m.mu.Unlock()
+				if closed {
+					log.Printf("[ERROR] Failed to flush Memtable on close, leaving its records to WAL replay: %v", err)
+					return
+				}
+				log.Printf("[ERROR] Failed to flush Memtable, retrying in %v: %v", m.opts.FlushRetryDelay, err)
+				select {
+				case <-time.After(m.opts.FlushRetryDelay):
+				case <-m.stop:
+				}
+				continue
+			}
+		}
 
-	val, exists := m.data[key]
-	return val, exists
+		m.mu.Lock()
+		state := m.state.Load()
+		m.state.Store(&memtableState{active: state.active, immutables: state.immutables[1:]})
+		if m.opts.Budget != nil {
+			m.opts.Budget.memtables.Add(-imm.list.Bytes())
+		}
+		m.flushes++
+		m.changed.Broadcast()
+		m.mu.Unlock()
+	}
 }
 
-// Delete removes a key from the Memtable.
-func (m *Memtable) Delete(key string) {
+// NewIterator returns an unpositioned iterator over the records of the
+// active Memtable.
+func (m *Memtable) NewIterator() *MemtableIterator {
+	return &MemtableIterator{list: m.state.Load().active}
+}
+
+// Iterators returns an iterator over each of the active and immutable
+// skiplists, newest first, for use in a MergingIterator.
+func (m *Memtable) Iterators() []Iterator {
+	state := m.state.Load()
+	iters := []Iterator{&MemtableIterator{list: state.active}}
+	for i := len(state.immutables) - 1; i >= 0; i-- {
+		iters = append(iters, &MemtableIterator{list: state.immutables[i].list})
+	}
+	return iters
+}
+
+// Stats returns the Memtable's size and flush counters.
+func (m *Memtable) Stats() MemtableStats {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	delete(m.data, key)
-}
 
-// GetRange retrieves keys in a sorted range using binary search.
-func (m *Memtable) GetRange(startKey, endKey string) map[string]string {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	state := m.state.Load()
+	stats := MemtableStats{
+		Entries:     state.active.Len(),
+		Bytes:       state.active.Bytes(),
+		Immutables:  len(state.immutables),
+		Flushes:     m.flushes,
+		FlushErrors: m.flushErrors,
+		Stalls:      m.stalls,
+		StallTime:   m.stallTime,
+	}
+	for _, imm := range state.immutables {
+		stats.ImmutableBytes += imm.list.Bytes()
+	}
+	return stats
+}
 
-	results := make(map[string]string)
-	keys := make([]string, 0, len(m.data))
+// Get retrieves a value for a given key. A deleted key is reported as absent.
+func (m *Memtable) Get(key string) (string, bool) {
+	entry, exists := m.GetEntry(key)
+	if !exists || entry.Tombstone {
+		return "", false
+	}
+	return entry.Value, true
+}
 
-	for k := range m.data {
-		keys = append(keys, k)
+// GetEntry returns the record held for key, which may be a tombstone: the
+// active Memtable first, then the immutables newest first. A key deleted
+// by a range tombstone is reported as a tombstone.
+func (m *Memtable) GetEntry(key string) (Entry, bool) {
+	state := m.state.Load()
+	if entry, ok := getEntry(state.active, key); ok {
+		return entry, true
 	}
-	sort.Strings(keys)
+	for i := len(state.immutables) - 1; i >= 0; i-- {
+		if entry, ok := getEntry(state.immutables[i].list, key); ok {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
 
-	// Binary search for start position
-	startIndex := sort.Search(len(keys), func(i int) bool { return keys[i] >= startKey })
-	for i := startIndex; i < len(keys) && keys[i] <= endKey; i++ {
-		results[keys[i]] = m.data[keys[i]]
+// getEntry looks key up in one skiplist: its own record, unless a later
+// range delete hides it, then the list's range tombstones.
+func getEntry(list *skiplist, key string) (Entry, bool) {
+	if entry, ok := list.Get(key); ok {
+		return entry, true
 	}
+	if _, ok := list.rangeTombstones().covering(key); ok {
+		return Entry{Tombstone: true}, true
+	}
+	return Entry{}, false
+}
 
+// GetRange retrieves the live keys in [startKey, endKey] of the active
+// Memtable and the immutables, merged as by Iterators.
+func (m *Memtable) GetRange(startKey, endKey string) map[string]string {
+	// Memtable iterators cannot fail.
+	results, _ := readRange(NewMergingIterator(m.Iterators()...), startKey, endKey)
 	return results
 }
 
-// Size returns the current number of keys in the Memtable.
+// Size returns the current number of keys in the Memtable, tombstones
+// included, counting immutables not yet flushed.
 func (m *Memtable) Size() int {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return len(m.data)
+	state := m.state.Load()
+	size := state.active.Len()
+	for _, imm := range state.immutables {
+		size += imm.list.Len()
+	}
+	return size
 }
@@ -1,17 +1,22 @@
 package storage_test
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"moniepoint/internal/storage"
 )
 
 // TestMemtable covers basic operations: Set, Get, and Delete.
 func TestMemtable(t *testing.T) {
-	memtable := storage.NewMemtable(1000, nil)
+	memtable := storage.NewMemtable(storage.DefaultMemtableOptions(), nil)
 
 	memtable.Set("payment1", "approved")
 	value, exists := memtable.Get("payment1")
@@ -29,11 +34,51 @@ func TestMemtable(t *testing.T) {
 	if exists {
 		t.Errorf("Expected 'payment1' to be deleted")
 	}
+	if entry, found := memtable.GetEntry("payment1"); !found || !entry.Tombstone {
+		t.Errorf("Expected a tombstone for 'payment1', got %+v (found=%v)", entry, found)
+	}
+}
+
+// TestMemtableRangeDeleteOrder verifies that a range delete hides the
+// records put before it, within a batch too, but not those put after it,
+// including where ranges overlap.
+func TestMemtableRangeDeleteOrder(t *testing.T) {
+	memtable := storage.NewMemtable(storage.DefaultMemtableOptions(), nil)
+
+	memtable.Set("a", "1")
+	memtable.Set("m", "1")
+	memtable.ApplyBatch(
+		storage.WALRecord{Key: "b", Entry: storage.Entry{Value: "1"}},
+		storage.WALRecord{Key: "a", Entry: storage.Entry{Tombstone: true}, End: "c"},
+		storage.WALRecord{Key: "a", Entry: storage.Entry{Value: "2"}},
+	)
+	memtable.Set("k", "2")
+	memtable.DeleteRange("j", "n")
+	memtable.Set("l", "3")
+	memtable.DeleteRange("b", "k")
+
+	want := map[string]string{"a": "2", "l": "3"}
+	for _, key := range []string{"a", "b", "k", "l", "m"} {
+		value, exists := memtable.Get(key)
+		if expected, live := want[key]; exists != live || value != expected {
+			t.Errorf("Get(%q): expected %q (exists=%v), got %q (exists=%v)", key, expected, live, value, exists)
+		}
+	}
+
+	it := storage.NewMergingIterator(memtable.Iterators()...)
+	defer it.Close()
+	got := map[string]string{}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		got[it.Key()] = it.Value()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v from an iterator, got %v", want, got)
+	}
 }
 
 // TestMemtableGetRange tests the GetRange function for proper range querying.
 func TestMemtableGetRange(t *testing.T) {
-	memtable := storage.NewMemtable(1000, nil)
+	memtable := storage.NewMemtable(storage.DefaultMemtableOptions(), nil)
 
 	memtable.Set("paymentA", "approved")
 	memtable.Set("paymentB", "declined")
@@ -54,47 +99,181 @@ func TestMemtableGetRange(t *testing.T) {
 
 // flushRecorder is a helper type to record flush events.
 type flushRecorder struct {
-	called bool
-	data   map[string]string
+	mu      sync.Mutex
+	called  bool
+	data    map[string]string
+	seq     uint64
+	flushed chan struct{}
+}
+
+func newFlushRecorder() *flushRecorder {
+	return &flushRecorder{flushed: make(chan struct{}, 16)}
 }
 
-func (fr *flushRecorder) flush(data map[string]string) {
+func (fr *flushRecorder) flush(it *storage.MemtableIterator, seq uint64) error {
+	fr.mu.Lock()
 	fr.called = true
+	fr.seq = seq
 	fr.data = make(map[string]string)
-	for k, v := range data {
-		fr.data[k] = v
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		fr.data[it.Key()] = it.Entry().Value
+	}
+	fr.mu.Unlock()
+	fr.flushed <- struct{}{}
+	return nil
+}
+
+// wait blocks until the background flush goroutine has called flush.
+func (fr *flushRecorder) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-fr.flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a flush")
 	}
 }
 
 // TestMemtableAutoFlush verifies that the Memtable flushes when the maximum capacity is reached.
 func TestMemtableAutoFlush(t *testing.T) {
-	recorder := &flushRecorder{}
-	memtable := storage.NewMemtable(3, recorder.flush)
+	recorder := newFlushRecorder()
+	memtable := storage.NewMemtable(storage.MemtableOptions{MaxBytes: 2500}, recorder.flush)
+	defer memtable.Close()
 
-	memtable.Set("txn1", "approved")
-	memtable.Set("txn2", "declined")
-	memtable.Set("txn3", "pending") // This should trigger auto-flush.
+	approved := strings.Repeat("approved", 125)
+	declined := strings.Repeat("declined", 125)
+	pending := strings.Repeat("pending", 143)
+	memtable.Set("txn1", approved)
+	memtable.Set("txn2", declined)
+	if stats := memtable.Stats(); stats.Immutables != 0 || stats.Flushes != 0 {
+		t.Fatalf("Expected no flush below the byte limit, got %+v", stats)
+	}
+	memtable.Set("txn3", pending) // This should trigger auto-flush.
 
+	recorder.wait(t)
+	memtable.Flush()
 	if size := memtable.Size(); size != 0 {
 		t.Errorf("Expected memtable to be empty after flush, got size %d", size)
 	}
 
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
 	if !recorder.called {
 		t.Error("Expected flush function to be called")
 	}
 	expectedData := map[string]string{
-		"txn1": "approved",
-		"txn2": "declined",
-		"txn3": "pending",
+		"txn1": approved,
+		"txn2": declined,
+		"txn3": pending,
 	}
 	if !reflect.DeepEqual(recorder.data, expectedData) {
 		t.Errorf("Expected flushed data %v, got %v", expectedData, recorder.data)
 	}
 }
 
+// TestMemtableBackgroundFlush verifies that full memtables stay readable
+// while they are flushed off the write path, and that writes stall only once
+// too many of them are waiting.
+func TestMemtableBackgroundFlush(t *testing.T) {
+	release := make(chan struct{})
+	opts := storage.MemtableOptions{MaxBytes: 1, MaxImmutables: 3} // Every write fills a memtable
+	memtable := storage.NewMemtable(opts, func(it *storage.MemtableIterator, seq uint64) error {
+		<-release
+		return nil
+	})
+	defer memtable.Close()
+
+	// Fill MaxImmutables memtables without blocking.
+	for i := 0; i < opts.MaxImmutables; i++ {
+		memtable.Set(fmt.Sprintf("key%02d", i), "value")
+	}
+	if stats := memtable.Stats(); stats.Immutables != opts.MaxImmutables || stats.Stalls != 0 {
+		t.Fatalf("Expected %d immutables and no stalls, got %+v", opts.MaxImmutables, stats)
+	}
+	if value, ok := memtable.Get("key00"); !ok || value != "value" {
+		t.Errorf("Expected frozen records to stay readable, got %q (ok=%v)", value, ok)
+	}
+	if n := len(memtable.GetRange("key00", "key99")); n != opts.MaxImmutables {
+		t.Errorf("Expected range to cover frozen records, got %d", n)
+	}
+
+	// The queue is full: the next write stalls until a flush completes.
+	written := make(chan struct{})
+	go func() {
+		memtable.Set("stalled", "value")
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("Expected the write to stall while the immutable queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the stalled write to proceed after a flush")
+	}
+	memtable.Flush()
+	if stats := memtable.Stats(); stats.Stalls != 1 || stats.Immutables != 0 {
+		t.Errorf("Expected one stall and an empty queue, got %+v", stats)
+	}
+}
+
+// TestMemtableFlushRetry verifies that a failed flush keeps the immutable
+// queued and readable, is retried with the same WAL position, and that
+// Close gives up on a flush that keeps failing.
+func TestMemtableFlushRetry(t *testing.T) {
+	var mu sync.Mutex
+	var seqs []uint64
+	fail := 2
+	opts := storage.MemtableOptions{MaxBytes: 1, FlushRetryDelay: time.Millisecond}
+	memtable := storage.NewMemtable(opts, func(it *storage.MemtableIterator, seq uint64) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seqs = append(seqs, seq)
+		if fail > 0 {
+			fail--
+			return errors.New("disk full")
+		}
+		return nil
+	})
+
+	memtable.Apply(7, "txn1", storage.Entry{Value: "approved"})
+	if value, ok := memtable.Get("txn1"); !ok || value != "approved" {
+		t.Errorf("Expected the record to stay readable while its flush fails, got %q (ok=%v)", value, ok)
+	}
+	memtable.Flush()
+	stats := memtable.Stats()
+	if stats.Flushes != 1 || stats.FlushErrors != 2 || stats.Immutables != 0 {
+		t.Errorf("Expected one flush after two failures, got %+v", stats)
+	}
+	mu.Lock()
+	if !reflect.DeepEqual(seqs, []uint64{7, 7, 7}) {
+		t.Errorf("Expected the same WAL position on every attempt, got %v", seqs)
+	}
+	mu.Unlock()
+	memtable.Close()
+
+	failing := storage.NewMemtable(opts, func(it *storage.MemtableIterator, seq uint64) error {
+		return errors.New("disk full")
+	})
+	failing.Set("txn2", "declined")
+	closed := make(chan struct{})
+	go func() {
+		failing.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Close to give up on a flush that keeps failing")
+	}
+}
+
 // TestMemtableConcurrency tests concurrent access to the Memtable.
 func TestMemtableConcurrency(t *testing.T) {
-	memtable := storage.NewMemtable(1000, nil)
+	memtable := storage.NewMemtable(storage.DefaultMemtableOptions(), nil)
 	var wg sync.WaitGroup
 
 	for i := 0; i < 1000; i++ {
@@ -117,3 +296,63 @@ func TestMemtableConcurrency(t *testing.T) {
 
 	wg.Wait()
 }
+
+// TestMemtableIterator verifies that records are walked in key order from a seek.
+func TestMemtableIterator(t *testing.T) {
+	memtable := storage.NewMemtable(storage.DefaultMemtableOptions(), nil)
+	for _, i := range rand.Perm(200) {
+		memtable.Set(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i))
+	}
+	memtable.Delete("key150")
+
+	it := memtable.NewIterator()
+	var keys []string
+	for it.Seek("key100"); it.Valid() && it.Key() < "key160"; it.Next() {
+		keys = append(keys, it.Key())
+		if it.Key() == "key150" && !it.Entry().Tombstone {
+			t.Errorf("Expected a tombstone at key150, got %+v", it.Entry())
+		}
+	}
+	if len(keys) != 60 || !sort.StringsAreSorted(keys) || keys[0] != "key100" {
+		t.Errorf("Expected keys key100..key159 in order, got %v", keys)
+	}
+
+	it.Seek("key1995")
+	if it.Valid() {
+		t.Errorf("Expected seek past the last key to be exhausted, got %q", it.Key())
+	}
+}
+
+// TestMemtableScanDuringWrites runs range scans concurrently with writers and
+// checks that every scan sees sorted, complete prefixes of the data.
+func TestMemtableScanDuringWrites(t *testing.T) {
+	memtable := storage.NewMemtable(storage.DefaultMemtableOptions(), nil)
+	for i := 0; i < 1000; i += 2 {
+		memtable.Set(fmt.Sprintf("key%04d", i), "even")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 1000; i += 2 {
+			memtable.Set(fmt.Sprintf("key%04d", i), "odd")
+		}
+	}()
+
+	for n := 0; n < 50; n++ {
+		var keys []string
+		it := memtable.NewIterator()
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if !sort.StringsAreSorted(keys) || len(keys) < 500 {
+			t.Fatalf("Expected a sorted scan of at least 500 keys, got %d (sorted=%v)", len(keys), sort.StringsAreSorted(keys))
+		}
+	}
+	wg.Wait()
+
+	if size := memtable.Size(); size != 1000 {
+		t.Errorf("Expected 1000 keys after concurrent writes, got %d", size)
+	}
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+)
+
+var ErrInvalidRange = errors.New("invalid range")
+
+// RangeTombstone records that every key in [Start, End) was deleted. Like a
+// point tombstone it is kept in the WAL, the Memtable and SSTables, where it
+// hides the keys of older sources: the immutables and files behind the one
+// holding it. In a Memtable it also hides the records put before it, by
+// sequence (see rangeFragments); those are left out when the Memtable is
+// flushed, so in an SSTable every record is newer than the file's ranges.
+type RangeTombstone struct {
+	Start string
+	End   string // Exclusive
+}
+
+// Contains reports whether key is in the deleted range.
+func (t RangeTombstone) Contains(key string) bool {
+	return key >= t.Start && key < t.End
+}
+
+// overlaps reports whether the range may hold keys in [minKey, maxKey]. For
+// key bounds the end counts as part of the range, so the bounds of a file
+// never end exactly where the next one starts.
+func (t RangeTombstone) overlaps(minKey, maxKey string) bool {
+	return t.Start <= maxKey && t.End >= minKey
+}
+
+// rangeSet is the union of the range tombstones of one source, as sorted,
+// disjoint ranges: within a source they all have the same effect, so
+// overlapping ones can be merged, and a lookup is one binary search.
+type rangeSet []RangeTombstone
+
+// add returns the set with t merged in, leaving s unmodified so it can be
+// shared with readers.
+func (s rangeSet) add(t RangeTombstone) rangeSet {
+	i := sort.Search(len(s), func(i int) bool { return s[i].End >= t.Start })
+	j := i
+	for ; j < len(s) && s[j].Start <= t.End; j++ {
+		t.Start, t.End = min(t.Start, s[j].Start), max(t.End, s[j].End)
+	}
+
+	merged := make(rangeSet, 0, len(s)-(j-i)+1)
+	merged = append(merged, s[:i]...)
+	merged = append(merged, t)
+	return append(merged, s[j:]...)
+}
+
+// covering returns the range that contains key, if any.
+func (s rangeSet) covering(key string) (RangeTombstone, bool) {
+	i := sort.Search(len(s), func(i int) bool { return s[i].End > key })
+	if i < len(s) && s[i].Start <= key {
+		return s[i], true
+	}
+	return RangeTombstone{}, false
+}
+
+// bytes approximates the memory held by the set.
+func (s rangeSet) bytes() int64 {
+	var n int64
+	for _, t := range s {
+		n += int64(len(t.Start) + len(t.End) + 32)
+	}
+	return n
+}
+
+// rangeFragments are the range tombstones of a skiplist as sorted, disjoint
+// fragments, each with the sequence number of the newest range delete over
+// it. Unlike a rangeSet, overlapping ranges are not merged, as a record of
+// the list is only hidden by the ranges deleted after it was put.
+type rangeFragments []rangeFragment
+
+type rangeFragment struct {
+	RangeTombstone
+	seq uint64
+}
+
+// add returns the fragments with t, deleted at seq, laid over them. seq must
+// be newer than any fragment's, so t replaces whatever it overlaps. f is
+// left unmodified so it can be shared with readers.
+func (f rangeFragments) add(t RangeTombstone, seq uint64) rangeFragments {
+	i := sort.Search(len(f), func(i int) bool { return f[i].End > t.Start })
+	j := i
+	for j < len(f) && f[j].Start < t.End {
+		j++
+	}
+
+	split := make(rangeFragments, 0, len(f)-(j-i)+3)
+	split = append(split, f[:i]...)
+	if i < j && f[i].Start < t.Start {
+		left := f[i]
+		left.End = t.Start
+		split = append(split, left)
+	}
+	split = append(split, rangeFragment{t, seq})
+	if i < j && f[j-1].End > t.End {
+		right := f[j-1]
+		right.Start = t.End
+		split = append(split, right)
+	}
+	return append(split, f[j:]...)
+}
+
+// deletes reports whether a record of key put at seq was deleted by a later
+// range.
+func (f rangeFragments) deletes(key string, seq uint64) bool {
+	i := sort.Search(len(f), func(i int) bool { return f[i].End > key })
+	return i < len(f) && f[i].Start <= key && f[i].seq > seq
+}
+
+// rangeDeleter is implemented by iterators over a source that may hold
+// range tombstones; a MergingIterator uses it to hide the keys of older
+// sources.
+type rangeDeleter interface {
+	// coveringTombstone returns the source's range tombstone that contains
+	// key, if any.
+	coveringTombstone(key string) (RangeTombstone, bool)
+}
@@ -0,0 +1,363 @@
+package storage
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	skiplistMaxHeight = 12
+	skiplistBranching = 4 // Each level holds about 1/4 of the nodes of the level below
+
+	// skipNodeOverhead approximates the memory of a node besides its key
+	// and value: the struct, the entry and the tower of next pointers.
+	skipNodeOverhead = 96
+)
+
+// skiplist is an ordered map from keys to records. Inserts must be
+// serialized by the caller, but readers need no lock: nodes are never
+// removed and links are published with atomic stores, so a reader sees each
+// node either fully linked at a level or not at all.
+//
+// Records are put in batches that readers see all at once: until commit,
+// a key put in the pending batch shows the record it had before, and a new
+// key is skipped. Range tombstones are kept beside the nodes and published
+// the same way. Every put and range delete takes the next sequence number,
+// so that a range hides the records put before it, and only those.
+type skiplist struct {
+	head      *skipNode
+	height    atomic.Int32
+	length    atomic.Int64               // Keys and range deletes
+	bytes     atomic.Int64               // Keys, values, ranges and node overhead
+	committed atomic.Uint64              // Number of the last batch readers may see
+	staged    []*skipNode                // Nodes put in the pending batch; writer only
+	seq       uint64                     // Sequence number of the last put or range delete; writer only
+	ranges    atomic.Pointer[skipRanges] // Range tombstones; nil if none
+	rnd       *rand.Rand                 // Used by the (single) writer only
+}
+
+type skipNode struct {
+	key   string
+	entry atomic.Pointer[skipEntry]
+	next  []atomic.Pointer[skipNode]
+}
+
+// skipEntry is a record and the batch and sequence number that put it.
+type skipEntry struct {
+	Entry
+	batch uint64
+	seq   uint64
+	prev  *skipEntry // The committed record it replaces, while its batch is pending
+}
+
+// skipRanges is the set of range tombstones and the batch that last changed
+// it. fragments hold the same ranges, with the sequence numbers that decide
+// which records of the list they hide.
+type skipRanges struct {
+	set       rangeSet
+	fragments rangeFragments
+	batch     uint64
+	prev      *skipRanges // The committed set, while its batch is pending
+}
+
+func newSkiplist() *skiplist {
+	s := &skiplist{
+		head: &skipNode{next: make([]atomic.Pointer[skipNode], skiplistMaxHeight)},
+		rnd:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.height.Store(1)
+	return s
+}
+
+// Put inserts key or replaces its record in the pending batch, which
+// readers do not see until commit. A key put twice in a batch keeps the
+// second record.
+func (s *skiplist) Put(key string, entry Entry) {
+	s.seq++
+	pending := &skipEntry{Entry: entry, batch: s.committed.Load() + 1, seq: s.seq}
+	var prev [skiplistMaxHeight]*skipNode
+	if node := s.seek(key, prev[:]); node != nil && node.key == key {
+		old := node.entry.Load()
+		if pending.prev = old; old.batch == pending.batch {
+			pending.prev = old.prev
+		} else {
+			s.staged = append(s.staged, node)
+		}
+		node.entry.Store(pending)
+		s.bytes.Add(int64(len(entry.Value) - len(old.Value)))
+		return
+	}
+
+	height := s.randomHeight()
+	if current := int(s.height.Load()); height > current {
+		for i := current; i < height; i++ {
+			prev[i] = s.head
+		}
+		// Readers that see the new height before the links below simply
+		// find nil at the new levels and descend.
+		s.height.Store(int32(height))
+	}
+
+	node := &skipNode{key: key, next: make([]atomic.Pointer[skipNode], height)}
+	node.entry.Store(pending)
+	for i := 0; i < height; i++ {
+		node.next[i].Store(prev[i].next[i].Load())
+		prev[i].next[i].Store(node)
+	}
+	s.length.Add(1)
+	s.bytes.Add(int64(len(key) + len(entry.Value) + skipNodeOverhead))
+}
+
+// DeleteRange records a range tombstone in the pending batch, hiding the
+// keys in [t.Start, t.End) of older sources and the records the list already
+// holds, however many there are. Records put later are not hidden.
+func (s *skiplist) DeleteRange(t RangeTombstone) {
+	s.seq++
+	pending := &skipRanges{batch: s.committed.Load() + 1}
+	old := s.ranges.Load()
+	if pending.prev = old; old != nil && old.batch == pending.batch {
+		pending.prev = old.prev
+	}
+	if old != nil {
+		pending.set, pending.fragments = old.set, old.fragments
+	}
+	pending.set = pending.set.add(t)
+	pending.fragments = pending.fragments.add(t, s.seq)
+	s.ranges.Store(pending)
+	s.length.Add(1)
+	s.bytes.Add(int64(len(t.Start) + len(t.End) + skipNodeOverhead))
+}
+
+// commit makes the pending batch visible to readers, then lets go of the
+// records it replaced.
+func (s *skiplist) commit() {
+	batch := s.committed.Add(1)
+	for _, node := range s.staged {
+		entry := node.entry.Load()
+		node.entry.Store(&skipEntry{Entry: entry.Entry, batch: batch, seq: entry.seq})
+	}
+	clear(s.staged)
+	s.staged = s.staged[:0]
+	if r := s.ranges.Load(); r != nil && r.prev != nil && r.batch == batch {
+		s.ranges.Store(&skipRanges{set: r.set, fragments: r.fragments, batch: batch})
+	}
+}
+
+// visibleAt returns the set readers see once batch committed is, or nil if
+// none. committed must be loaded after r, as commit replaces r with a set
+// that has no prev.
+func (r *skipRanges) visibleAt(committed uint64) *skipRanges {
+	if r != nil && r.batch > committed {
+		return r.prev
+	}
+	return r
+}
+
+// rangeTombstones returns the range tombstones readers see.
+func (s *skiplist) rangeTombstones() rangeSet {
+	if r := s.ranges.Load().visibleAt(s.committed.Load()); r != nil {
+		return r.set
+	}
+	return nil
+}
+
+// rangeDeletedEntry stands in for a record hidden by a later range delete
+// of its list. Readers share it and must not modify it.
+var rangeDeletedEntry = &skipEntry{Entry: Entry{Tombstone: true}}
+
+// visible returns the record readers see for node, rangeDeletedEntry if a
+// later range delete hides it, or nil if its key only exists in the pending
+// batch. The record and the ranges are loaded before the committed batch,
+// which commit bumps before replacing them.
+func (s *skiplist) visible(node *skipNode) *skipEntry {
+	entry, ranges := node.entry.Load(), s.ranges.Load()
+	committed := s.committed.Load()
+	if entry.batch > committed {
+		entry = entry.prev
+	}
+	if entry == nil {
+		return nil
+	}
+	if r := ranges.visibleAt(committed); r != nil && r.fragments.deletes(node.key, entry.seq) {
+		return rangeDeletedEntry
+	}
+	return entry
+}
+
+// Get returns the record held for key, a tombstone if a range delete hides
+// it.
+func (s *skiplist) Get(key string) (Entry, bool) {
+	node := s.seek(key, nil)
+	if node == nil || node.key != key {
+		return Entry{}, false
+	}
+	entry := s.visible(node)
+	if entry == nil {
+		return Entry{}, false
+	}
+	return entry.Entry, true
+}
+
+// Len returns the number of keys and range deletes in the list.
+func (s *skiplist) Len() int {
+	return int(s.length.Load())
+}
+
+// Bytes returns the approximate memory held by the list.
+func (s *skiplist) Bytes() int64 {
+	return s.bytes.Load()
+}
+
+// seek returns the first node with a key >= key, or nil. If prev is not nil
+// it receives the last node before that position at every level.
+func (s *skiplist) seek(key string, prev []*skipNode) *skipNode {
+	node := s.head
+	level := int(s.height.Load()) - 1
+	for {
+		next := node.next[level].Load()
+		if next != nil && next.key < key {
+			node = next
+			continue
+		}
+		if prev != nil {
+			prev[level] = node
+		}
+		if level == 0 {
+			return next
+		}
+		level--
+	}
+}
+
+func (s *skiplist) randomHeight() int {
+	height := 1
+	for height < skiplistMaxHeight && s.rnd.Intn(skiplistBranching) == 0 {
+		height++
+	}
+	return height
+}
+
+// findLessThan returns the last node with a key < key, or nil.
+func (s *skiplist) findLessThan(key string) *skipNode {
+	node := s.head
+	for level := int(s.height.Load()) - 1; level >= 0; level-- {
+		for next := node.next[level].Load(); next != nil && next.key < key; next = node.next[level].Load() {
+			node = next
+		}
+	}
+	if node == s.head {
+		return nil
+	}
+	return node
+}
+
+// findLast returns the node with the largest key, or nil.
+func (s *skiplist) findLast() *skipNode {
+	node := s.head
+	for level := int(s.height.Load()) - 1; level >= 0; level-- {
+		for next := node.next[level].Load(); next != nil; next = node.next[level].Load() {
+			node = next
+		}
+	}
+	if node == s.head {
+		return nil
+	}
+	return node
+}
+
+// MemtableIterator walks a Memtable's records, tombstones included, in key
+// order, and implements Iterator. It reads without locking and may observe
+// records inserted after it was created, but never those of a batch that
+// is not committed. Nodes only link forward, so Prev searches from the
+// head.
+type MemtableIterator struct {
+	list  *skiplist
+	node  *skipNode
+	entry *skipEntry // The record of node seen when the iterator reached it
+}
+
+// SeekToFirst positions the iterator at the smallest key.
+func (it *MemtableIterator) SeekToFirst() {
+	it.node = it.list.head.next[0].Load()
+	it.skipForward()
+}
+
+// SeekToLast positions the iterator at the largest key.
+func (it *MemtableIterator) SeekToLast() {
+	it.node = it.list.findLast()
+	it.skipBackward()
+}
+
+// Seek positions the iterator at the first key >= key.
+func (it *MemtableIterator) Seek(key string) {
+	it.node = it.list.seek(key, nil)
+	it.skipForward()
+}
+
+// Valid reports whether the iterator is positioned at a record.
+func (it *MemtableIterator) Valid() bool {
+	return it.node != nil
+}
+
+// Next advances to the next key.
+func (it *MemtableIterator) Next() {
+	it.node = it.node.next[0].Load()
+	it.skipForward()
+}
+
+// Prev moves back to the previous key.
+func (it *MemtableIterator) Prev() {
+	it.node = it.list.findLessThan(it.node.key)
+	it.skipBackward()
+}
+
+// skipForward steps over keys that only exist in a pending batch.
+func (it *MemtableIterator) skipForward() {
+	for ; it.node != nil; it.node = it.node.next[0].Load() {
+		if it.entry = it.list.visible(it.node); it.entry != nil {
+			return
+		}
+	}
+}
+
+// skipBackward is skipForward in reverse.
+func (it *MemtableIterator) skipBackward() {
+	for ; it.node != nil; it.node = it.list.findLessThan(it.node.key) {
+		if it.entry = it.list.visible(it.node); it.entry != nil {
+			return
+		}
+	}
+}
+
+// Key returns the current key.
+func (it *MemtableIterator) Key() string {
+	return it.node.key
+}
+
+// Value returns the current value, empty for a tombstone.
+func (it *MemtableIterator) Value() string {
+	return it.entry.Value
+}
+
+// Entry returns the current record.
+func (it *MemtableIterator) Entry() Entry {
+	return it.entry.Entry
+}
+
+// coveringTombstone returns the range tombstone of the list that contains
+// key, if any.
+func (it *MemtableIterator) coveringTombstone(key string) (RangeTombstone, bool) {
+	return it.list.rangeTombstones().covering(key)
+}
+
+// Err always returns nil: reading memory cannot fail.
+func (it *MemtableIterator) Err() error {
+	return nil
+}
+
+// Close does nothing; the skiplist stays alive while it is referenced.
+func (it *MemtableIterator) Close() error {
+	it.node, it.entry = nil, nil
+	return nil
+}
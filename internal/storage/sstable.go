@@ -1,220 +1,916 @@
 package storage
 
 import (
-	"bufio"
-	"encoding/json"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sort"
-	"strconv"
-	"strings"
-	"sync"
+	"sync/atomic"
 )
 
-var ErrKeyNotFound = errors.New("key not found")
+// SSTable file layout (all integers little-endian, lengths as uvarints):
+//
+//	[data block 0] ... [data block N-1] [end-of-data marker]
+//	[range block]  range tombstones: count, then start and end of each
+//	[filter block] Bloom filter over all keys (empty when disabled)
+//	[index block]  one entry per data block: last key, offset, length
+//	[meta block]   entry count, min key, max key, tombstone count, raw and stored data size, range tombstone count
+//	[footer]       filter, index, meta and range offset/length, CRC32, magic (76 bytes)
+//
+// Every block ends with a CRC32 (Castagnoli) of its contents, verified on
+// each read, and the footer carries one of its own.
+//
+// Data blocks hold key-sorted entries encoded as keyLen|key|kind|valueLen|value,
+// where kind is one byte: a value or a tombstone (with an empty value). Each
+// data block is compressed on its own and followed by one byte naming the
+// Codec that wrote it. Data blocks start with their 4-byte length, and an
+// empty one marks the end of the data, so the data can be scanned without
+// the index to rebuild it (see RepairSSTable). The range block is framed the
+// same way, uncompressed, so the scan can pick it up after the marker. The
+// key bounds in the meta block cover the range tombstones too, counting
+// their ends as part of them.
+// Files are written once by SSTableWriter, to a temporary file renamed into
+// place, and never modified afterwards.
+
+var (
+	ErrKeyNotFound     = errors.New("key not found")
+	ErrCorruption      = errors.New("data corruption")
+	ErrInvalidSSTable  = fmt.Errorf("%w: invalid sstable file", ErrCorruption)
+	ErrKeysOutOfOrder  = errors.New("sstable keys must be added in strictly ascending order")
+	ErrSSTableFinished = errors.New("sstable writer already finished")
+)
+
+var sstableCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	SSTableBlockSize = 4 * 1024 // Target size of a data block before it is cut
+
+	sstableMagic        uint64 = 0x6b7673737462_0007 // "kvsstb" + format version
+	sstableFooterSize          = 8*8 + 4 + 8
+	blockTrailerSize           = 4 // CRC32 of the block
+	dataBlockHeaderSize        = 4 // Length of a data block's contents
+
+	entryKindValue     byte = 1
+	entryKindTombstone byte = 2
+)
+
+// SSTableOptions controls how new SSTable files are built.
+type SSTableOptions struct {
+	BlockSize       int    // Target size of a data block in bytes
+	BloomBitsPerKey int    // Bloom filter bits per key; 0 disables the filter
+	Compression     string // Name of the Codec new data blocks are compressed with
+}
+
+// DefaultSSTableOptions returns the options used when none are configured.
+func DefaultSSTableOptions() SSTableOptions {
+	return SSTableOptions{
+		BlockSize:       SSTableBlockSize,
+		BloomBitsPerKey: DefaultBloomBitsPerKey,
+		Compression:     CompressionFlate,
+	}
+}
+
+// blockHandle locates a block inside an SSTable file.
+type blockHandle struct {
+	offset uint64
+	length uint64
+}
+
+// indexEntry maps the last key of a data block to its location.
+type indexEntry struct {
+	lastKey string
+	handle  blockHandle
+}
+
+// SSTableMeta describes the contents of an SSTable file.
+type SSTableMeta struct {
+	EntryCount          uint64 // Values and tombstones
+	MinKey              string // Smallest key or range tombstone start
+	MaxKey              string // Largest key or range tombstone end
+	TombstoneCount      uint64
+	RawDataBytes        uint64 // Data blocks before compression
+	DataBytes           uint64 // Data blocks as stored, trailers included
+	RangeTombstoneCount uint64
+}
 
-// SSTable represents a persistent key-value store with an index for fast lookups.
+// SSTable is a read-only handle to an immutable, sorted, block-based table file.
+// The metadata is loaded into memory on open, and so are the sparse block
+// index and Bloom filter unless a BlockCache holds them instead; data blocks
+// are read on demand, through the BlockCache when there is one.
+//
+// Any number of goroutines may read a table at once without locking: nothing
+// is modified after open, and data blocks are read with positional ReadAt
+// calls, which share no file offset.
 type SSTable struct {
-	file       *os.File
-	indexPath  string
-	mu         sync.RWMutex
-	index      map[string]int64
-	bufferedRd *bufio.Reader // Buffered Reader for faster reads
-	writeBuf   *bufio.Writer // Buffered Writer to batch writes
+	path   string
+	file   *os.File
+	closed atomic.Bool
+	refs   atomic.Int32 // Owner and open iterators; the last release closes the file
+	gone   atomic.Bool  // Replaced by compaction: remove the file once released
+	cache  *BlockCache  // Optional
+	id     uint64       // Identifies the table's blocks in the cache
+	pinned bool         // index and filter are held here rather than in the cache
+	index  []indexEntry
+	filter *BloomFilter
+	meta   SSTableMeta
+	ranges rangeSet // Range tombstones, always held in memory
+
+	indexHandle  blockHandle
+	filterHandle blockHandle
 }
 
-// NewSSTable initializes an SSTable with buffered I/O
+// NewSSTable opens the SSTable at filePath. A missing file is created as an
+// empty table so a fresh data directory can be opened like an existing one.
 func NewSSTable(filePath string) (*SSTable, error) {
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		if err := WriteSSTable(filePath, nil, DefaultSSTableOptions()); err != nil {
+			return nil, err
+		}
+	}
+	return openSSTable(filePath, nil)
+}
+
+// openSSTable reads the footer, index and metadata of an existing file whose
+// blocks are to be cached in cache, which may be nil.
+func openSSTable(filePath string, cache *BlockCache) (*SSTable, error) {
+	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
 	}
 
 	s := &SSTable{
-		file:       file,
-		indexPath:  filePath + ".index",
-		index:      make(map[string]int64),
-		bufferedRd: bufio.NewReader(file),
-		writeBuf:   bufio.NewWriter(file),
+		path:   filePath,
+		file:   file,
+		cache:  cache,
+		pinned: cache == nil || cache.opts.PinIndexAndFilter,
 	}
-
-	if err := s.loadIndex(); err != nil {
-		return nil, err
+	s.refs.Store(1)
+	if cache != nil {
+		s.id = cache.newFileID()
+	}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", filePath, err)
 	}
-
 	return s, nil
 }
 
-// Write with Immediate Flush & Sync
-func (s *SSTable) Write(key, value string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	offset, err := s.file.Seek(0, os.SEEK_END)
+// load parses the footer and the meta block it points to, and the filter and
+// index blocks when they are pinned.
+func (s *SSTable) load() error {
+	info, err := s.file.Stat()
 	if err != nil {
 		return err
 	}
+	if info.Size() < sstableFooterSize {
+		return ErrInvalidSSTable
+	}
 
-	entry := map[string]string{"key": key, "value": value}
-	jsonData, err := json.Marshal(entry)
-	if err != nil {
+	footer := make([]byte, sstableFooterSize)
+	if _, err := s.file.ReadAt(footer, info.Size()-sstableFooterSize); err != nil {
 		return err
 	}
+	if binary.LittleEndian.Uint64(footer[68:]) != sstableMagic {
+		return fmt.Errorf("%w: bad magic number", ErrInvalidSSTable)
+	}
+	if crc32.Checksum(footer[:64], sstableCRCTable) != binary.LittleEndian.Uint32(footer[64:]) {
+		return fmt.Errorf("%w: footer checksum mismatch", ErrCorruption)
+	}
+	s.filterHandle = blockHandle{
+		offset: binary.LittleEndian.Uint64(footer[0:]),
+		length: binary.LittleEndian.Uint64(footer[8:]),
+	}
+	s.indexHandle = blockHandle{
+		offset: binary.LittleEndian.Uint64(footer[16:]),
+		length: binary.LittleEndian.Uint64(footer[24:]),
+	}
+	metaHandle := blockHandle{
+		offset: binary.LittleEndian.Uint64(footer[32:]),
+		length: binary.LittleEndian.Uint64(footer[40:]),
+	}
+	rangeHandle := blockHandle{
+		offset: binary.LittleEndian.Uint64(footer[48:]),
+		length: binary.LittleEndian.Uint64(footer[56:]),
+	}
 
-	_, err = s.writeBuf.Write(append(jsonData, '\n'))
-	if err != nil {
+	if s.pinned {
+		filterBlock, err := s.readBlock(s.filterHandle)
+		if err != nil {
+			return err
+		}
+		s.filter = decodeBloomFilter(filterBlock)
+
+		indexBlock, err := s.readBlock(s.indexHandle)
+		if err != nil {
+			return err
+		}
+		if s.index, err = decodeIndexBlock(indexBlock); err != nil {
+			return err
+		}
+	}
+
+	if s.ranges, err = s.readRangeBlock(rangeHandle); err != nil {
 		return err
 	}
 
-	err = s.writeBuf.Flush()
+	metaBlock, err := s.readBlock(metaHandle)
 	if err != nil {
 		return err
 	}
+	s.meta, err = decodeMetaBlock(metaBlock)
+	return err
+}
+
+// readBlock reads a block and verifies its checksum, returning its contents
+// without the trailer.
+func (s *SSTable) readBlock(h blockHandle) ([]byte, error) {
+	if h.length < blockTrailerSize {
+		return nil, fmt.Errorf("%w: %s: block at offset %d is too short", ErrCorruption, s.path, h.offset)
+	}
+	buf := make([]byte, h.length)
+	if _, err := s.file.ReadAt(buf, int64(h.offset)); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: %s: block at offset %d is truncated", ErrCorruption, s.path, h.offset)
+		}
+		return nil, err
+	}
 
-	err = s.file.Sync()
+	data := buf[:len(buf)-blockTrailerSize]
+	if crc32.Checksum(data, sstableCRCTable) != binary.LittleEndian.Uint32(buf[len(data):]) {
+		return nil, fmt.Errorf("%w: %s: block at offset %d: checksum mismatch", ErrCorruption, s.path, h.offset)
+	}
+	return data, nil
+}
+
+// readDataBlock reads and decompresses a data block.
+func (s *SSTable) readDataBlock(h blockHandle) ([]byte, error) {
+	data, err := s.readBlock(h)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(data) < dataBlockHeaderSize || binary.LittleEndian.Uint32(data) != uint32(len(data)-dataBlockHeaderSize) {
+		return nil, fmt.Errorf("%w: %s: block at offset %d: bad length", ErrCorruption, s.path, h.offset)
 	}
+	return decompressBlock(data[dataBlockHeaderSize:])
+}
 
-	s.index[key] = offset
-	return nil
+// readRangeBlock reads and decodes the range block.
+func (s *SSTable) readRangeBlock(h blockHandle) (rangeSet, error) {
+	data, err := s.readBlock(h)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < dataBlockHeaderSize || binary.LittleEndian.Uint32(data) != uint32(len(data)-dataBlockHeaderSize) {
+		return nil, fmt.Errorf("%w: %s: range block at offset %d: bad length", ErrCorruption, s.path, h.offset)
+	}
+	return decodeRangeBlock(data[dataBlockHeaderSize:])
 }
 
-// Read using Buffered Reader
-func (s *SSTable) Read(key string) (string, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// dataBlock returns a decompressed data block, from the block cache when
+// possible.
+func (s *SSTable) dataBlock(h blockHandle) ([]byte, error) {
+	if s.cache == nil {
+		return s.readDataBlock(h)
+	}
+	block, err := s.cache.getOrLoad(s.id, h.offset, func() (any, int64, error) {
+		data, err := s.readDataBlock(h)
+		return data, int64(len(data)), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return block.([]byte), nil
+}
 
-	offset, exists := s.index[key]
-	if !exists {
-		return "", ErrKeyNotFound
+// blockIndex returns the sparse block index, held in memory when pinned and
+// in the block cache otherwise.
+func (s *SSTable) blockIndex() ([]indexEntry, error) {
+	if s.pinned {
+		return s.index, nil
+	}
+	index, err := s.cache.getOrLoad(s.id, s.indexHandle.offset, func() (any, int64, error) {
+		data, err := s.readBlock(s.indexHandle)
+		if err != nil {
+			return nil, 0, err
+		}
+		index, err := decodeIndexBlock(data)
+		return index, indexSize(index), err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return index.([]indexEntry), nil
+}
 
-	_, err := s.file.Seek(offset, os.SEEK_SET)
+// bloomFilter returns the Bloom filter, held in memory when pinned and in
+// the block cache otherwise.
+func (s *SSTable) bloomFilter() (*BloomFilter, error) {
+	if s.pinned {
+		return s.filter, nil
+	}
+	filter, err := s.cache.getOrLoad(s.id, s.filterHandle.offset, func() (any, int64, error) {
+		data, err := s.readBlock(s.filterHandle)
+		if err != nil {
+			return nil, 0, err
+		}
+		filter := decodeBloomFilter(data)
+		return filter, int64(len(data)), nil
+	})
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	return filter.(*BloomFilter), nil
+}
+
+// Path returns the location of the table file.
+func (s *SSTable) Path() string {
+	return s.path
+}
+
+// Meta returns the entry count and key bounds of the table.
+func (s *SSTable) Meta() SSTableMeta {
+	return s.meta
+}
+
+// RangeTombstones returns the table's range tombstones, sorted and disjoint.
+func (s *SSTable) RangeTombstones() []RangeTombstone {
+	return s.ranges
+}
+
+// IndexBytes approximates the memory held by the table's pinned index and
+// Bloom filter, and its range tombstones; unpinned indexes and filters are
+// charged to the block cache instead.
+func (s *SSTable) IndexBytes() int64 {
+	size := indexSize(s.index) + s.ranges.bytes()
+	if s.filter != nil {
+		size += int64(len(s.filter.bits))
 	}
+	return size
+}
 
-	s.bufferedRd = bufio.NewReader(s.file)
+// indexSize approximates the memory held by a decoded block index.
+func indexSize(index []indexEntry) int64 {
+	var size int64
+	for _, e := range index {
+		size += int64(len(e.lastKey)) + 40 // String header and block handle
+	}
+	return size
+}
 
-	line, err := s.bufferedRd.ReadString('\n') // Buffered Read
+// Read looks up a single key. A key whose newest record in this table is a
+// tombstone is reported as ErrKeyNotFound.
+func (s *SSTable) Read(key string) (string, error) {
+	entry, err := s.Get(key)
 	if err != nil {
 		return "", err
 	}
+	if entry.Tombstone {
+		return "", ErrKeyNotFound
+	}
+	return entry.Value, nil
+}
 
-	var entry map[string]string
-	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &entry); err != nil {
-		return "", err
+// Get returns the record stored for key, which may be a tombstone; the
+// table's range tombstones are not consulted, as a record in the same table
+// is newer than them (see RangeTombstone). Keys outside the table's key
+// range or rejected by its Bloom filter are answered without touching the
+// disk; otherwise it is one binary search over the in-memory index and one
+// data block read.
+func (s *SSTable) Get(key string) (Entry, error) {
+	if s.closed.Load() {
+		return Entry{}, os.ErrClosed
+	}
+	if !s.MayContain(key) {
+		return Entry{}, ErrKeyNotFound
 	}
 
-	return entry["value"], nil
-}
+	index, err := s.blockIndex()
+	if err != nil {
+		return Entry{}, err
+	}
+	i := findBlock(index, key)
+	if i >= len(index) {
+		return Entry{}, ErrKeyNotFound
+	}
 
-// ReadRange with Binary Search
-func (s *SSTable) ReadRange(startKey, endKey string) (map[string]string, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	block, err := s.dataBlock(index[i].handle)
+	if err != nil {
+		return Entry{}, err
+	}
 
-	results := make(map[string]string)
-	keys := make([]string, 0, len(s.index))
+	it := newBlockIterator(block)
+	for it.next() {
+		if it.key == key {
+			return it.entry, nil
+		}
+		if it.key > key {
+			break
+		}
+	}
+	if it.err != nil {
+		return Entry{}, it.err
+	}
+	return Entry{}, ErrKeyNotFound
+}
 
-	for k := range s.index {
-		keys = append(keys, k)
+// MayContain checks the key bounds and Bloom filter without any disk access.
+// A false result means the key is definitely not in the table. An unpinned
+// filter that cannot be read is treated as a match, leaving the error to the
+// read that follows.
+func (s *SSTable) MayContain(key string) bool {
+	if s.meta.EntryCount == 0 || key < s.meta.MinKey || key > s.meta.MaxKey {
+		return false
 	}
-	sort.Strings(keys)
+	filter, err := s.bloomFilter()
+	return err != nil || filter.MayContain(key)
+}
 
-	// binary search to find start and end positions
-	startIdx := sort.SearchStrings(keys, startKey)
-	endIdx := sort.SearchStrings(keys, endKey)
+// findBlock returns the position in index of the first block whose last key
+// is >= key.
+func findBlock(index []indexEntry, key string) int {
+	return sort.Search(len(index), func(i int) bool {
+		return index[i].lastKey >= key
+	})
+}
 
-	if startIdx >= len(keys) || endIdx >= len(keys) || startIdx > endIdx {
-		return nil, nil
+// ReadRange returns all live keys in [startKey, endKey], reading only the
+// blocks that overlap the range.
+func (s *SSTable) ReadRange(startKey, endKey string) (map[string]string, error) {
+	entries, err := s.GetRange(startKey, endKey)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, key := range keys[startIdx : endIdx+1] {
-		value, err := s.Read(key)
-		if err == nil {
-			results[key] = value
+	results := make(map[string]string, len(entries))
+	for key, entry := range entries {
+		if !entry.Tombstone {
+			results[key] = entry.Value
 		}
 	}
+	return results, nil
+}
 
+// GetRange returns every record in [startKey, endKey], tombstones included,
+// so that callers merging several tables can let them shadow older values.
+func (s *SSTable) GetRange(startKey, endKey string) (map[string]Entry, error) {
+	results := make(map[string]Entry)
+	err := s.scan(startKey, func(key string, entry Entry) bool {
+		if key > endKey {
+			return false
+		}
+		results[key] = entry
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
 	return results, nil
 }
 
-// Delete Function (No Deadlock)
-func (s *SSTable) Delete(key string) error {
-	s.mu.Lock()
-	_, exists := s.index[key]
-	if !exists {
-		s.mu.Unlock()
-		return ErrKeyNotFound
+// scan calls fn for every entry with key >= startKey in ascending key order
+// until fn returns false.
+func (s *SSTable) scan(startKey string, fn func(key string, entry Entry) bool) error {
+	if s.closed.Load() {
+		return os.ErrClosed
 	}
 
-	delete(s.index, key)
-	s.mu.Unlock()
+	index, err := s.blockIndex()
+	if err != nil {
+		return err
+	}
+	for i := findBlock(index, startKey); i < len(index); i++ {
+		block, err := s.dataBlock(index[i].handle)
+		if err != nil {
+			return err
+		}
+
+		it := newBlockIterator(block)
+		for it.next() {
+			if it.key < startKey {
+				continue
+			}
+			if !fn(it.key, it.entry) {
+				return nil
+			}
+		}
+		if it.err != nil {
+			return it.err
+		}
+	}
+	return nil
+}
 
-	return s.saveIndex()
+// Verify reads every block of the table, checking checksums and decoding
+// every entry, and returns the first problem found.
+func (s *SSTable) Verify() error {
+	if s.closed.Load() {
+		return os.ErrClosed
+	}
+	if _, err := s.readBlock(s.filterHandle); err != nil {
+		return err
+	}
+	it := s.newTableIterator()
+	for it.next() {
+	}
+	return it.err
 }
 
-// Save index to disk safely
-func (s *SSTable) saveIndex() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// sampleEntries calls fn for every entry of up to maxBlocks data blocks spread
+// evenly across the table, used to estimate statistics without a full scan.
+func (s *SSTable) sampleEntries(maxBlocks int, fn func(key string, entry Entry)) error {
+	if s.closed.Load() {
+		return os.ErrClosed
+	}
 
-	file, err := os.Create(s.indexPath)
+	index, err := s.blockIndex()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	step := 1
+	if len(index) > maxBlocks {
+		step = len(index) / maxBlocks
+	}
 
-	writer := bufio.NewWriter(file)
-	for key, offset := range s.index {
-		_, err := writer.WriteString(fmt.Sprintf("%s:%d\n", key, offset))
+	for i := 0; i < len(index); i += step {
+		block, err := s.readDataBlock(index[i].handle)
 		if err != nil {
 			return err
 		}
+		it := newBlockIterator(block)
+		for it.next() {
+			fn(it.key, it.entry)
+		}
+		if it.err != nil {
+			return it.err
+		}
 	}
-	return writer.Flush()
+	return nil
 }
 
-// Load index from disk on startup
-func (s *SSTable) loadIndex() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// sstableIterator walks a table's records, tombstones included, in either
+// direction, one decoded data block at a time. It holds a reference to the
+// table, so compaction may replace the table while it is in use.
+type sstableIterator struct {
+	table   *SSTable
+	index   []indexEntry
+	block   int // Position in index of the decoded block
+	entries []blockEntry
+	pos     int // Position in entries; out of range when not Valid
+	err     error
+	closed  bool
+}
 
-	file, err := os.Open(s.indexPath)
-	if os.IsNotExist(err) {
-		return nil // No index file yet
-	} else if err != nil {
-		return err
+// blockEntry is a decoded record of a data block.
+type blockEntry struct {
+	key   string
+	entry Entry
+}
+
+// NewIterator returns an unpositioned iterator over the table's records,
+// which also reports its range tombstones to a MergingIterator. It must be
+// closed.
+func (s *SSTable) NewIterator() Iterator {
+	s.acquire()
+	it := &sstableIterator{table: s, pos: -1}
+	it.index, it.err = s.blockIndex()
+	return it
+}
+
+// load decodes the data block at position i of the index, leaving the
+// iterator unpositioned; it returns false if there is no such block or it
+// cannot be read.
+func (it *sstableIterator) load(i int) bool {
+	it.entries, it.pos = it.entries[:0], -1
+	if it.err != nil || i < 0 || i >= len(it.index) {
+		return false
+	}
+	data, err := it.table.dataBlock(it.index[i].handle)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	block := newBlockIterator(data)
+	for block.next() {
+		it.entries = append(it.entries, blockEntry{key: block.key, entry: block.entry})
+	}
+	if block.err != nil {
+		it.err = block.err
+		return false
+	}
+	it.block = i
+	return true
+}
+
+func (it *sstableIterator) Seek(key string) {
+	if it.load(findBlock(it.index, key)) {
+		it.pos = sort.Search(len(it.entries), func(i int) bool { return it.entries[i].key >= key })
 	}
-	defer file.Close()
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		parts := strings.Split(scanner.Text(), ":")
-		if len(parts) != 2 {
-			continue
+func (it *sstableIterator) SeekToFirst() {
+	if it.load(0) {
+		it.pos = 0
+	}
+}
+
+func (it *sstableIterator) SeekToLast() {
+	if it.load(len(it.index) - 1) {
+		it.pos = len(it.entries) - 1
+	}
+}
+
+func (it *sstableIterator) Valid() bool {
+	return it.err == nil && it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *sstableIterator) Next() {
+	if it.pos++; it.pos >= len(it.entries) && it.load(it.block+1) {
+		it.pos = 0
+	}
+}
+
+func (it *sstableIterator) Prev() {
+	if it.pos--; it.pos < 0 && it.load(it.block-1) {
+		it.pos = len(it.entries) - 1
+	}
+}
+
+func (it *sstableIterator) Key() string   { return it.entries[it.pos].key }
+func (it *sstableIterator) Value() string { return it.entries[it.pos].entry.Value }
+func (it *sstableIterator) Entry() Entry  { return it.entries[it.pos].entry }
+func (it *sstableIterator) Err() error    { return it.err }
+
+func (it *sstableIterator) coveringTombstone(key string) (RangeTombstone, bool) {
+	return it.table.ranges.covering(key)
+}
+
+// Close releases the iterator's reference to the table.
+func (it *sstableIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.entries, it.pos = nil, -1
+	return it.table.release()
+}
+
+// tableIterator walks every entry of a table in key order, reading one data
+// block at a time. It is used by compaction, so blocks are read past the
+// block cache rather than evicting hot ones; the table must stay open for
+// the lifetime of the iterator.
+type tableIterator struct {
+	table    *SSTable
+	index    []indexEntry
+	blockIdx int
+	block    *blockIterator
+	key      string
+	entry    Entry
+	err      error
+}
+
+func (s *SSTable) newTableIterator() *tableIterator {
+	it := &tableIterator{table: s}
+	it.index, it.err = s.blockIndex()
+	return it
+}
+
+// next advances to the following entry, returning false when the table is
+// exhausted or a read fails (reported through it.err).
+func (it *tableIterator) next() bool {
+	for it.err == nil {
+		if it.block != nil && it.block.next() {
+			it.key, it.entry = it.block.key, it.block.entry
+			return true
+		}
+		if it.block != nil && it.block.err != nil {
+			it.err = it.block.err
+			return false
 		}
-		offset, err := strconv.ParseInt(parts[1], 10, 64)
+		if it.blockIdx >= len(it.index) {
+			return false
+		}
+
+		data, err := it.table.readDataBlock(it.index[it.blockIdx].handle)
 		if err != nil {
-			continue
+			it.err = err
+			return false
 		}
-		s.index[parts[0]] = offset
+		it.block = newBlockIterator(data)
+		it.blockIdx++
+	}
+	return false
+}
+
+// acquire adds a reference that keeps the file open, e.g. for an iterator
+// that outlives the lock under which it found the table.
+func (s *SSTable) acquire() {
+	s.refs.Add(1)
+}
+
+// release drops a reference. The last one closes the file, and deletes it
+// if compaction has replaced it.
+func (s *SSTable) release() error {
+	if s.refs.Add(-1) > 0 {
+		return nil
 	}
+	err := s.Close()
+	if s.gone.Load() {
+		os.Remove(s.path)
+	}
+	return err
+}
 
-	return scanner.Err()
+// retire drops the owner's reference to a file replaced by compaction; it
+// is deleted once open iterators are done with it.
+func (s *SSTable) retire() {
+	s.gone.Store(true)
+	s.release()
 }
 
+// Close releases the file and drops its cached blocks, whatever references
+// remain. Reads still in flight fail with os.ErrClosed rather than racing
+// with it; later reads are refused up front.
 func (s *SSTable) Close() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if !s.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	if s.cache != nil {
+		s.cache.evictFile(s.id)
+	}
+	return s.file.Close()
+}
 
-	if s.file != nil {
-		err := s.file.Close()
-		s.file = nil
-		return err
+// blockIterator walks the entries of a decoded data block in order.
+type blockIterator struct {
+	data  []byte
+	key   string
+	entry Entry
+	err   error
+}
+
+func newBlockIterator(data []byte) *blockIterator {
+	return &blockIterator{data: data}
+}
+
+// next advances to the following entry, returning false at the end of the
+// block or on a decoding error (reported through it.err).
+func (it *blockIterator) next() bool {
+	if len(it.data) == 0 || it.err != nil {
+		return false
 	}
-	return nil
+
+	key, rest, err := readLengthPrefixed(it.data)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if len(rest) == 0 || (rest[0] != entryKindValue && rest[0] != entryKindTombstone) {
+		it.err = fmt.Errorf("%w: bad entry kind", ErrInvalidSSTable)
+		return false
+	}
+	kind := rest[0]
+	value, rest, err := readLengthPrefixed(rest[1:])
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.key, it.data = string(key), rest
+	it.entry = Entry{Value: string(value), Tombstone: kind == entryKindTombstone}
+	return true
+}
+
+// appendLengthPrefixed appends a uvarint length followed by b.
+func appendLengthPrefixed(dst []byte, b string) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+// readLengthPrefixed decodes a uvarint length and the bytes that follow it.
+func readLengthPrefixed(src []byte) ([]byte, []byte, error) {
+	n, size := binary.Uvarint(src)
+	if size <= 0 || uint64(len(src)-size) < n {
+		return nil, nil, fmt.Errorf("%w: malformed length prefix", ErrInvalidSSTable)
+	}
+	src = src[size:]
+	return src[:n], src[n:], nil
+}
+
+// readUvarint decodes a single uvarint.
+func readUvarint(src []byte) (uint64, []byte, error) {
+	v, size := binary.Uvarint(src)
+	if size <= 0 {
+		return 0, nil, fmt.Errorf("%w: malformed varint", ErrInvalidSSTable)
+	}
+	return v, src[size:], nil
+}
+
+func encodeIndexBlock(index []indexEntry) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(index)))
+	for _, e := range index {
+		buf = appendLengthPrefixed(buf, e.lastKey)
+		buf = binary.AppendUvarint(buf, e.handle.offset)
+		buf = binary.AppendUvarint(buf, e.handle.length)
+	}
+	return buf
+}
+
+func decodeIndexBlock(data []byte) ([]indexEntry, error) {
+	count, data, err := readUvarint(data)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make([]indexEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var e indexEntry
+		var key []byte
+		if key, data, err = readLengthPrefixed(data); err != nil {
+			return nil, err
+		}
+		e.lastKey = string(key)
+		if e.handle.offset, data, err = readUvarint(data); err != nil {
+			return nil, err
+		}
+		if e.handle.length, data, err = readUvarint(data); err != nil {
+			return nil, err
+		}
+		index = append(index, e)
+	}
+	return index, nil
+}
+
+func encodeMetaBlock(meta SSTableMeta) []byte {
+	buf := binary.AppendUvarint(nil, meta.EntryCount)
+	buf = appendLengthPrefixed(buf, meta.MinKey)
+	buf = appendLengthPrefixed(buf, meta.MaxKey)
+	buf = binary.AppendUvarint(buf, meta.TombstoneCount)
+	buf = binary.AppendUvarint(buf, meta.RawDataBytes)
+	buf = binary.AppendUvarint(buf, meta.DataBytes)
+	return binary.AppendUvarint(buf, meta.RangeTombstoneCount)
+}
+
+func decodeMetaBlock(data []byte) (SSTableMeta, error) {
+	var meta SSTableMeta
+	var key []byte
+	var err error
+
+	if meta.EntryCount, data, err = readUvarint(data); err != nil {
+		return meta, err
+	}
+	if key, data, err = readLengthPrefixed(data); err != nil {
+		return meta, err
+	}
+	meta.MinKey = string(key)
+	if key, data, err = readLengthPrefixed(data); err != nil {
+		return meta, err
+	}
+	meta.MaxKey = string(key)
+	if meta.TombstoneCount, data, err = readUvarint(data); err != nil {
+		return meta, err
+	}
+	if meta.RawDataBytes, data, err = readUvarint(data); err != nil {
+		return meta, err
+	}
+	if meta.DataBytes, data, err = readUvarint(data); err != nil {
+		return meta, err
+	}
+	meta.RangeTombstoneCount, _, err = readUvarint(data)
+	return meta, err
+}
+
+func encodeRangeBlock(ranges rangeSet) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(ranges)))
+	for _, t := range ranges {
+		buf = appendLengthPrefixed(buf, t.Start)
+		buf = appendLengthPrefixed(buf, t.End)
+	}
+	return buf
+}
+
+func decodeRangeBlock(data []byte) (rangeSet, error) {
+	count, data, err := readUvarint(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges rangeSet
+	for i := uint64(0); i < count; i++ {
+		var start, end []byte
+		if start, data, err = readLengthPrefixed(data); err != nil {
+			return nil, err
+		}
+		if end, data, err = readLengthPrefixed(data); err != nil {
+			return nil, err
+		}
+		t := RangeTombstone{Start: string(start), End: string(end)}
+		if t.Start >= t.End || (len(ranges) > 0 && t.Start <= ranges[len(ranges)-1].End) {
+			return nil, fmt.Errorf("%w: range tombstones out of order", ErrInvalidSSTable)
+		}
+		ranges = append(ranges, t)
+	}
+	return ranges, nil
 }
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// RepairSSTable rebuilds the index, Bloom filter, metadata and footer of the
+// table at filePath from its data blocks, for when they are missing or
+// damaged. Data blocks are scanned in file order up to the end-of-data
+// marker, then the range block that follows it, each checked against its
+// checksum, and their entries are written with opts to a new file that
+// atomically replaces the old one.
+//
+// A damaged data or range block cannot be repaired: the error wraps
+// ErrCorruption and the file is left as it was.
+func RepairSSTable(filePath string, opts SSTableOptions) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	s := &SSTable{path: filePath, file: file}
+
+	writer, err := NewSSTableWriter(filePath, opts)
+	if err != nil {
+		return err
+	}
+	if err := s.copyData(writer, uint64(info.Size())); err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Finish()
+}
+
+// copyData adds every entry of the data blocks to writer, stopping at the
+// end-of-data marker, and then the range tombstones of the block after it.
+func (s *SSTable) copyData(writer *SSTableWriter, size uint64) error {
+	var offset uint64
+	for {
+		h, err := s.framedBlock(offset, size)
+		if err != nil {
+			return err
+		}
+		offset += h.length
+
+		if h.length == dataBlockHeaderSize+blockTrailerSize {
+			if _, err := s.readBlock(h); err != nil { // The end-of-data marker
+				return err
+			}
+			return s.copyRanges(writer, offset, size)
+		}
+		block, err := s.readDataBlock(h)
+		if err != nil {
+			return err
+		}
+		it := newBlockIterator(block)
+		for it.next() {
+			if err := writer.AddEntry(it.key, it.entry); err != nil {
+				return fmt.Errorf("%w: %s: block at offset %d: %v", ErrCorruption, s.path, h.offset, err)
+			}
+		}
+		if it.err != nil {
+			return it.err
+		}
+	}
+}
+
+// copyRanges adds the range tombstones of the range block at offset to
+// writer.
+func (s *SSTable) copyRanges(writer *SSTableWriter, offset, size uint64) error {
+	h, err := s.framedBlock(offset, size)
+	if err != nil {
+		return err
+	}
+	ranges, err := s.readRangeBlock(h)
+	if err != nil {
+		return err
+	}
+	for _, t := range ranges {
+		if err := writer.AddRangeTombstone(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// framedBlock locates the block at offset from the length it starts with.
+func (s *SSTable) framedBlock(offset, size uint64) (blockHandle, error) {
+	if offset+dataBlockHeaderSize+blockTrailerSize > size {
+		return blockHandle{}, fmt.Errorf("%w: %s: data ends at offset %d without an end-of-data marker", ErrCorruption, s.path, offset)
+	}
+	header := make([]byte, dataBlockHeaderSize)
+	if _, err := s.file.ReadAt(header, int64(offset)); err != nil {
+		return blockHandle{}, err
+	}
+	h := blockHandle{
+		offset: offset,
+		length: dataBlockHeaderSize + uint64(binary.LittleEndian.Uint32(header)) + blockTrailerSize,
+	}
+	if h.offset+h.length > size {
+		return blockHandle{}, fmt.Errorf("%w: %s: block at offset %d runs past the end of the file", ErrCorruption, s.path, offset)
+	}
+	return h, nil
+}
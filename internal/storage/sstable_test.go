@@ -1,31 +1,34 @@
 package storage_test
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"sync"
 	"testing"
 
 	"moniepoint/internal/storage"
 )
 
-// cleanup removes the test SSTable file and its associated index file.
+// cleanup removes the test SSTable file.
 func cleanup(filePath string) {
 	os.Remove(filePath)
-	os.Remove(filePath + ".index")
 }
 
 func TestSSTable_WriteAndRead(t *testing.T) {
 	filePath := "test_sstable.db"
 	defer cleanup(filePath)
 
-	sstable, err := storage.NewSSTable(filePath)
+	err := storage.WriteSSTable(filePath, map[string]string{"txn123": "status:approved"}, storage.DefaultSSTableOptions())
 	if err != nil {
-		t.Fatalf("Failed to initialize SSTable: %v", err)
+		t.Fatalf("Failed to write SSTable: %v", err)
 	}
 
-	err = sstable.Write("txn123", "status:approved")
+	sstable, err := storage.NewSSTable(filePath)
 	if err != nil {
-		t.Fatalf("Failed to write to SSTable: %v", err)
+		t.Fatalf("Failed to initialize SSTable: %v", err)
 	}
+	defer sstable.Close()
 
 	value, err := sstable.Read("txn123")
 	if err != nil || value != "status:approved" {
@@ -33,26 +36,251 @@ func TestSSTable_WriteAndRead(t *testing.T) {
 	}
 }
 
-func TestSSTable_Delete(t *testing.T) {
+// TestSSTable_Tombstone verifies that tombstones are stored in the file and
+// hide the key from reads.
+func TestSSTable_Tombstone(t *testing.T) {
 	filePath := "test_sstable.db"
 	defer cleanup(filePath)
 
+	writer, err := storage.NewSSTableWriter(filePath, storage.DefaultSSTableOptions())
+	if err != nil {
+		t.Fatalf("Failed to create SSTable writer: %v", err)
+	}
+	if err := writer.Add("txn456", "status:approved"); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := writer.AddEntry("txn789", storage.Entry{Tombstone: true}); err != nil {
+		t.Fatalf("AddEntry failed: %v", err)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
 	sstable, err := storage.NewSSTable(filePath)
 	if err != nil {
 		t.Fatalf("Failed to initialize SSTable: %v", err)
 	}
+	defer sstable.Close()
+
+	if _, err := sstable.Read("txn789"); err != storage.ErrKeyNotFound {
+		t.Errorf("Expected key 'txn789' to be deleted, got %v", err)
+	}
+	if entry, err := sstable.Get("txn789"); err != nil || !entry.Tombstone {
+		t.Errorf("Expected a tombstone for 'txn789', got %+v (err=%v)", entry, err)
+	}
+	if meta := sstable.Meta(); meta.EntryCount != 2 || meta.TombstoneCount != 1 {
+		t.Errorf("Unexpected metadata: %+v", meta)
+	}
+
+	results, err := sstable.ReadRange("txn000", "txn999")
+	if err != nil {
+		t.Fatalf("ReadRange failed: %v", err)
+	}
+	if len(results) != 1 || results["txn456"] != "status:approved" {
+		t.Errorf("Expected only the live key in range, got %v", results)
+	}
+}
+
+// TestSSTable_MultiBlock writes enough entries to span many data blocks and
+// checks point lookups, misses between keys and the metadata footer.
+func TestSSTable_MultiBlock(t *testing.T) {
+	filePath := "test_sstable.db"
+	defer cleanup(filePath)
+
+	writer, err := storage.NewSSTableWriter(filePath, storage.DefaultSSTableOptions())
+	if err != nil {
+		t.Fatalf("Failed to create SSTable writer: %v", err)
+	}
+	numEntries := 5000
+	for i := 0; i < numEntries; i++ {
+		if err := writer.Add(fmt.Sprintf("key_%06d", i*2), fmt.Sprintf("value_%d", i)); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	sstable, err := storage.NewSSTable(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer sstable.Close()
+
+	meta := sstable.Meta()
+	if meta.EntryCount != uint64(numEntries) || meta.MinKey != "key_000000" || meta.MaxKey != fmt.Sprintf("key_%06d", (numEntries-1)*2) {
+		t.Errorf("Unexpected metadata: %+v", meta)
+	}
+
+	for _, i := range []int{0, 1, 777, 2500, numEntries - 1} {
+		value, err := sstable.Read(fmt.Sprintf("key_%06d", i*2))
+		if err != nil || value != fmt.Sprintf("value_%d", i) {
+			t.Errorf("Expected 'value_%d', got '%s' (err=%v)", i, value, err)
+		}
+		if _, err := sstable.Read(fmt.Sprintf("key_%06d", i*2+1)); err != storage.ErrKeyNotFound {
+			t.Errorf("Expected ErrKeyNotFound for odd key %d, got %v", i*2+1, err)
+		}
+	}
+}
+
+func TestSSTable_RejectsUnsortedKeys(t *testing.T) {
+	filePath := "test_sstable.db"
+	defer cleanup(filePath)
+
+	writer, err := storage.NewSSTableWriter(filePath, storage.DefaultSSTableOptions())
+	if err != nil {
+		t.Fatalf("Failed to create SSTable writer: %v", err)
+	}
+	defer writer.Abort()
 
-	sstable.Write("txn789", "status:pending")
+	if err := writer.Add("b", "1"); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := writer.Add("a", "2"); !errors.Is(err, storage.ErrKeysOutOfOrder) {
+		t.Errorf("Expected ErrKeysOutOfOrder, got %v", err)
+	}
+	if err := writer.Add("b", "3"); !errors.Is(err, storage.ErrKeysOutOfOrder) {
+		t.Errorf("Expected ErrKeysOutOfOrder for duplicate key, got %v", err)
+	}
+}
 
-	value, err := sstable.Read("txn789")
-	if err != nil || value != "status:pending" {
-		t.Fatalf("Expected 'status:pending', got '%s'", value)
+func TestSSTable_ReadRange(t *testing.T) {
+	filePath := "test_sstable.db"
+	defer cleanup(filePath)
+
+	data := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		data[fmt.Sprintf("txn%04d", i)] = fmt.Sprintf("v%d", i)
+	}
+	if err := storage.WriteSSTable(filePath, data, storage.DefaultSSTableOptions()); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
 	}
 
-	sstable.Delete("txn789")
+	sstable, err := storage.NewSSTable(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer sstable.Close()
+
+	results, err := sstable.ReadRange("txn0100", "txn0199")
+	if err != nil {
+		t.Fatalf("ReadRange failed: %v", err)
+	}
+	if len(results) != 100 {
+		t.Fatalf("Expected 100 results, got %d", len(results))
+	}
+	for i := 100; i < 200; i++ {
+		key := fmt.Sprintf("txn%04d", i)
+		if results[key] != data[key] {
+			t.Errorf("Expected %s=%s, got '%s'", key, data[key], results[key])
+		}
+	}
+}
+
+func TestSSTable_RejectsInvalidFile(t *testing.T) {
+	filePath := "test_sstable.db"
+	defer cleanup(filePath)
 
-	_, err = sstable.Read("txn789")
-	if err != storage.ErrKeyNotFound {
-		t.Errorf("Expected key 'txn789' to be deleted, but found it")
+	if err := os.WriteFile(filePath, []byte(`{"key":"a","value":"b"}`+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := storage.NewSSTable(filePath); !errors.Is(err, storage.ErrInvalidSSTable) {
+		t.Errorf("Expected ErrInvalidSSTable, got %v", err)
+	}
+}
+
+// TestSSTable_ConcurrentReaders hammers one table from many goroutines with
+// point and range reads; run with -race to check that the lock-free read
+// path shares no mutable state. Closing the table mid-read must only make
+// reads fail with os.ErrClosed.
+func TestSSTable_ConcurrentReaders(t *testing.T) {
+	filePath := "test_sstable.db"
+	defer cleanup(filePath)
+
+	data := make(map[string]string)
+	for i := 0; i < 5000; i++ {
+		data[fmt.Sprintf("key_%06d", i)] = fmt.Sprintf("value_%d", i)
+	}
+	if err := storage.WriteSSTable(filePath, data, storage.DefaultSSTableOptions()); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+
+	sstable, err := storage.NewSSTable(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer sstable.Close()
+
+	read := func(g, i int) error {
+		n := (g*7919 + i*31) % 5000
+		key := fmt.Sprintf("key_%06d", n)
+		if i%10 == 0 {
+			end := fmt.Sprintf("key_%06d", n+20)
+			results, err := sstable.ReadRange(key, end)
+			if err != nil {
+				return err
+			}
+			for k, v := range results {
+				if k < key || k > end || data[k] != v {
+					return fmt.Errorf("range [%s, %s]: unexpected %s=%s", key, end, k, v)
+				}
+			}
+			return nil
+		}
+		value, err := sstable.Read(key)
+		if err != nil {
+			return err
+		}
+		if value != data[key] {
+			return fmt.Errorf("expected %s=%s, got %s", key, data[key], value)
+		}
+		return nil
+	}
+
+	numReaders := 64
+	var wg sync.WaitGroup
+	errs := make(chan error, numReaders)
+	for g := 0; g < numReaders; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				if err := read(g, i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Concurrent read failed: %v", err)
+	}
+
+	// Close while readers are still running.
+	start := make(chan struct{})
+	errs = make(chan error, numReaders)
+	for g := 0; g < numReaders; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			<-start
+			for i := 0; i < 500; i++ {
+				if err := read(g, i); err != nil {
+					if !errors.Is(err, os.ErrClosed) {
+						errs <- err
+					}
+					return
+				}
+			}
+		}(g)
+	}
+	close(start)
+	sstable.Close()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Expected reads after Close to fail with os.ErrClosed, got %v", err)
 	}
 }
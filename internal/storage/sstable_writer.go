@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const sstableTempExt = ".tmp" // Suffix of files still being written
+
+// SSTableWriter builds an SSTable file in a single pass. Keys must be added in
+// strictly ascending order; Finish writes the filter, index, metadata and
+// footer, syncs the file to disk and only then moves it into place, so a
+// crash never leaves a file whose index is missing or partial.
+type SSTableWriter struct {
+	path      string
+	file      *os.File // Temporary file renamed to path by Finish
+	writer    *bufio.Writer
+	opts      SSTableOptions
+	codec     Codec
+	offset    uint64
+	block     []byte
+	encoded   []byte // Reused buffer for the compressed block
+	index     []indexEntry
+	keyHashes []uint64 // Bloom filter input, one hash per key
+	ranges    rangeSet
+	meta      SSTableMeta
+	lastKey   string
+	finished  bool
+}
+
+// NewSSTableWriter starts a file that replaces filePath when finished.
+func NewSSTableWriter(filePath string, opts SSTableOptions) (*SSTableWriter, error) {
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = SSTableBlockSize
+	}
+	codec, err := CodecByName(opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filePath+sstableTempExt, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SSTableWriter{
+		path:   filePath,
+		file:   file,
+		writer: bufio.NewWriterSize(file, BufferSize),
+		opts:   opts,
+		codec:  codec,
+		block:  make([]byte, 0, opts.BlockSize),
+	}, nil
+}
+
+// Add appends a value. Keys must be strictly greater than the previous key.
+func (sw *SSTableWriter) Add(key, value string) error {
+	return sw.AddEntry(key, Entry{Value: value})
+}
+
+// AddEntry appends a value or a tombstone. Keys must be strictly greater than
+// the previous key.
+func (sw *SSTableWriter) AddEntry(key string, entry Entry) error {
+	if sw.finished {
+		return ErrSSTableFinished
+	}
+	if sw.meta.EntryCount > 0 && key <= sw.lastKey {
+		return ErrKeysOutOfOrder
+	}
+
+	if sw.meta.EntryCount == 0 {
+		sw.meta.MinKey = key
+	}
+	sw.meta.MaxKey = key
+	sw.meta.EntryCount++
+	sw.lastKey = key
+
+	sw.block = appendLengthPrefixed(sw.block, key)
+	if entry.Tombstone {
+		sw.meta.TombstoneCount++
+		sw.block = append(sw.block, entryKindTombstone)
+		sw.block = appendLengthPrefixed(sw.block, "")
+	} else {
+		sw.block = append(sw.block, entryKindValue)
+		sw.block = appendLengthPrefixed(sw.block, entry.Value)
+	}
+	if sw.opts.BloomBitsPerKey > 0 {
+		sw.keyHashes = append(sw.keyHashes, bloomHash(key))
+	}
+
+	if len(sw.block) >= sw.opts.BlockSize {
+		return sw.flushBlock()
+	}
+	return nil
+}
+
+// AddRangeTombstone records the deletion of [t.Start, t.End), hiding the
+// keys of older tables; the table's own entries stay visible. Range
+// tombstones may be added in any order, before, between or after entries,
+// and overlapping ones are merged.
+func (sw *SSTableWriter) AddRangeTombstone(t RangeTombstone) error {
+	if sw.finished {
+		return ErrSSTableFinished
+	}
+	if t.Start >= t.End {
+		return fmt.Errorf("%w: [%q, %q)", ErrInvalidRange, t.Start, t.End)
+	}
+	sw.ranges = sw.ranges.add(t)
+	return nil
+}
+
+// flushBlock compresses and writes the pending data block and records it in
+// the index.
+func (sw *SSTableWriter) flushBlock() error {
+	if len(sw.block) == 0 {
+		return nil
+	}
+
+	encoded, err := compressBlock(append(sw.encoded[:0], 0, 0, 0, 0), sw.codec, sw.block)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(encoded, uint32(len(encoded)-dataBlockHeaderSize))
+	sw.encoded = encoded
+	handle, err := sw.writeBlock(encoded)
+	if err != nil {
+		return err
+	}
+	sw.meta.RawDataBytes += uint64(len(sw.block))
+	sw.meta.DataBytes += handle.length
+	sw.index = append(sw.index, indexEntry{lastKey: sw.lastKey, handle: handle})
+	sw.block = sw.block[:0]
+	return nil
+}
+
+// writeBlock appends b and its checksum to the file and returns their
+// location. b may be modified.
+func (sw *SSTableWriter) writeBlock(b []byte) (blockHandle, error) {
+	b = binary.LittleEndian.AppendUint32(b, crc32.Checksum(b, sstableCRCTable))
+	return sw.writeRaw(b)
+}
+
+// writeRaw appends b to the file and returns its location.
+func (sw *SSTableWriter) writeRaw(b []byte) (blockHandle, error) {
+	handle := blockHandle{offset: sw.offset, length: uint64(len(b))}
+	if _, err := sw.writer.Write(b); err != nil {
+		return handle, err
+	}
+	sw.offset += uint64(len(b))
+	return handle, nil
+}
+
+// Finish writes the remaining block, the end-of-data marker, the filter,
+// index, metadata and footer, then syncs and closes the file and renames it
+// into place. On error the temporary file is removed.
+func (sw *SSTableWriter) Finish() error {
+	if sw.finished {
+		return ErrSSTableFinished
+	}
+	sw.finished = true
+
+	err := sw.finish()
+	if err != nil {
+		sw.file.Close()
+		os.Remove(sw.file.Name())
+	}
+	return err
+}
+
+// finish does the work of Finish.
+func (sw *SSTableWriter) finish() error {
+	if err := sw.flushBlock(); err != nil {
+		return err
+	}
+	if _, err := sw.writeBlock(make([]byte, dataBlockHeaderSize)); err != nil {
+		return err
+	}
+	rangeBlock := append(make([]byte, dataBlockHeaderSize), encodeRangeBlock(sw.ranges)...)
+	binary.LittleEndian.PutUint32(rangeBlock, uint32(len(rangeBlock)-dataBlockHeaderSize))
+	rangeHandle, err := sw.writeBlock(rangeBlock)
+	if err != nil {
+		return err
+	}
+	sw.addRangeBounds()
+
+	var filterBlock []byte
+	if sw.opts.BloomBitsPerKey > 0 && len(sw.keyHashes) > 0 {
+		filterBlock = NewBloomFilter(sw.keyHashes, sw.opts.BloomBitsPerKey).Encode()
+	}
+	filterHandle, err := sw.writeBlock(filterBlock)
+	if err != nil {
+		return err
+	}
+	indexHandle, err := sw.writeBlock(encodeIndexBlock(sw.index))
+	if err != nil {
+		return err
+	}
+	metaHandle, err := sw.writeBlock(encodeMetaBlock(sw.meta))
+	if err != nil {
+		return err
+	}
+
+	footer := make([]byte, sstableFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:], filterHandle.offset)
+	binary.LittleEndian.PutUint64(footer[8:], filterHandle.length)
+	binary.LittleEndian.PutUint64(footer[16:], indexHandle.offset)
+	binary.LittleEndian.PutUint64(footer[24:], indexHandle.length)
+	binary.LittleEndian.PutUint64(footer[32:], metaHandle.offset)
+	binary.LittleEndian.PutUint64(footer[40:], metaHandle.length)
+	binary.LittleEndian.PutUint64(footer[48:], rangeHandle.offset)
+	binary.LittleEndian.PutUint64(footer[56:], rangeHandle.length)
+	binary.LittleEndian.PutUint32(footer[64:], crc32.Checksum(footer[:64], sstableCRCTable))
+	binary.LittleEndian.PutUint64(footer[68:], sstableMagic)
+	if _, err := sw.writeRaw(footer); err != nil {
+		return err
+	}
+
+	if err := sw.writer.Flush(); err != nil {
+		return err
+	}
+	if err := sw.file.Sync(); err != nil {
+		return err
+	}
+	if err := sw.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(sw.file.Name(), sw.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(sw.path))
+}
+
+// addRangeBounds widens the key bounds of the metadata to the range
+// tombstones.
+func (sw *SSTableWriter) addRangeBounds() {
+	sw.meta.RangeTombstoneCount = uint64(len(sw.ranges))
+	if len(sw.ranges) == 0 {
+		return
+	}
+	start, end := sw.ranges[0].Start, sw.ranges[len(sw.ranges)-1].End
+	if sw.meta.EntryCount == 0 || start < sw.meta.MinKey {
+		sw.meta.MinKey = start
+	}
+	if sw.meta.EntryCount == 0 || end > sw.meta.MaxKey {
+		sw.meta.MaxKey = end
+	}
+}
+
+// Abort discards a partially written file.
+func (sw *SSTableWriter) Abort() {
+	if !sw.finished {
+		sw.finished = true
+		sw.file.Close()
+	}
+	os.Remove(sw.file.Name())
+}
+
+// Size returns the number of bytes written so far, including the pending block.
+func (sw *SSTableWriter) Size() uint64 {
+	return sw.offset + uint64(len(sw.block))
+}
+
+// Meta returns the metadata of the entries added so far.
+func (sw *SSTableWriter) Meta() SSTableMeta {
+	return sw.meta
+}
+
+// WriteSSTable builds a complete SSTable at filePath from an unsorted map of
+// values.
+func WriteSSTable(filePath string, data map[string]string, opts SSTableOptions) error {
+	entries := make(map[string]Entry, len(data))
+	for key, value := range data {
+		entries[key] = Entry{Value: value}
+	}
+	return writeSSTableEntries(filePath, entries, opts)
+}
+
+// writeSSTableIterator builds a complete SSTable at filePath from records
+// that are already in key order, without buffering or sorting them, and the
+// range tombstones of the same skiplist.
+func writeSSTableIterator(filePath string, it *MemtableIterator, opts SSTableOptions) error {
+	writer, err := NewSSTableWriter(filePath, opts)
+	if err != nil {
+		return err
+	}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		// Records hidden by the list's own ranges are left out: the ranges
+		// are written too and hide the key in older files.
+		if it.entry == rangeDeletedEntry {
+			continue
+		}
+		if err := writer.AddEntry(it.Key(), it.Entry()); err != nil {
+			writer.Abort()
+			return err
+		}
+	}
+	for _, t := range it.list.rangeTombstones() {
+		if err := writer.AddRangeTombstone(t); err != nil {
+			writer.Abort()
+			return err
+		}
+	}
+	if err := writer.Finish(); err != nil {
+		os.Remove(filePath)
+		return err
+	}
+	return nil
+}
+
+// writeSSTableEntries builds a complete SSTable at filePath from an unsorted
+// map of values and tombstones, e.g. the contents of a Memtable being flushed.
+func writeSSTableEntries(filePath string, data map[string]Entry, opts SSTableOptions) error {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writer, err := NewSSTableWriter(filePath, opts)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := writer.AddEntry(key, data[key]); err != nil {
+			writer.Abort()
+			return err
+		}
+	}
+	if err := writer.Finish(); err != nil {
+		os.Remove(filePath)
+		return err
+	}
+	return nil
+}
@@ -1,11 +1,8 @@
 package storage_test
 
 import (
-	"bufio"
 	"fmt"
-	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -22,37 +19,21 @@ func aggregateWALEntries() (map[string]string, error) {
 		return nil, err
 	}
 
-	if len(files) == 0 {
-		files = append(files, filepath.Join(storage.WALDirectory, "wal_1.log"))
-	}
-
 	for _, file := range files {
-		f, err := os.Open(file)
+		err := storage.ReadWALSegment(file, func(rec storage.WALRecord) {
+			entries[rec.Key] = rec.Entry.Value
+		})
 		if err != nil {
-			continue
-		}
-
-		scanner := bufio.NewScanner(f)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line == "" {
-				continue
-			}
-
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) != 2 {
-				continue // Skip malformed entries.
-			}
-			entries[parts[0]] = parts[1]
+			return nil, err
 		}
-		f.Close()
 	}
 
 	return entries, nil
 }
 
 func TestWALStress(t *testing.T) {
-	wal, err := storage.NewWAL()
+	// Interval mode measures raw append throughput; fsync batching is covered by TestWALGroupCommit.
+	wal, err := storage.OpenWAL(storage.WALOptions{Durability: storage.WALDurabilityInterval})
 	if err != nil {
 		t.Fatalf("Failed to initialize WAL: %v", err)
 	}
@@ -102,7 +83,7 @@ func TestMemtableStress(t *testing.T) {
 	numOpsPerGoroutine := 20000
 	totalExpected := numGoroutines * numOpsPerGoroutine
 
-	memtable := storage.NewMemtable(totalExpected*2, nil)
+	memtable := storage.NewMemtable(storage.MemtableOptions{MaxBytes: 1 << 30}, nil)
 
 	var wg sync.WaitGroup
 
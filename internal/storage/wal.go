@@ -2,114 +2,459 @@ package storage
 
 import (
 	"bufio"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	WALFlushInterval  = 500 * time.Millisecond // Flush interval for WAL (every 500ms)
+	WALFlushInterval  = 500 * time.Millisecond // Default fsync interval in interval mode
 	WALMaxSize        = 10 * 1024 * 1024       // Rotate WAL when it exceeds 10MB
 	WALDirectory      = "data/wal/"
-	WALRetentionCount = 5           // Keep the last 5 WAL files
-	BufferSize        = 64 * 1024   // 64 KB buffer
-	MaxBufferSize     = 1024 * 1024 // Max 1MB buffer
+	WALCheckpointFile = "CHECKPOINT" // Sequence number of the last record flushed to an SSTable
+	BufferSize        = 64 * 1024    // 64 KB buffer
 )
 
+// WAL durability modes decide when Append returns relative to fsync.
+//
+//   - sync: every Append returns only after its record has been fsynced.
+//   - group: as sync, but a writer about to fsync while others are appending
+//     waits up to GroupCommitWait so that one fsync acknowledges all of them.
+//   - interval: Append returns once the record is buffered; the log is
+//     fsynced every SyncInterval, so a crash loses at most that much.
+const (
+	WALDurabilitySync     = "sync"
+	WALDurabilityGroup    = "group"
+	WALDurabilityInterval = "interval"
+)
+
+// Durability levels a single write can be acknowledged at, weakest first.
+//
+//   - memory: the record is in the Memtable and the WAL's in-process buffer;
+//     a process crash loses it.
+//   - wal-buffered: the record has been written to the WAL file; it survives
+//     a process crash but not a power failure.
+//   - fsync: the record has been fsynced.
+//
+// A write that does not name a level gets the one its WAL durability mode
+// promises: fsync under sync and group, memory under interval.
+const (
+	DurabilityMemory   = "memory"
+	DurabilityBuffered = "wal-buffered"
+	DurabilityFsync    = "fsync"
+)
+
+// CheckDurability reports whether durability is a known level, or empty.
+func CheckDurability(durability string) error {
+	switch durability {
+	case "", DurabilityMemory, DurabilityBuffered, DurabilityFsync:
+		return nil
+	}
+	return fmt.Errorf("unknown durability level %q", durability)
+}
+
+// WALOptions configures a WAL.
+type WALOptions struct {
+	Durability      string        // WALDurabilitySync, WALDurabilityGroup (default) or WALDurabilityInterval
+	GroupCommitWait time.Duration // Group: longest a writer waits for others to join its fsync
+	SyncInterval    time.Duration // Interval: time between fsyncs
+}
+
+// DefaultWALOptions returns the options used when none are configured.
+func DefaultWALOptions() WALOptions {
+	return WALOptions{
+		Durability:      WALDurabilityGroup,
+		GroupCommitWait: time.Millisecond,
+		SyncInterval:    WALFlushInterval,
+	}
+}
+
+// WALStats reports how often the log is fsynced relative to the records
+// written; under group commit Syncs grows much more slowly than Records.
+type WALStats struct {
+	Durability string `json:"durability"`
+	Records    uint64 `json:"records"`
+	Syncs      uint64 `json:"syncs"`
+}
+
+// WAL segments are named wal_<seq>.log after the sequence number of their
+// first record, so segment i holds records [seq_i, seq_i+1) and can be
+// deleted once the checkpoint reaches seq_i+1 - 1 without reading it.
+
+// WAL record layout (integers little-endian):
+//
+//	type (1) | sequence (8) | key length (4) | value length (4) | header CRC32 (4) | key | value | CRC32 (4)
+//
+// A range delete stores the start of the range as its key and the end as
+// its value.
+//
+// A batch of several changes is a single record holding them all, under the
+// sequence number of the first; the others follow it consecutively:
+//
+//	type (1) | sequence (8) | count (4) | payload length (4) | header CRC32 (4) | payload | CRC32 (4)
+//
+// where the payload is count entries of
+//
+//	type (1) | key length (4) | value length (4) | key | value
+//
+// With one checksum over the whole batch, replay applies all of its changes
+// or, if it is torn, none.
+//
+// The header CRC32 (Castagnoli) covers the header fields before it, so a
+// damaged length is caught before it is used to frame the record; the
+// trailing CRC32 covers every byte of the record before it. A crash can
+// leave the last record of the active segment, the newest one, half
+// written; replay treats a record there that is cut short by the end of the
+// file, or a damaged record followed only by zero bytes, as such a torn
+// write and stops there. Damage anywhere else, including a torn record in
+// an older segment, which was fsynced in full before rotation, is reported
+// as ErrWALCorrupted.
+const (
+	walRecordPut    byte = 1
+	walRecordDelete byte = 2
+	walRecordBatch  byte = 3
+	walRecordRange  byte = 4 // Range delete
+
+	walHeaderSize     = 1 + 8 + 4 + 4 + 4 // Including the header CRC32 in the last 4 bytes
+	walTrailerSize    = 4
+	walBatchEntrySize = 1 + 4 + 4 // Header of each change in a batch payload
+)
+
+var (
+	ErrWALCorrupted = errors.New("wal corrupted")
+
+	errWALTornRecord = errors.New("torn wal record")
+	walCRCTable      = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// WALRecord is a decoded WAL entry.
+type WALRecord struct {
+	Seq   uint64
+	Key   string
+	Entry Entry
+	End   string // Set for a range delete of [Key, End), whose Entry is a tombstone
+}
+
 type WAL struct {
-	mu        sync.Mutex
-	file      *os.File
-	writer    *bufio.Writer
-	logQueue  chan string
+	opts WALOptions
+
+	mu         sync.Mutex // Guards the active segment and the fields below
+	file       *os.File
+	writer     *bufio.Writer
+	buf        []byte // Scratch space for encoding records
+	lastSeq    uint64 // Sequence number of the last record appended
+	flushedSeq uint64 // Records up to this sequence number have been written to the file
+	syncedSeq  uint64 // Records up to this sequence number have been fsynced
+	checkpoint uint64 // Records up to this sequence number are in SSTables
+
+	syncMu  sync.Mutex   // Held by the writer performing the current fsync
+	writers atomic.Int64 // Appends not yet acknowledged, for group commit
+	records atomic.Uint64
+	syncs   atomic.Uint64
+
 	wg        sync.WaitGroup
 	closeChan chan struct{}
 }
 
-// NewWAL initializes a new Write-Ahead Log with asynchronous writes and rotation.
+// NewWAL opens the Write-Ahead Log with the default options.
 func NewWAL() (*WAL, error) {
+	return OpenWAL(DefaultWALOptions())
+}
+
+// OpenWAL opens the Write-Ahead Log, continuing its latest segment.
+// A torn record at the end of the latest segment is truncated so that new
+// records are appended after the last complete one.
+func OpenWAL(opts WALOptions) (*WAL, error) {
+	defaults := DefaultWALOptions()
+	switch opts.Durability {
+	case "":
+		opts.Durability = defaults.Durability
+	case WALDurabilitySync, WALDurabilityGroup, WALDurabilityInterval:
+	default:
+		return nil, fmt.Errorf("unknown WAL durability mode %q", opts.Durability)
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaults.SyncInterval
+	}
+
 	if err := os.MkdirAll(WALDirectory, 0755); err != nil {
 		return nil, err
 	}
 
+	checkpoint, err := readWALCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	// Continue the sequence from the newest record on disk.
+	segments, err := walSegments()
+	if err != nil {
+		return nil, err
+	}
+	lastSeq := checkpoint
+	for i, segment := range segments {
+		err := readWALSegment(segment.path, i == len(segments)-1, func(rec WALRecord) {
+			lastSeq = max(lastSeq, rec.Seq)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Get the latest WAL file or create a new one.
-	filePath := getLatestWALFile()
+	filePath := walSegmentPath(lastSeq + 1)
+	if len(segments) > 0 {
+		filePath = segments[len(segments)-1].path
+	}
+	if err := truncateTornTail(filePath); err != nil {
+		return nil, err
+	}
 	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return nil, err
 	}
 
 	wal := &WAL{
-		file:      file,
-		writer:    bufio.NewWriterSize(file, BufferSize),
-		logQueue:  make(chan string, 1000),
-		closeChan: make(chan struct{}),
+		opts:       opts,
+		file:       file,
+		writer:     bufio.NewWriterSize(file, BufferSize),
+		lastSeq:    lastSeq,
+		flushedSeq: lastSeq,
+		syncedSeq:  lastSeq,
+		checkpoint: checkpoint,
+		closeChan:  make(chan struct{}),
 	}
 
-	wal.wg.Add(1)
-	go wal.processQueue()
+	if opts.Durability == WALDurabilityInterval {
+		wal.wg.Add(1)
+		go wal.syncPeriodically()
+	}
 
 	return wal, nil
 }
 
-// Append queues a log entry for asynchronous writing.
+// Durability returns the durability mode of the WAL.
+func (w *WAL) Durability() string {
+	return w.opts.Durability
+}
+
+// Append logs a value record and returns once it is as durable as the
+// durability mode promises.
 func (w *WAL) Append(key, value string) error {
-	if key == "" || value == "" {
-		return fmt.Errorf("invalid WAL entry: empty key or value")
+	return w.appendAndCommit(key, Entry{Value: value})
+}
+
+// AppendDelete logs a tombstone record for key, like Append.
+func (w *WAL) AppendDelete(key string) error {
+	return w.appendAndCommit(key, Entry{Tombstone: true})
+}
+
+func (w *WAL) appendAndCommit(key string, entry Entry) error {
+	seq, err := w.append(WALRecord{Key: key, Entry: entry})
+	if err != nil {
+		return err
+	}
+	_, err = w.commit(seq, "")
+	return err
+}
+
+// append writes records to the active segment's buffer under consecutive
+// sequence numbers and returns the last one. Several records are written as
+// one batch record, so that they are replayed all together or not at all.
+// The caller must commit the returned sequence number before acknowledging
+// the write.
+func (w *WAL) append(records ...WALRecord) (uint64, error) {
+	if len(records) == 0 {
+		return 0, errors.New("invalid WAL entry: no records")
+	}
+	for _, rec := range records {
+		if rec.Key == "" {
+			return 0, fmt.Errorf("invalid WAL entry: empty key")
+		}
 	}
 
-	entry := fmt.Sprintf("%s:%s\n", key, value)
+	w.writers.Add(1)
 
-	if os.Getenv("TEST_MODE") == "true" {
-		w.syncWrite(entry)
-		return nil
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var err error
+	if len(records) == 1 {
+		w.buf = appendWALRecord(w.buf[:0], w.lastSeq+1, records[0])
+	} else {
+		w.buf, err = appendWALBatch(w.buf[:0], w.lastSeq+1, records)
+	}
+	if err != nil {
+		w.writers.Add(-1)
+		return 0, err
+	}
+	if _, err := w.writer.Write(w.buf); err != nil {
+		w.writers.Add(-1)
+		return 0, fmt.Errorf("WAL write failed: %w", err)
+	}
+	w.lastSeq += uint64(len(records))
+	w.records.Add(uint64(len(records)))
+	w.checkRotation()
+	return w.lastSeq, nil
+}
+
+// commit waits until the record at seq is at least as durable as the
+// requested level, or the durability mode's level if none is given, and
+// returns the level the record has actually reached.
+func (w *WAL) commit(seq uint64, durability string) (string, error) {
+	defer w.writers.Add(-1)
+
+	if durability == "" {
+		durability = DurabilityFsync
+		if w.opts.Durability == WALDurabilityInterval {
+			durability = DurabilityMemory
+		}
+	}
+
+	var err error
+	switch durability {
+	case DurabilityFsync:
+		err = w.syncTo(seq)
+	case DurabilityBuffered:
+		err = w.flushTo(seq)
+	case DurabilityMemory:
+	default:
+		err = CheckDurability(durability)
+	}
+	if err != nil {
+		return "", err
 	}
+	return w.achieved(seq), nil
+}
+
+// achieved returns the strongest level the record at seq has reached.
+func (w *WAL) achieved(seq uint64) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	select {
-	case w.logQueue <- entry:
+	switch {
+	case w.syncedSeq >= seq:
+		return DurabilityFsync
+	case w.flushedSeq >= seq:
+		return DurabilityBuffered
 	default:
-		w.syncWrite(entry)
+		return DurabilityMemory
+	}
+}
+
+// flushTo writes the buffer to the file if it still holds the record at seq.
+func (w *WAL) flushTo(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.flushedSeq >= seq {
+		return nil
+	}
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("WAL flush failed: %w", err)
+	}
+	w.flushedSeq = w.lastSeq
+	return nil
+}
+
+// syncTo returns once every record up to seq has been fsynced. Writers queue
+// on syncMu; whoever holds it fsyncs everything appended so far, so writers
+// that arrive during an fsync find their records covered by the next one.
+func (w *WAL) syncTo(seq uint64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	if w.synced() >= seq {
+		return nil
+	}
+
+	// Group commit: let writers that are ready to run append first and, if
+	// any of them is still mid-write, give them a bounded chance to finish
+	// before the fsync, so one fsync acknowledges all of them. A lone writer
+	// does not wait.
+	if w.opts.Durability == WALDurabilityGroup && w.opts.GroupCommitWait > 0 {
+		runtime.Gosched()
+		if w.writers.Load() > 1 {
+			time.Sleep(w.opts.GroupCommitWait)
+		}
 	}
+
+	return w.sync()
+}
+
+func (w *WAL) synced() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncedSeq
+}
+
+// sync flushes the buffer and fsyncs the active segment.
+func (w *WAL) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("WAL flush failed: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("WAL fsync failed: %w", err)
+	}
+	w.syncs.Add(1)
+	w.flushedSeq = w.lastSeq
+	w.syncedSeq = w.lastSeq
 	return nil
 }
 
-// processQueue handles asynchronous writes and periodic flushing.
-func (w *WAL) processQueue() {
+// syncPeriodically fsyncs the log every SyncInterval in interval mode.
+func (w *WAL) syncPeriodically() {
 	defer w.wg.Done()
 
-	ticker := time.NewTicker(WALFlushInterval)
+	ticker := time.NewTicker(w.opts.SyncInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case entry := <-w.logQueue:
-			w.syncWrite(entry)
 		case <-ticker.C:
-			w.Flush()
+			if err := w.sync(); err != nil {
+				log.Printf("[ERROR] %v", err)
+			}
 		case <-w.closeChan:
-			w.Flush()
 			return
 		}
 	}
 }
 
-// syncWrite writes directly to the WAL with mutex protection.
-func (w *WAL) syncWrite(entry string) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	_, err := w.writer.WriteString(entry)
-	if err != nil {
-		log.Printf("[ERROR] WAL write failed: %v", err)
+// Stats returns the WAL's write counters.
+func (w *WAL) Stats() WALStats {
+	return WALStats{
+		Durability: w.opts.Durability,
+		Records:    w.records.Load(),
+		Syncs:      w.syncs.Load(),
 	}
+}
 
-	w.checkRotation()
+// LastSeq returns the sequence number of the last record appended.
+func (w *WAL) LastSeq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastSeq
 }
 
-// checkRotation rotates WAL logs when the file exceeds the maximum size.
+// checkRotation rotates WAL logs when the file exceeds the maximum size. The
+// old segment is fsynced before it is closed, and the new one is named after
+// the sequence number of its first record.
 func (w *WAL) checkRotation() {
 	info, err := w.file.Stat()
 	if err != nil {
@@ -118,47 +463,67 @@ func (w *WAL) checkRotation() {
 	}
 
 	if info.Size() > WALMaxSize {
-		w.writer.Flush()
-		w.file.Close()
+		if err := w.writer.Flush(); err != nil {
+			log.Printf("[ERROR] Failed to flush WAL before rotation: %v", err)
+			return
+		}
+		if err := w.file.Sync(); err != nil {
+			log.Printf("[ERROR] Failed to sync WAL before rotation: %v", err)
+			return
+		}
+		w.flushedSeq = w.lastSeq
+		w.syncedSeq = w.lastSeq
 
-		newFilePath := filepath.Join(WALDirectory, fmt.Sprintf("wal_%d.log", time.Now().Unix()))
-		newFile, err := os.OpenFile(newFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		newFile, err := os.OpenFile(walSegmentPath(w.lastSeq+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
 			log.Printf("[ERROR] Failed to create new WAL file: %v", err)
 			return
 		}
 
+		w.file.Close()
 		w.file = newFile
 		w.writer = bufio.NewWriterSize(newFile, BufferSize)
-
-		w.cleanupOldWALs()
 	}
 }
 
-// cleanupOldWALs removes older WAL logs, keeping only the latest WALRetentionCount files.
-func (w *WAL) cleanupOldWALs() {
-	files, err := filepath.Glob(filepath.Join(WALDirectory, "wal_*.log"))
-	if err != nil {
-		log.Printf("[ERROR] Failed to list WAL files: %v", err)
-		return
+// Checkpoint records that every record up to seq is durable in an SSTable,
+// e.g. after a Memtable flush, and deletes the segments it fully covers.
+// The active segment is never deleted.
+func (w *WAL) Checkpoint(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if seq <= w.checkpoint {
+		return nil
+	}
+	if err := writeFileAtomic(filepath.Join(WALDirectory, WALCheckpointFile), []byte(strconv.FormatUint(seq, 10))); err != nil {
+		return err
 	}
+	w.checkpoint = seq
 
-	if len(files) > WALRetentionCount {
-		for _, file := range files[:len(files)-WALRetentionCount] {
-			os.Remove(file)
+	segments, err := walSegments()
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(segments); i++ {
+		if segments[i].path == w.file.Name() || segments[i+1].firstSeq-1 > seq {
+			break
+		}
+		if err := os.Remove(segments[i].path); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 // Flush forces the buffered WAL data to be written to disk.
 func (w *WAL) Flush() {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	w.writer.Flush()
-	w.file.Sync()
+	if err := w.sync(); err != nil {
+		log.Printf("[ERROR] %v", err)
+	}
 }
 
-// Close gracefully shuts down the WAL by stopping the async goroutine, flushing, and closing the file.
+// Close gracefully shuts down the WAL by stopping the sync goroutine, flushing, and closing the file.
 func (w *WAL) Close() {
 	close(w.closeChan)
 	w.wg.Wait()
@@ -166,63 +531,326 @@ func (w *WAL) Close() {
 	w.file.Close()
 }
 
-// Replay reads the WAL logs and reconstructs the state.
-func (w *WAL) Replay() (map[string]string, error) {
+// Replay reads the WAL logs and reconstructs the state not yet flushed to
+// SSTables, including tombstones for deleted keys. Records are applied in
+// sequence order, so the last record of a key wins. A range delete can only
+// be shown here as tombstones for the keys it covers in the log; use
+// ReplayRecords to see the range itself.
+func (w *WAL) Replay() (map[string]Entry, error) {
+	data := make(map[string]Entry)
+	err := w.ReplayRecords(func(rec WALRecord) {
+		if rec.End == "" {
+			data[rec.Key] = rec.Entry
+			return
+		}
+		for key := range data {
+			if key >= rec.Key && key < rec.End {
+				data[key] = rec.Entry
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ReplayRecords calls fn, in sequence order, for every record after the
+// checkpoint in every segment. The segments are read without holding the
+// WAL lock, so fn may apply records to a Memtable whose flush checkpoints
+// this WAL.
+func (w *WAL) ReplayRecords(fn func(WALRecord)) error {
 	w.mu.Lock()
-	defer w.mu.Unlock()
+	if err := w.writer.Flush(); err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	w.flushedSeq = w.lastSeq
+	checkpoint, last := w.checkpoint, w.lastSeq
+	w.mu.Unlock()
 
-	data := make(map[string]string)
-	file, err := os.Open(w.file.Name())
+	segments, err := walSegments()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	for i, segment := range segments {
+		if i+1 < len(segments) && segments[i+1].firstSeq-1 <= checkpoint {
+			continue
+		}
+		// A segment removed by a checkpoint taken meanwhile holds only
+		// flushed records and reads as empty.
+		err := readWALSegment(segment.path, i == len(segments)-1, func(rec WALRecord) {
+			if rec.Seq > checkpoint && rec.Seq <= last {
+				fn(rec)
+			}
+		})
+		if err != nil {
+			return err
+		}
 	}
-	defer file.Close()
+	return nil
+}
 
-	scanner := bufio.NewScanner(file)
-	scanner.Buffer(make([]byte, BufferSize), MaxBufferSize)
+// ReadWALSegment decodes every complete record of a WAL segment file in
+// order, reading it as the active segment: a torn record at the end of the
+// file ends the segment; damage before the end is returned as
+// ErrWALCorrupted.
+func ReadWALSegment(path string, fn func(WALRecord)) error {
+	return readWALSegment(path, true, fn)
+}
 
-	batchSize := 10000
-	tempBatch := make([]string, 0, batchSize)
+// readWALSegment is ReadWALSegment for a segment that, unless active, must
+// not end in a torn record.
+func readWALSegment(path string, active bool, fn func(WALRecord)) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := decodeWALRecords(data, active, fn); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
+// truncateTornTail cuts a torn record off the end of a segment.
+func truncateTornTail(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	valid, err := decodeWALRecords(data, true, func(WALRecord) {})
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if valid == len(data) {
+		return nil
+	}
+
+	log.Printf("[WARN] Truncating torn WAL record in %s at offset %d (%d bytes)", path, valid, len(data)-valid)
+	return os.Truncate(path, int64(valid))
+}
+
+// decodeWALRecords calls fn for every record in data, expanding batches,
+// and returns the length of the valid prefix. A torn record ends data only
+// if it may have a torn tail, i.e. it is the active segment.
+func decodeWALRecords(data []byte, tornTail bool, fn func(WALRecord)) (int, error) {
+	var records []WALRecord
+	offset := 0
+	for offset < len(data) {
+		var size int
+		var err error
+		records, size, err = decodeWALRecord(data[offset:], records[:0])
+		if err == nil {
+			for _, rec := range records {
+				fn(rec)
+			}
+			offset += size
 			continue
 		}
 
-		tempBatch = append(tempBatch, line)
+		if tornTail && (errors.Is(err, errWALTornRecord) || allZero(data[offset+size:])) {
+			return offset, nil
+		}
+		return offset, fmt.Errorf("%w: record at offset %d: %v", ErrWALCorrupted, offset, err)
+	}
+	return offset, nil
+}
+
+// decodeWALRecord appends the change, or the changes of a batch, held by
+// the record at the start of data to dst and returns its encoded size. On
+// failure the size covers as much of the record as could be framed, so the
+// caller can check what follows it.
+func decodeWALRecord(data []byte, dst []WALRecord) ([]WALRecord, int, error) {
+	if len(data) < walHeaderSize {
+		return dst, len(data), errWALTornRecord
+	}
+	if crc32.Checksum(data[:walHeaderSize-4], walCRCTable) != binary.LittleEndian.Uint32(data[walHeaderSize-4:]) {
+		return dst, walHeaderSize, errors.New("header checksum mismatch")
+	}
+
+	kind := data[0]
+	if !isWALChange(kind) && kind != walRecordBatch {
+		return dst, walHeaderSize, fmt.Errorf("unknown record type %d", kind)
+	}
+	// For a batch, the count and the payload length
+	keyLen := uint64(binary.LittleEndian.Uint32(data[9:]))
+	valueLen := uint64(binary.LittleEndian.Uint32(data[13:]))
+	if kind == walRecordBatch {
+		keyLen = 0
+	}
+	size := uint64(walHeaderSize) + keyLen + valueLen + walTrailerSize
+	if size > uint64(len(data)) {
+		return dst, len(data), errWALTornRecord
+	}
+
+	body := data[:size-walTrailerSize]
+	if crc32.Checksum(body, walCRCTable) != binary.LittleEndian.Uint32(data[size-walTrailerSize:]) {
+		return dst, int(size), errors.New("checksum mismatch")
+	}
+
+	seq := binary.LittleEndian.Uint64(data[1:])
+	payload := body[walHeaderSize:]
+	if kind != walRecordBatch {
+		return append(dst, walChange(seq, kind, payload[:keyLen], payload[keyLen:])), int(size), nil
+	}
 
-		if len(tempBatch) >= batchSize {
-			processBatch(tempBatch, &data)
-			tempBatch = tempBatch[:0]
+	count := binary.LittleEndian.Uint32(data[9:])
+	for i := uint32(0); i < count; i++ {
+		if len(payload) < walBatchEntrySize {
+			return dst, int(size), fmt.Errorf("batch entry %d of %d cut short", i, count)
+		}
+		kind := payload[0]
+		keyLen := uint64(binary.LittleEndian.Uint32(payload[1:]))
+		valueLen := uint64(binary.LittleEndian.Uint32(payload[5:]))
+		end := walBatchEntrySize + keyLen + valueLen
+		if !isWALChange(kind) || end > uint64(len(payload)) {
+			return dst, int(size), fmt.Errorf("invalid batch entry %d of %d", i, count)
 		}
+		key := payload[walBatchEntrySize : walBatchEntrySize+keyLen]
+		dst = append(dst, walChange(seq+uint64(i), kind, key, payload[walBatchEntrySize+keyLen:end]))
+		payload = payload[end:]
 	}
+	if count == 0 || len(payload) != 0 {
+		return dst, int(size), fmt.Errorf("batch of %d entries with %d bytes left over", count, len(payload))
+	}
+	return dst, int(size), nil
+}
 
-	if len(tempBatch) > 0 {
-		processBatch(tempBatch, &data)
+// isWALChange reports whether kind is the type of a single change.
+func isWALChange(kind byte) bool {
+	return kind == walRecordPut || kind == walRecordDelete || kind == walRecordRange
+}
+
+// walChange builds the record of one decoded put, delete or range delete.
+func walChange(seq uint64, kind byte, key, value []byte) WALRecord {
+	rec := WALRecord{Seq: seq, Key: string(key)}
+	switch kind {
+	case walRecordDelete:
+		rec.Entry = Entry{Tombstone: true}
+	case walRecordRange:
+		rec.Entry, rec.End = Entry{Tombstone: true}, string(value)
+	default:
+		rec.Entry = Entry{Value: string(value)}
 	}
+	return rec
+}
 
-	return data, scanner.Err()
+// walKind returns the record type of a change and the value it stores.
+func walKind(rec WALRecord) (byte, string) {
+	switch {
+	case rec.End != "":
+		return walRecordRange, rec.End
+	case rec.Entry.Tombstone:
+		return walRecordDelete, ""
+	}
+	return walRecordPut, rec.Entry.Value
 }
 
-// processBatch parses a batch of WAL lines and updates the provided data map.
-func processBatch(batch []string, data *map[string]string) {
-	for _, line := range batch {
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			log.Printf("[WARN] Skipping malformed WAL entry: %s", line)
-			continue
+// appendWALRecord appends the encoding of one record to dst.
+func appendWALRecord(dst []byte, seq uint64, rec WALRecord) []byte {
+	start := len(dst)
+	kind, value := walKind(rec)
+
+	dst = append(dst, kind)
+	dst = binary.LittleEndian.AppendUint64(dst, seq)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(rec.Key)))
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(value)))
+	dst = binary.LittleEndian.AppendUint32(dst, crc32.Checksum(dst[start:], walCRCTable))
+	dst = append(dst, rec.Key...)
+	dst = append(dst, value...)
+	return binary.LittleEndian.AppendUint32(dst, crc32.Checksum(dst[start:], walCRCTable))
+}
+
+// appendWALBatch appends the encoding of a batch record holding records,
+// the first under seq, to dst.
+func appendWALBatch(dst []byte, seq uint64, records []WALRecord) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, walRecordBatch)
+	dst = binary.LittleEndian.AppendUint64(dst, seq)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(records)))
+	dst = binary.LittleEndian.AppendUint32(dst, 0) // Payload length, set below
+	dst = binary.LittleEndian.AppendUint32(dst, 0) // Header checksum, set below
+	for _, rec := range records {
+		kind, value := walKind(rec)
+		dst = append(dst, kind)
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(rec.Key)))
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(value)))
+		dst = append(dst, rec.Key...)
+		dst = append(dst, value...)
+	}
+
+	payload := uint64(len(dst) - start - walHeaderSize)
+	if payload > math.MaxUint32 {
+		return dst[:start], fmt.Errorf("%w: %d bytes in one WAL record", ErrBatchTooLarge, payload)
+	}
+	binary.LittleEndian.PutUint32(dst[start+13:], uint32(payload))
+	header := dst[start : start+walHeaderSize]
+	binary.LittleEndian.PutUint32(header[walHeaderSize-4:], crc32.Checksum(header[:walHeaderSize-4], walCRCTable))
+	return binary.LittleEndian.AppendUint32(dst, crc32.Checksum(dst[start:], walCRCTable)), nil
+}
+
+// allZero reports whether b holds only zero bytes, as left behind when a
+// crash interrupts a write into space the filesystem already allocated.
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
 		}
-		(*data)[parts[0]] = parts[1]
 	}
+	return true
 }
 
-// getLatestWALFile finds the most recent WAL file or returns a default file path.
-func getLatestWALFile() string {
+// walSegment is a WAL file and the sequence number of its first record.
+type walSegment struct {
+	path     string
+	firstSeq uint64
+}
+
+// walSegments lists the WAL files in sequence order.
+func walSegments() ([]walSegment, error) {
 	files, err := filepath.Glob(filepath.Join(WALDirectory, "wal_*.log"))
-	if err != nil || len(files) == 0 {
-		return filepath.Join(WALDirectory, "wal_1.log")
+	if err != nil {
+		return nil, err
 	}
 
-	return files[len(files)-1]
+	segments := make([]walSegment, 0, len(files))
+	for _, path := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "wal_"), ".log")
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			log.Printf("[WARN] Ignoring unrecognised WAL file %s", path)
+			continue
+		}
+		segments = append(segments, walSegment{path: path, firstSeq: seq})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].firstSeq < segments[j].firstSeq })
+	return segments, nil
+}
+
+// walSegmentPath returns the path of the segment starting at seq.
+func walSegmentPath(seq uint64) string {
+	return filepath.Join(WALDirectory, fmt.Sprintf("wal_%d.log", seq))
+}
+
+// readWALCheckpoint returns the persisted checkpoint, or 0 if none exists.
+func readWALCheckpoint() (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(WALDirectory, WALCheckpointFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad checkpoint %q", ErrWALCorrupted, data)
+	}
+	return seq, nil
 }
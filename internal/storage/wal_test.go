@@ -1,11 +1,16 @@
 package storage_test
 
 import (
+	"errors"
 	"fmt"
 	"moniepoint/internal/storage"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 // TestMain is the entry point for testing; it cleans up the WAL directory when done.
@@ -58,7 +63,8 @@ func TestWAL(t *testing.T) {
 	}
 
 	for _, txn := range transactions {
-		status, exists := data[txn.TxnID]
+		entry, exists := data[txn.TxnID]
+		status := entry.Value
 		if !exists {
 			t.Errorf("Transaction '%s' not found during replay", txn.TxnID)
 		} else if status != txn.Status {
@@ -142,7 +148,454 @@ func TestWALCrashRecovery(t *testing.T) {
 		t.Fatalf("Failed to replay WAL after simulated crash: %v", err)
 	}
 
-	if status, exists := data["txn_before_crash"]; !exists || status != "processing" {
-		t.Errorf("Transaction lost after crash: expected 'processing', got '%s'", status)
+	if entry, exists := data["txn_before_crash"]; !exists || entry.Value != "processing" {
+		t.Errorf("Transaction lost after crash: expected 'processing', got '%s'", entry.Value)
+	}
+}
+
+func TestWALReplayTombstones(t *testing.T) {
+	enableTestMode()
+	defer disableTestMode()
+
+	wal, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	defer wal.Close()
+
+	if err := wal.Append("txn_deleted", "pending"); err != nil {
+		t.Fatalf("Failed to append transaction: %v", err)
+	}
+	if err := wal.AppendDelete("txn_deleted"); err != nil {
+		t.Fatalf("Failed to append tombstone: %v", err)
+	}
+	wal.Flush()
+
+	data, err := wal.Replay()
+	if err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+	if entry := data["txn_deleted"]; !entry.Tombstone {
+		t.Errorf("Expected the delete to be replayed as a tombstone, got %+v", entry)
+	}
+}
+
+// latestWALSegment returns the segment new records are appended to.
+func latestWALSegment(t *testing.T) string {
+	t.Helper()
+	segments := walSegments(t)
+	if len(segments) == 0 {
+		t.Fatal("No WAL segment found")
+	}
+	return segments[len(segments)-1]
+}
+
+// walSegments lists the WAL segments in sequence order.
+func walSegments(t *testing.T) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(storage.WALDirectory, "wal_*.log"))
+	if err != nil {
+		t.Fatalf("Failed to list WAL segments: %v", err)
+	}
+	firstSeq := func(path string) int {
+		var seq int
+		fmt.Sscanf(filepath.Base(path), "wal_%d.log", &seq)
+		return seq
+	}
+	sort.Slice(files, func(i, j int) bool { return firstSeq(files[i]) < firstSeq(files[j]) })
+	return files
+}
+
+func TestWALBinarySafeRecords(t *testing.T) {
+	enableTestMode()
+	defer disableTestMode()
+
+	wal, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	defer wal.Close()
+
+	expected := map[string]string{
+		"order:42":       `{"status": "approved",\n "note": "a:b"}`,
+		"txn_multi_line": "line1\nline2\r\n",
+		"txn_empty":      "",
+	}
+	for key, value := range expected {
+		if err := wal.Append(key, value); err != nil {
+			t.Fatalf("Failed to append %q: %v", key, err)
+		}
+	}
+	wal.Flush()
+
+	data, err := wal.Replay()
+	if err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+	for key, value := range expected {
+		if entry, exists := data[key]; !exists || entry.Value != value {
+			t.Errorf("Expected %q=%q, got %q (exists=%v)", key, value, entry.Value, exists)
+		}
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	enableTestMode()
+	defer disableTestMode()
+
+	wal, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	wal.Append("txn_torn_1", "complete")
+	wal.Flush()
+	wal.Close()
+
+	// Simulate a crash halfway through writing the next record.
+	segment := latestWALSegment(t)
+	f, err := os.OpenFile(segment, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	f.Write([]byte{1, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0, 10, 0, 0, 0, 't', 'x'})
+	f.Close()
+
+	reopened, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Expected a torn tail to be recovered, got %v", err)
+	}
+	defer reopened.Close()
+
+	reopened.Append("txn_torn_2", "after_restart")
+	reopened.Flush()
+
+	data, err := reopened.Replay()
+	if err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+	if data["txn_torn_1"].Value != "complete" || data["txn_torn_2"].Value != "after_restart" {
+		t.Errorf("Expected records around the torn write to survive, got %v", data)
+	}
+}
+
+func TestWALCorruptionInMiddle(t *testing.T) {
+	enableTestMode()
+	defer disableTestMode()
+	defer os.RemoveAll(storage.WALDirectory)
+
+	os.RemoveAll(storage.WALDirectory)
+	wal, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		wal.Append(fmt.Sprintf("txn_corrupt_%d", i), "value")
+	}
+	wal.Flush()
+	wal.Close()
+
+	// Flip a byte inside the first record's payload.
+	segment := latestWALSegment(t)
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatalf("Failed to read segment: %v", err)
+	}
+	data[20] ^= 0xff
+	if err := os.WriteFile(segment, data, 0644); err != nil {
+		t.Fatalf("Failed to write segment: %v", err)
+	}
+
+	if _, err := storage.NewWAL(); !errors.Is(err, storage.ErrWALCorrupted) {
+		t.Fatalf("Expected ErrWALCorrupted, got %v", err)
+	}
+	if err := storage.ReadWALSegment(segment, func(storage.WALRecord) {}); !errors.Is(err, storage.ErrWALCorrupted) {
+		t.Errorf("Expected ErrWALCorrupted from ReadWALSegment, got %v", err)
+	}
+}
+
+// A damaged length must not pass for a torn tail and truncate the records
+// after it.
+func TestWALCorruptedLength(t *testing.T) {
+	enableTestMode()
+	defer disableTestMode()
+	defer os.RemoveAll(storage.WALDirectory)
+
+	os.RemoveAll(storage.WALDirectory)
+	wal, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		wal.Append(fmt.Sprintf("txn_length_%d", i), "value")
+	}
+	wal.Flush()
+	wal.Close()
+
+	// Flip a byte of the first record's value length.
+	segment := latestWALSegment(t)
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatalf("Failed to read segment: %v", err)
+	}
+	data[14] ^= 0xff
+	if err := os.WriteFile(segment, data, 0644); err != nil {
+		t.Fatalf("Failed to write segment: %v", err)
+	}
+
+	if _, err := storage.NewWAL(); !errors.Is(err, storage.ErrWALCorrupted) {
+		t.Fatalf("Expected ErrWALCorrupted, got %v", err)
+	}
+	if info, err := os.Stat(segment); err != nil || info.Size() != int64(len(data)) {
+		t.Errorf("Expected the segment to be left intact, got %v (err=%v)", info, err)
+	}
+}
+
+// Only the active segment can end in a torn record: older ones were fsynced
+// in full before rotation.
+func TestWALTornRecordInOlderSegment(t *testing.T) {
+	enableTestMode()
+	defer disableTestMode()
+	defer os.RemoveAll(storage.WALDirectory)
+
+	os.RemoveAll(storage.WALDirectory)
+	wal, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	value := strings.Repeat("v", 1<<20)
+	for i := 0; i < 12; i++ {
+		wal.Append(fmt.Sprintf("txn_older_%02d", i), value)
+	}
+	wal.Flush()
+	wal.Close()
+
+	segments := walSegments(t)
+	if len(segments) < 2 {
+		t.Fatalf("Expected records in at least 2 segments, got %d", len(segments))
+	}
+	info, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatalf("Failed to stat segment: %v", err)
+	}
+	if err := os.Truncate(segments[0], info.Size()-10); err != nil {
+		t.Fatalf("Failed to truncate segment: %v", err)
+	}
+
+	if _, err := storage.NewWAL(); !errors.Is(err, storage.ErrWALCorrupted) {
+		t.Fatalf("Expected ErrWALCorrupted, got %v", err)
+	}
+}
+
+func TestWALReplaysAllSegmentsAfterCheckpoint(t *testing.T) {
+	enableTestMode()
+	defer disableTestMode()
+	defer os.RemoveAll(storage.WALDirectory)
+
+	os.RemoveAll(storage.WALDirectory)
+	wal, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+
+	// Large values force rotation, spreading the records over several segments.
+	value := strings.Repeat("v", 1<<20)
+	for i := 0; i < 25; i++ {
+		if err := wal.Append(fmt.Sprintf("txn_seg_%02d", i), value); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	wal.Flush()
+	wal.Close()
+
+	if n := len(walSegments(t)); n < 3 {
+		t.Fatalf("Expected records in at least 3 segments, got %d", n)
+	}
+
+	wal, err = storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	data, err := wal.Replay()
+	if err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+	if len(data) != 25 {
+		t.Fatalf("Expected all 25 records from every segment, got %d", len(data))
+	}
+
+	// A checkpoint inside the second segment removes only the first one.
+	segments := walSegments(t)
+	var secondStart uint64
+	fmt.Sscanf(filepath.Base(segments[1]), "wal_%d.log", &secondStart)
+	checkpoint := secondStart + 1
+	if err := wal.Checkpoint(checkpoint); err != nil {
+		t.Fatalf("Failed to checkpoint WAL: %v", err)
+	}
+	remaining := walSegments(t)
+	if len(remaining) != len(segments)-1 || remaining[0] != segments[1] {
+		t.Errorf("Expected only the first segment to be removed, got %v (was %v)", remaining, segments)
+	}
+	wal.Close()
+
+	// After a restart only records past the checkpoint are replayed.
+	wal, err = storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer wal.Close()
+
+	var replayed []uint64
+	err = wal.ReplayRecords(func(rec storage.WALRecord) {
+		replayed = append(replayed, rec.Seq)
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+	if len(replayed) != 25-int(checkpoint) || replayed[0] != checkpoint+1 {
+		t.Errorf("Expected records %d..25 to be replayed, got %v", checkpoint+1, replayed)
+	}
+	for i := 1; i < len(replayed); i++ {
+		if replayed[i] != replayed[i-1]+1 {
+			t.Fatalf("Expected records in sequence order, got %v", replayed)
+		}
+	}
+	if wal.LastSeq() != 25 {
+		t.Errorf("Expected the sequence to continue from 25, got %d", wal.LastSeq())
+	}
+}
+
+// Replay must not hold the WAL while applying records: a Memtable flushed
+// during replay checkpoints the same WAL.
+func TestWALReplayAllowsCheckpoint(t *testing.T) {
+	enableTestMode()
+	defer disableTestMode()
+	defer os.RemoveAll(storage.WALDirectory)
+
+	os.RemoveAll(storage.WALDirectory)
+	wal, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		wal.Append(fmt.Sprintf("txn_ckpt_%d", i), "value")
+	}
+	wal.Flush()
+	wal.Close()
+
+	wal, err = storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+
+	done := make(chan error, 1)
+	replayed := 0
+	go func() {
+		done <- wal.ReplayRecords(func(rec storage.WALRecord) {
+			replayed++
+			if err := wal.Checkpoint(rec.Seq); err != nil {
+				t.Errorf("Failed to checkpoint WAL during replay: %v", err)
+			}
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Failed to replay WAL: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Replay deadlocked on a checkpoint taken during replay")
+	}
+	wal.Close()
+	if replayed != 10 {
+		t.Errorf("Expected 10 records to be replayed, got %d", replayed)
+	}
+}
+
+func TestWALGroupCommit(t *testing.T) {
+	defer os.RemoveAll(storage.WALDirectory)
+
+	os.RemoveAll(storage.WALDirectory)
+	wal, err := storage.OpenWAL(storage.WALOptions{
+		Durability:      storage.WALDurabilityGroup,
+		GroupCommitWait: 2 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := wal.Append(fmt.Sprintf("txn_group_%d_%d", i, j), "committed"); err != nil {
+					t.Errorf("Append failed: %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := wal.Stats()
+	if stats.Records != 1000 {
+		t.Errorf("Expected 1000 records, got %d", stats.Records)
+	}
+	if stats.Syncs == 0 || stats.Syncs*4 > stats.Records {
+		t.Errorf("Expected concurrent appends to share fsyncs, got %d syncs for %d records", stats.Syncs, stats.Records)
+	}
+
+	// Every acknowledged record is on disk without an explicit Flush.
+	segment := latestWALSegment(t)
+	count := 0
+	if err := storage.ReadWALSegment(segment, func(storage.WALRecord) { count++ }); err != nil {
+		t.Fatalf("Failed to read segment: %v", err)
+	}
+	if count != 1000 {
+		t.Errorf("Expected 1000 records on disk after acknowledgement, got %d", count)
+	}
+	wal.Close()
+}
+
+func TestWALDurabilityModes(t *testing.T) {
+	defer os.RemoveAll(storage.WALDirectory)
+
+	os.RemoveAll(storage.WALDirectory)
+	if _, err := storage.OpenWAL(storage.WALOptions{Durability: "eventually"}); err == nil {
+		t.Fatal("Expected an unknown durability mode to be rejected")
+	}
+
+	wal, err := storage.OpenWAL(storage.WALOptions{Durability: storage.WALDurabilitySync})
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		wal.Append(fmt.Sprintf("txn_sync_%d", i), "committed")
+	}
+	if stats := wal.Stats(); stats.Syncs != 3 {
+		t.Errorf("Expected one fsync per sequential append in sync mode, got %d", stats.Syncs)
+	}
+	wal.Close()
+
+	wal, err = storage.OpenWAL(storage.WALOptions{
+		Durability:   storage.WALDurabilityInterval,
+		SyncInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	defer wal.Close()
+
+	wal.Append("txn_interval", "committed")
+	if stats := wal.Stats(); stats.Syncs != 0 {
+		t.Errorf("Expected interval mode to acknowledge before fsync, got %d syncs", stats.Syncs)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if stats := wal.Stats(); stats.Syncs == 0 {
+		t.Error("Expected interval mode to fsync in the background")
+	}
+	data, err := wal.Replay()
+	if err != nil || data["txn_interval"].Value != "committed" {
+		t.Errorf("Expected the interval-mode record to be replayed, got %v (err=%v)", data, err)
 	}
 }
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Writer is the write path into the store. Each change is appended to the
+// WAL under one lock, waits for durability outside it, which is what lets
+// concurrent writes share a group commit, and only then is applied to the
+// Memtable, so readers never see a write that has not reached the requested
+// durability. Writes are applied in the order they were appended, so the
+// Memtable always holds a prefix of the WAL and a flush covers every record
+// up to the sequence number it reports. A write whose commit fails is not
+// applied; it may still be replayed from the WAL after a restart, as its
+// outcome is unknown to the client.
+type Writer struct {
+	mu       sync.Mutex // Orders WAL appends
+	wal      *WAL
+	memtable *Memtable
+	limits   Limits
+
+	turnMu    sync.Mutex
+	turn      *sync.Cond // Signalled when a write has been applied, or dropped
+	appended  uint64     // Writes appended to the WAL, guarded by mu
+	published uint64     // Writes applied to the Memtable or dropped, guarded by turnMu
+}
+
+// KV is a key and the value to write for it, or a deletion of the key.
+type KV struct {
+	Key    string
+	Value  string
+	Delete bool // Delete Key instead of writing Value
+}
+
+// NewWriter initializes a Writer over a WAL and the Memtable it feeds,
+// rejecting writes that break limits.
+func NewWriter(wal *WAL, memtable *Memtable, limits Limits) *Writer {
+	w := &Writer{wal: wal, memtable: memtable, limits: limits}
+	w.turn = sync.NewCond(&w.turnMu)
+	return w
+}
+
+// Limits returns the limits the Writer enforces.
+func (w *Writer) Limits() Limits {
+	return w.limits
+}
+
+// Put logs a value for key and stores it in the Memtable. It returns once the
+// record is at least as durable as the requested level (see DurabilityFsync;
+// empty means the WAL's default) and reports the level it reached.
+func (w *Writer) Put(key, value, durability string) (string, error) {
+	return w.write(durability, WALRecord{Key: key, Entry: Entry{Value: value}})
+}
+
+// Delete logs a tombstone for key and stores it in the Memtable, like Put.
+func (w *Writer) Delete(key, durability string) (string, error) {
+	return w.write(durability, WALRecord{Key: key, Entry: Entry{Tombstone: true}})
+}
+
+// PutBatch writes the values, and deletes the keys marked Delete,
+// atomically: they are logged as one WAL record under consecutive sequence
+// numbers, applied in order, so a key given twice keeps its last value, and
+// become visible to readers all at once. Either the whole batch is accepted
+// or it is rejected with an error and nothing is written. It waits once for
+// the batch to reach the requested durability.
+func (w *Writer) PutBatch(kvs []KV, durability string) (string, error) {
+	records := make([]WALRecord, len(kvs))
+	for i, kv := range kvs {
+		entry := Entry{Value: kv.Value}
+		if kv.Delete {
+			entry = Entry{Tombstone: true}
+		}
+		records[i] = WALRecord{Key: kv.Key, Entry: entry}
+	}
+	return w.write(durability, records...)
+}
+
+// DeleteBatch deletes keys atomically, like PutBatch.
+func (w *Writer) DeleteBatch(keys []string, durability string) (string, error) {
+	records := make([]WALRecord, len(keys))
+	for i, key := range keys {
+		records[i] = WALRecord{Key: key, Entry: Entry{Tombstone: true}}
+	}
+	return w.write(durability, records...)
+}
+
+// DeleteRange deletes every key in [start, end) with a single range
+// tombstone, however many keys that is; an empty start deletes from the
+// first key. The space is reclaimed as compaction merges the tombstone
+// down the levels. The range must not be empty: end has to be after start.
+func (w *Writer) DeleteRange(start, end, durability string) (string, error) {
+	if start == "" {
+		start = "\x00" // The smallest key
+	}
+	if end == "" {
+		return "", fmt.Errorf("%w: no end", ErrInvalidRange)
+	}
+	return w.write(durability, WALRecord{Key: start, Entry: Entry{Tombstone: true}, End: end})
+}
+
+func (w *Writer) write(durability string, records ...WALRecord) (string, error) {
+	if err := CheckDurability(durability); err != nil {
+		return "", err
+	}
+	if err := w.limits.check(records); err != nil {
+		return "", err
+	}
+
+	seq, ticket, err := w.append(records)
+	if err != nil {
+		return "", err
+	}
+	achieved, err := w.wal.commit(seq, durability)
+	w.publish(ticket, records, err == nil)
+	if err != nil {
+		return "", err
+	}
+	return achieved, nil
+}
+
+// append logs records as one WAL record, numbers them in sequence order and
+// returns the last sequence number and the write's place in the order of
+// appends.
+func (w *Writer) append(records []WALRecord) (uint64, uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	last, err := w.wal.append(records...)
+	if err != nil {
+		return 0, 0, err
+	}
+	first := last - uint64(len(records)) + 1
+	for i := range records {
+		records[i].Seq = first + uint64(i)
+	}
+	ticket := w.appended
+	w.appended++
+	return last, ticket, nil
+}
+
+// publish waits for the writes appended before this one to be published,
+// then stores records in the Memtable, as one batch, if apply is set.
+func (w *Writer) publish(ticket uint64, records []WALRecord, apply bool) {
+	w.turnMu.Lock()
+	for w.published != ticket {
+		w.turn.Wait()
+	}
+	w.turnMu.Unlock()
+
+	if apply {
+		w.memtable.ApplyBatch(records...)
+	}
+
+	w.turnMu.Lock()
+	w.published++
+	w.turn.Broadcast()
+	w.turnMu.Unlock()
+}
@@ -0,0 +1,383 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"moniepoint/internal/storage"
+)
+
+// TestWriterFlushCoversWAL verifies that a flush reports the WAL position of
+// the last record it contains.
+func TestWriterFlushCoversWAL(t *testing.T) {
+	defer os.RemoveAll(storage.WALDirectory)
+
+	wal, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	defer wal.Close()
+
+	recorder := newFlushRecorder()
+	memtable := storage.NewMemtable(storage.MemtableOptions{MaxBytes: 1000}, recorder.flush)
+	defer memtable.Close()
+	writer := storage.NewWriter(wal, memtable, storage.DefaultLimits())
+
+	writer.Put("txn1", strings.Repeat("a", 400), "")
+	writer.Delete("txn2", "")
+	if memtable.Stats().Immutables != 0 {
+		t.Fatal("Expected no flush before the Memtable is full")
+	}
+	writer.Put("txn3", strings.Repeat("p", 600), "")
+
+	recorder.wait(t)
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if recorder.seq != wal.LastSeq() {
+		t.Errorf("Expected flush to cover WAL position %d, got %d", wal.LastSeq(), recorder.seq)
+	}
+}
+
+// TestWriterDurabilityLevels verifies that each write is acknowledged at the
+// level it asks for and reports the level it reached.
+func TestWriterDurabilityLevels(t *testing.T) {
+	defer os.RemoveAll(storage.WALDirectory)
+
+	os.RemoveAll(storage.WALDirectory)
+	wal, err := storage.OpenWAL(storage.WALOptions{Durability: storage.WALDurabilityGroup})
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	defer wal.Close()
+	writer := storage.NewWriter(wal, storage.NewMemtable(storage.DefaultMemtableOptions(), nil), storage.DefaultLimits())
+
+	onDisk := func() int {
+		count := 0
+		storage.ReadWALSegment(latestWALSegment(t), func(storage.WALRecord) { count++ })
+		return count
+	}
+
+	tests := []struct {
+		durability string
+		achieved   string
+		onDisk     int
+		syncs      uint64
+	}{
+		{storage.DurabilityMemory, storage.DurabilityMemory, 0, 0},
+		{storage.DurabilityBuffered, storage.DurabilityBuffered, 2, 0},
+		{storage.DurabilityFsync, storage.DurabilityFsync, 3, 1},
+		{"", storage.DurabilityFsync, 4, 2}, // group mode defaults to fsync
+	}
+	for i, tt := range tests {
+		achieved, err := writer.Put("txn_durability", tt.durability, tt.durability)
+		if err != nil {
+			t.Fatalf("Put(%q) failed: %v", tt.durability, err)
+		}
+		if achieved != tt.achieved {
+			t.Errorf("Put(%q): expected %q acknowledgement, got %q", tt.durability, tt.achieved, achieved)
+		}
+		if n := onDisk(); n != tt.onDisk {
+			t.Errorf("Put(%q): expected %d records in the file, got %d", tt.durability, tt.onDisk, n)
+		}
+		if syncs := wal.Stats().Syncs; syncs != tt.syncs {
+			t.Errorf("Put(%q) #%d: expected %d fsyncs, got %d", tt.durability, i, tt.syncs, syncs)
+		}
+	}
+
+	if _, err := writer.Put("txn_durability", "value", "eventually"); err == nil {
+		t.Error("Expected an unknown durability level to be rejected")
+	}
+	if seq := wal.LastSeq(); seq != 4 {
+		t.Errorf("Expected a rejected write not to be logged, last seq is %d", seq)
+	}
+}
+
+// TestWriterPublishesDurableWrites verifies that a write only reaches
+// readers once it is as durable as requested, and that one whose commit
+// fails is never published and does not hold up the writes after it.
+func TestWriterPublishesDurableWrites(t *testing.T) {
+	defer os.RemoveAll(storage.WALDirectory)
+
+	os.RemoveAll(storage.WALDirectory)
+	wal, err := storage.OpenWAL(storage.WALOptions{Durability: storage.WALDurabilitySync})
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	memtable := storage.NewMemtable(storage.DefaultMemtableOptions(), nil)
+	writer := storage.NewWriter(wal, memtable, storage.DefaultLimits())
+
+	if _, err := writer.Put("txn0", "ok", storage.DurabilityFsync); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if value, ok := memtable.Get("txn0"); !ok || value != "ok" {
+		t.Errorf("Expected txn0=ok once fsynced, got %q (ok=%v)", value, ok)
+	}
+
+	// With the segment closed, records still reach the WAL buffer but no fsync succeeds.
+	wal.Close()
+	if _, err := writer.PutBatch([]storage.KV{{Key: "txn1", Value: "a"}, {Key: "txn2", Value: "b"}}, storage.DurabilityFsync); err == nil {
+		t.Fatal("Expected the fsync to fail on a closed WAL")
+	}
+	for _, key := range []string{"txn1", "txn2"} {
+		if value, ok := memtable.Get(key); ok {
+			t.Errorf("Expected %s not to be published after a failed commit, got %q", key, value)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		writer.Put("txn3", "c", storage.DurabilityFsync)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a failed write not to hold up the next one")
+	}
+}
+
+// TestWriterLimits verifies that writes over the limits are rejected with
+// their own errors before anything is logged.
+func TestWriterLimits(t *testing.T) {
+	defer os.RemoveAll(storage.WALDirectory)
+
+	os.RemoveAll(storage.WALDirectory)
+	wal, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	defer wal.Close()
+	limits := storage.Limits{MaxKeyBytes: 8, MaxValueBytes: 16, MaxBatchEntries: 3, MaxBatchBytes: 40}
+	writer := storage.NewWriter(wal, storage.NewMemtable(storage.DefaultMemtableOptions(), nil), limits)
+
+	tests := []struct {
+		name string
+		kvs  []storage.KV
+		want error
+	}{
+		{"empty key", []storage.KV{{Key: "", Value: "v"}}, storage.ErrEmptyKey},
+		{"long key", []storage.KV{{Key: "txn_123456", Value: "v"}}, storage.ErrKeyTooLarge},
+		{"long value", []storage.KV{{Key: "txn1", Value: strings.Repeat("v", 17)}}, storage.ErrValueTooLarge},
+		{"many entries", []storage.KV{{Key: "a"}, {Key: "b"}, {Key: "c"}, {Key: "d"}}, storage.ErrBatchTooLarge},
+		{"large batch", []storage.KV{{Key: "a", Value: strings.Repeat("v", 16)}, {Key: "b", Value: strings.Repeat("v", 16)}, {Key: "c", Value: strings.Repeat("v", 16)}}, storage.ErrBatchTooLarge},
+		{"bad entry", []storage.KV{{Key: "a"}, {Key: "b", Value: strings.Repeat("v", 17)}}, storage.ErrValueTooLarge},
+	}
+	for _, tt := range tests {
+		if _, err := writer.PutBatch(tt.kvs, ""); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+	if _, err := writer.Put("txn_123456", "v", ""); !errors.Is(err, storage.ErrKeyTooLarge) {
+		t.Errorf("Expected ErrKeyTooLarge from Put, got %v", err)
+	}
+	if _, err := writer.Delete("txn_123456", ""); !errors.Is(err, storage.ErrKeyTooLarge) {
+		t.Errorf("Expected ErrKeyTooLarge from Delete, got %v", err)
+	}
+	if seq := wal.LastSeq(); seq != 0 {
+		t.Errorf("Expected rejected writes not to be logged, last seq is %d", seq)
+	}
+
+	if _, err := writer.PutBatch([]storage.KV{{Key: "txn1", Value: strings.Repeat("v", 16)}, {Key: "txn2"}}, ""); err != nil {
+		t.Errorf("Expected a batch at the limits to succeed, got %v", err)
+	}
+}
+
+// TestWriterBatchIsAtomic verifies that a batch is logged as one WAL record
+// that replay applies whole or not at all, that its entries apply in order,
+// and that readers never see part of it.
+func TestWriterBatchIsAtomic(t *testing.T) {
+	defer os.RemoveAll(storage.WALDirectory)
+
+	os.RemoveAll(storage.WALDirectory)
+	wal, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	memtable := storage.NewMemtable(storage.DefaultMemtableOptions(), nil)
+	defer memtable.Close()
+	writer := storage.NewWriter(wal, memtable, storage.DefaultLimits())
+
+	// Each batch sets a first and b last to the same number. Readers check
+	// a before b, so seeing a ahead of b means they saw half of a batch.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 200; i++ {
+			v := strconv.Itoa(i)
+			kvs := []storage.KV{{Key: "a", Value: v}}
+			for j := 0; j < 100; j++ {
+				kvs = append(kvs, storage.KV{Key: fmt.Sprintf("k%03d", j), Value: v})
+			}
+			kvs = append(kvs, storage.KV{Key: "b", Value: v})
+			if _, err := writer.PutBatch(kvs, storage.DurabilityMemory); err != nil {
+				t.Errorf("PutBatch failed: %v", err)
+			}
+		}
+		close(stop)
+	}()
+	for done := false; !done; {
+		select {
+		case <-stop:
+			done = true
+		default:
+		}
+		a, _ := memtable.Get("a")
+		b, _ := memtable.Get("b")
+		x, _ := strconv.Atoi(a)
+		y, _ := strconv.Atoi(b)
+		if x > y {
+			t.Fatalf("Saw half of a batch: a=%s, b=%s", a, b)
+		}
+	}
+	wg.Wait()
+
+	if _, err := writer.PutBatch([]storage.KV{{Key: "txn1", Value: "1"}, {Key: "txn2", Value: "1"}, {Key: "txn1", Value: "2"}}, storage.DurabilityFsync); err != nil {
+		t.Fatalf("PutBatch failed: %v", err)
+	}
+	if v, _ := memtable.Get("txn1"); v != "2" {
+		t.Errorf("Expected the last value of a key given twice, got %q", v)
+	}
+	wal.Close()
+
+	data, err := os.ReadFile(latestWALSegment(t))
+	if err != nil {
+		t.Fatalf("Failed to read segment: %v", err)
+	}
+	var seqs []uint64
+	storage.ReadWALSegment(latestWALSegment(t), func(rec storage.WALRecord) { seqs = append(seqs, rec.Seq) })
+	if n := len(seqs); n != 200*102+3 || seqs[n-3] != 200*102+1 || seqs[n-1] != 200*102+3 {
+		t.Fatalf("Expected %d records with consecutive sequence numbers, got %d", 200*102+3, n)
+	}
+
+	// Cut the last batch short: replay drops all of it.
+	if err := os.Truncate(latestWALSegment(t), int64(len(data)-1)); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	reopened, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer reopened.Close()
+	replayed, err := reopened.Replay()
+	if err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+	if _, ok := replayed["txn2"]; ok || replayed["a"].Value != "200" || replayed["b"].Value != "200" {
+		t.Errorf("Expected the torn batch to be dropped whole, got %v", replayed)
+	}
+}
+
+// TestWriterDeleteRange verifies that a range delete hides the keys of older
+// data in the Memtable and SSTables, but not keys written after it, through
+// every read path, before and after a flush and across WAL replay.
+func TestWriterDeleteRange(t *testing.T) {
+	defer os.RemoveAll(storage.WALDirectory)
+
+	os.RemoveAll(storage.WALDirectory)
+	tree, err := storage.OpenLSMTree(t.TempDir(), storage.DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer tree.Close()
+	flushBatches(t, tree,
+		map[string]string{"a": "1", "b": "1", "c": "1", "d": "1", "e": "1", "f": "1"},
+		map[string]string{"c": "2", "g": "2"},
+	)
+
+	wal, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to initialize WAL: %v", err)
+	}
+	memtable := storage.NewMemtable(storage.DefaultMemtableOptions(), func(it *storage.MemtableIterator, seq uint64) error {
+		if err := tree.FlushMemtable(it); err != nil {
+			t.Errorf("FlushMemtable failed: %v", err)
+		}
+		return nil
+	})
+	writer := storage.NewWriter(wal, memtable, storage.DefaultLimits())
+
+	writer.Put("d", "3", "")
+	if _, err := writer.DeleteRange("b", "e", ""); err != nil {
+		t.Fatalf("DeleteRange failed: %v", err)
+	}
+	writer.Put("c", "4", "")
+	if _, err := writer.DeleteRange("e", "e", ""); !errors.Is(err, storage.ErrInvalidRange) {
+		t.Errorf("Expected ErrInvalidRange for an empty range, got %v", err)
+	}
+
+	want := map[string]string{"a": "1", "c": "4", "e": "1", "f": "1", "g": "2"}
+	check := func(stage string, iters []storage.Iterator) {
+		t.Helper()
+		it := storage.NewMergingIterator(iters...)
+		defer it.Close()
+
+		var forward, backward []string
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			forward = append(forward, it.Key()+"="+it.Value())
+		}
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			backward = append([]string{it.Key() + "=" + it.Value()}, backward...)
+		}
+		if expected := []string{"a=1", "c=4", "e=1", "f=1", "g=2"}; !reflect.DeepEqual(forward, expected) || !reflect.DeepEqual(backward, expected) {
+			t.Errorf("%s: expected %v both ways, got %v forwards and %v backwards", stage, expected, forward, backward)
+		}
+		if it.Seek("b"); !it.Valid() || it.Key() != "c" {
+			t.Errorf("%s: expected a seek into the range to land on c", stage)
+		}
+	}
+	check("In the Memtable", append(memtable.Iterators(), tree.Iterators()...))
+	for _, key := range []string{"b", "d"} {
+		if entry, ok := memtable.GetEntry(key); !ok || !entry.Tombstone {
+			t.Errorf("Expected a tombstone for %s in the Memtable, got %+v", key, entry)
+		}
+	}
+
+	memtable.Flush()
+	memtable.Close()
+	check("Flushed", tree.Iterators())
+	for _, key := range []string{"b", "d"} {
+		if _, err := tree.Get(key); err != storage.ErrKeyNotFound {
+			t.Errorf("Expected %s to be deleted on disk, got %v", key, err)
+		}
+	}
+	if got, err := tree.GetRange("a", "z"); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v in range, got %v (err=%v)", want, got, err)
+	}
+	wal.Close()
+
+	reopened, err := storage.NewWAL()
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer reopened.Close()
+	replayed := storage.NewMemtable(storage.DefaultMemtableOptions(), nil)
+	defer replayed.Close()
+	var ranges []string
+	err = reopened.ReplayRecords(func(rec storage.WALRecord) {
+		if rec.End != "" {
+			ranges = append(ranges, rec.Key+"-"+rec.End)
+		}
+		replayed.ApplyBatch(rec)
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+	if !reflect.DeepEqual(ranges, []string{"b-e"}) {
+		t.Errorf("Expected the range delete to be replayed as one record, got %v", ranges)
+	}
+	if got, _ := replayed.Get("c"); got != "4" {
+		t.Errorf("Expected c=4 after replay, got %q", got)
+	}
+	if _, ok := replayed.Get("d"); ok {
+		t.Errorf("Expected d to stay deleted after replay")
+	}
+}
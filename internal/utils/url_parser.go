@@ -1,12 +1,22 @@
 package utils
 
-import "strings"
+import (
+	"net/url"
+	"strings"
+)
 
-// GetKeyFromPath extracts the key from a URL path like "/kv/{key}"
+// GetKeyFromPath extracts the key from an escaped URL path like "/kv/{key}".
+// The key is the whole remainder of the path, slashes included, unescaped,
+// so "/kv/users%2F42/profile" names the key "users/42/profile". It returns
+// an empty string if there is no key or the escaping is invalid.
 func GetKeyFromPath(path string) string {
-	parts := strings.Split(path, "/")
+	parts := strings.SplitN(path, "/", 3)
 	if len(parts) < 3 {
 		return ""
 	}
-	return parts[2]
+	key, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return ""
+	}
+	return key
 }
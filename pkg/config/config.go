@@ -4,15 +4,35 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+
+	"moniepoint/internal/handler"
+	"moniepoint/internal/storage"
 )
 
 // Config holds the application configuration.
 type Config struct {
-	Host               string `json:"host"`
-	Port               int    `json:"port"`
-	WALPath            string `json:"wal_path"`
-	SSTablePath        string `json:"sstable_path"`
-	MemtableMaxEntries int    `json:"memtable_max_entries"`
+	Host                string `json:"host"`
+	Port                int    `json:"port"`
+	WALPath             string `json:"wal_path"`
+	WALDurability       string `json:"wal_durability"`        // sync, group or interval
+	WALGroupCommitWait  int    `json:"wal_group_commit_wait"` // group: microseconds a writer waits for others to share its fsync
+	WALSyncInterval     int    `json:"wal_sync_interval"`     // interval: milliseconds between fsyncs
+	SSTableDir          string `json:"sstable_dir"`           // SSTable files and MANIFEST
+	MemtableMaxBytes    int64  `json:"memtable_max_bytes"`    // keys + values + per-record overhead
+	MemoryBudget        int64  `json:"memory_budget"`         // bytes shared by memtables, block cache and indexes; negative disables
+	BlockCacheSize      int64  `json:"block_cache_size"`      // bytes; 0 takes what the memory budget leaves, negative disables
+	BlockCacheIndexes   bool   `json:"block_cache_indexes"`   // cache SSTable indexes and Bloom filters instead of pinning them
+	BloomBitsPerKey     int    `json:"bloom_bits_per_key"`    // negative disables SSTable Bloom filters
+	SSTableCompression  string `json:"sstable_compression"`   // codec for new SSTable blocks: none or flate
+	CompactionRateLimit int64  `json:"compaction_rate_limit"` // bytes/sec; negative disables throttling
+	CompactionStrategy  string `json:"compaction_strategy"`   // leveled, size-tiered or time-window
+	CompactionWindow    int    `json:"compaction_window"`     // time-window: window width in seconds
+	CompactionRetention int    `json:"compaction_retention"`  // time-window: seconds to keep a window; 0 keeps forever
+	MaxKeyBytes         int    `json:"max_key_bytes"`         // write limits: negative disables
+	MaxValueBytes       int    `json:"max_value_bytes"`       // negative disables
+	MaxBatchEntries     int    `json:"max_batch_entries"`     // negative disables
+	MaxBatchBytes       int    `json:"max_batch_bytes"`       // keys + values of a batch; negative disables
+	MaxRequestBytes     int64  `json:"max_request_bytes"`     // write request bodies; negative disables
 }
 
 // LoadConfig reads the config file or sets defaults.
@@ -21,11 +41,25 @@ func LoadConfig(filePath string) (*Config, error) {
 	if err != nil {
 		fmt.Println("Config file not found, using default settings")
 		return &Config{
-			Host:               "0.0.0.0",
-			Port:               8080,
-			WALPath:            "data/wal.log",
-			SSTablePath:        "data/sstable.db",
-			MemtableMaxEntries: 1000, // default maximum entries for the Memtable
+			Host:                "0.0.0.0",
+			Port:                8080,
+			WALPath:             "data/wal.log",
+			WALDurability:       "group",
+			WALGroupCommitWait:  1000,
+			WALSyncInterval:     500,
+			SSTableDir:          "data/sstables",
+			MemtableMaxBytes:    4 * 1024 * 1024, // default maximum size of the Memtable
+			MemoryBudget:        256 * 1024 * 1024,
+			BloomBitsPerKey:     10, // ~1% false-positive rate
+			SSTableCompression:  "flate",
+			CompactionRateLimit: 16 * 1024 * 1024,
+			CompactionStrategy:  "leveled",
+			CompactionWindow:    3600,
+			MaxKeyBytes:         storage.DefaultMaxKeyBytes,
+			MaxValueBytes:       storage.DefaultMaxValueBytes,
+			MaxBatchEntries:     storage.DefaultMaxBatchEntries,
+			MaxBatchBytes:       storage.DefaultMaxBatchBytes,
+			MaxRequestBytes:     handler.DefaultMaxRequestBytes,
 		}, nil
 	}
 	defer file.Close()
@@ -48,11 +82,53 @@ func LoadConfig(filePath string) (*Config, error) {
 	if config.WALPath == "" {
 		config.WALPath = "data/wal.log"
 	}
-	if config.SSTablePath == "" {
-		config.SSTablePath = "data/sstable.db"
+	if config.WALDurability == "" {
+		config.WALDurability = "group"
+	}
+	if config.WALGroupCommitWait == 0 {
+		config.WALGroupCommitWait = 1000
+	}
+	if config.WALSyncInterval == 0 {
+		config.WALSyncInterval = 500
+	}
+	if config.SSTableDir == "" {
+		config.SSTableDir = "data/sstables"
+	}
+	if config.MemtableMaxBytes == 0 {
+		config.MemtableMaxBytes = 4 * 1024 * 1024
+	}
+	if config.MemoryBudget == 0 {
+		config.MemoryBudget = 256 * 1024 * 1024
+	}
+	if config.BloomBitsPerKey == 0 {
+		config.BloomBitsPerKey = 10
+	}
+	if config.SSTableCompression == "" {
+		config.SSTableCompression = "flate"
+	}
+	if config.CompactionRateLimit == 0 {
+		config.CompactionRateLimit = 16 * 1024 * 1024
+	}
+	if config.CompactionStrategy == "" {
+		config.CompactionStrategy = "leveled"
+	}
+	if config.CompactionWindow == 0 {
+		config.CompactionWindow = 3600
+	}
+	if config.MaxKeyBytes == 0 {
+		config.MaxKeyBytes = storage.DefaultMaxKeyBytes
+	}
+	if config.MaxValueBytes == 0 {
+		config.MaxValueBytes = storage.DefaultMaxValueBytes
+	}
+	if config.MaxBatchEntries == 0 {
+		config.MaxBatchEntries = storage.DefaultMaxBatchEntries
+	}
+	if config.MaxBatchBytes == 0 {
+		config.MaxBatchBytes = storage.DefaultMaxBatchBytes
 	}
-	if config.MemtableMaxEntries == 0 {
-		config.MemtableMaxEntries = 1000
+	if config.MaxRequestBytes == 0 {
+		config.MaxRequestBytes = handler.DefaultMaxRequestBytes
 	}
 
 	return config, nil